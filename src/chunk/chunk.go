@@ -0,0 +1,271 @@
+// Content-defined chunking, and a store of deduplicated chunks.
+//
+// A Chunker splits a stream into chunks whose boundaries depend only
+// on the nearby content, using a gear rolling hash, so that inserting
+// or removing data only changes the chunks around the change.  Files
+// that are renamed, moved, or only partly changed therefore mostly
+// produce chunks that have been seen before.
+//
+// A Store keeps each distinct chunk once, named by the SHA-256 of its
+// contents, and compressed.
+
+package chunk
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Chunk sizes.  Boundaries are never placed closer than MinSize, and
+// always placed by MaxSize.  Between those, each position has a one in
+// 2^boundaryBits chance of being a boundary, so chunks average a
+// little over a megabyte.
+const (
+	MinSize = 256 << 10
+	MaxSize = 4 << 20
+)
+
+const boundaryBits = 20
+const boundaryMask = 1<<boundaryBits - 1
+
+// The gear table.  This must never change, or the chunks of
+// unchanged files would no longer match those already stored.
+var gear = makeGear()
+
+func makeGear() (table [256]uint64) {
+	// splitmix64, from a fixed seed.
+	state := uint64(0x676f6261636b)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}
+
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	len int
+	eof bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxSize)}
+}
+
+// Return the next chunk of the stream, or io.EOF at the end.
+func (c *Chunker) Next() (data []byte, err error) {
+	err = c.fill()
+	if err != nil {
+		return
+	}
+	if c.len == 0 {
+		err = io.EOF
+		return
+	}
+
+	size := boundary(c.buf[:c.len])
+	data = make([]byte, size)
+	copy(data, c.buf[:size])
+	copy(c.buf, c.buf[size:c.len])
+	c.len -= size
+	return
+}
+
+// Read until the buffer holds at least MaxSize bytes, or the input is
+// exhausted.
+func (c *Chunker) fill() (err error) {
+	for !c.eof && c.len < MaxSize {
+		var n int
+		n, err = c.r.Read(c.buf[c.len:])
+		c.len += n
+		if err == io.EOF {
+			c.eof = true
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Find the length of the first chunk of data.
+func boundary(data []byte) int {
+	if len(data) <= MinSize {
+		return len(data)
+	}
+	limit := len(data)
+	if limit > MaxSize {
+		limit = MaxSize
+	}
+
+	var hash uint64
+	for i := MinSize; i < limit; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&boundaryMask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
+
+// The name of a chunk's contents.
+func ID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type Store struct {
+	Dir string
+}
+
+// Open the chunk store within dir, creating it if necessary.
+func Open(dir string) (s *Store, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	s = &Store{Dir: dir}
+	return
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.Dir, id[:2], id)
+}
+
+// Is the chunk present?
+func (s *Store) Has(id string) bool {
+	_, err := os.Lstat(s.path(id))
+	return err == nil
+}
+
+// Add a chunk to the store, if it isn't already present.  Returns
+// the chunk's ID, and the number of bytes written to the store, which
+// is zero when the chunk was already present.
+func (s *Store) Put(data []byte) (id string, added int64, err error) {
+	id = ID(data)
+	if s.Has(id) {
+		return
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return
+	}
+
+	name := s.path(id)
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".chunk")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	added = int64(buf.Len())
+	return
+}
+
+// Read a chunk back, checking that its contents match its ID.
+func (s *Store) Get(id string) (data []byte, err error) {
+	if len(id) != 2*sha256.Size {
+		err = errors.New(fmt.Sprintf("Invalid chunk ID %q", id))
+		return
+	}
+
+	packed, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return
+	}
+
+	data, err = io.ReadAll(flate.NewReader(bytes.NewReader(packed)))
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Chunk %s: %s", id, err))
+		return
+	}
+
+	if ID(data) != id {
+		err = errors.New(fmt.Sprintf("Chunk %s is corrupt", id))
+	}
+	return
+}
+
+// Remove a chunk, returning the space it took.
+func (s *Store) Remove(id string) (size int64, err error) {
+	fi, err := os.Lstat(s.path(id))
+	if err != nil {
+		return
+	}
+	err = os.Remove(s.path(id))
+	if err == nil {
+		size = fi.Size()
+	}
+	return
+}
+
+// List the IDs of all of the chunks in the store, sorted.
+func (s *Store) List() (ids []string, err error) {
+	dirs, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		var names []os.DirEntry
+		names, err = os.ReadDir(filepath.Join(s.Dir, d.Name()))
+		if err != nil {
+			return
+		}
+		for _, n := range names {
+			if len(n.Name()) == 2*sha256.Size && n.Name()[:2] == d.Name() {
+				ids = append(ids, n.Name())
+			}
+		}
+	}
+
+	sort.Strings(ids)
+	return
+}
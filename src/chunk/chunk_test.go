@@ -0,0 +1,96 @@
+// Test chunking and the chunk store.
+
+package chunk_test
+
+import (
+	"bytes"
+	"chunk"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunks(t *testing.T, data []byte) (ids []string) {
+	c := chunk.NewChunker(bytes.NewReader(data))
+	for {
+		piece, err := c.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		if len(piece) > chunk.MaxSize {
+			t.Errorf("Chunk of %d bytes is too large", len(piece))
+		}
+		ids = append(ids, chunk.ID(piece))
+	}
+}
+
+func TestChunkerShift(t *testing.T) {
+	data := make([]byte, 20<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	before := chunks(t, data)
+	if len(before) < 5 {
+		t.Fatalf("Only %d chunks", len(before))
+	}
+
+	// Inserting near the start should only change the first chunk
+	// or so.
+	shifted := append([]byte("inserted"), data...)
+	after := chunks(t, shifted)
+
+	have := make(map[string]bool)
+	for _, id := range after {
+		have[id] = true
+	}
+	missing := 0
+	for _, id := range before {
+		if !have[id] {
+			missing++
+		}
+	}
+	if missing > 2 {
+		t.Errorf("%d of %d chunks changed after an insertion", missing, len(before))
+	}
+}
+
+func TestStore(t *testing.T) {
+	s, err := chunk.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("chunk "), 1000)
+	id, added, err := s.Put(data)
+	if err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if added == 0 {
+		t.Errorf("First Put added nothing")
+	}
+
+	_, added, err = s.Put(data)
+	if err != nil || added != 0 {
+		t.Errorf("Second Put: added %d, %v", added, err)
+	}
+
+	back, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if !bytes.Equal(back, data) {
+		t.Errorf("Chunk came back different")
+	}
+
+	ids, err := s.List()
+	if err != nil || len(ids) != 1 || ids[0] != id {
+		t.Errorf("List: %v, %v", ids, err)
+	}
+
+	size, err := s.Remove(id)
+	if err != nil || size == 0 || s.Has(id) {
+		t.Errorf("Remove: %v", err)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tsync"
+)
+
+// Creation of tar archives of a tree, along with their manifests.
+// This is run as an internal command, through sudo, since it needs
+// to be able to read everything in the snapshot.  The tar stream is
+// written to stdout, to be compressed (and possibly encrypted) by
+// the rest of the pipeline.
+
+// Internal command: tar-create -name name [-prev manifest] src manifest
+func tarCreateCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("tar-create", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the archive being created")
+	prev := flags.String("prev", "", "manifest of the previous archive, for an incremental")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	args = flags.Args()
+
+	if len(args) != 2 || *name == "" {
+		err = errors.New("tar-create expects -name, a source and a manifest")
+		return
+	}
+
+	var parent *Manifest
+	if *prev != "" {
+		parent, err = readManifest(*prev)
+		if err != nil {
+			return
+		}
+	}
+
+	// The manifest may be in a directory of the user's own, so a
+	// symlink there isn't followed.
+	mfile, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0666)
+	if err != nil {
+		return
+	}
+	defer mfile.Close()
+
+	// The manifest belongs to whoever ran us through sudo.
+	chownToSudoUser(mfile)
+
+	ac := &archiveCreator{
+		name:  *name,
+		src:   args[0],
+		tw:    tar.NewWriter(os.Stdout),
+		links: make(map[uint64]string),
+	}
+
+	header := &ManifestHeader{
+		Name:    *name,
+		Source:  args[0],
+		Created: time.Now(),
+	}
+	if parent != nil {
+		header.Parent = parent.Header.Name
+		ac.prev = parent.ByPath()
+	}
+
+	ac.mw, err = newManifestWriter(mfile, header)
+	if err != nil {
+		return
+	}
+
+	err = filepath.WalkDir(ac.src, ac.add)
+	if err != nil {
+		return
+	}
+
+	err = ac.tw.Close()
+	if err != nil {
+		return
+	}
+
+	err = mfile.Sync()
+	return
+}
+
+type archiveCreator struct {
+	name  string
+	src   string
+	tw    *tar.Writer
+	mw    *manifestWriter
+	prev  map[string]*ManifestEntry
+	links map[uint64]string
+}
+
+func (ac *archiveCreator) add(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(ac.src, path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	entry, st, err := newManifestEntry(path, rel, fi)
+	if err != nil {
+		return err
+	}
+	entry.Archive = ac.name
+
+	// Tar can't hold sockets, and they have no content anyway.
+	// They are only recorded in the manifest.
+	if entry.Type == "s" {
+		entry.Archive = ""
+		return ac.mw.Add(entry)
+	}
+
+	// Later links to a file are stored as hardlinks.  These are
+	// always stored in full, so that the link within the archive
+	// refers to a file in the same archive.
+	if entry.Type != "d" && st.Nlink > 1 {
+		if first, ok := ac.links[st.Ino]; ok {
+			entry.Type = "h"
+			entry.Link = first
+			entry.Size = 0
+
+			hdr := &tar.Header{
+				Typeflag: tar.TypeLink,
+				Name:     rel,
+				Linkname: first,
+				ModTime:  fi.ModTime(),
+				Format:   tar.FormatPAX,
+			}
+			err = ac.tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			return ac.mw.Add(entry)
+		}
+		ac.links[st.Ino] = rel
+	}
+
+	// Unchanged files in an incremental are only recorded in the
+	// manifest, pointing at the archive that has their data.
+	if old, ok := ac.prev[rel]; ok && entry.Type == "f" && st.Nlink == 1 &&
+		old.Sha256 != "" && old.Same(entry) {
+		entry.Sha256 = old.Sha256
+		entry.Archive = old.Archive
+		return ac.mw.Add(entry)
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, entry.Link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if entry.Type == "d" {
+		hdr.Name += "/"
+	}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.Format = tar.FormatPAX
+
+	attrs, err := tsync.GetXattrs(path)
+	if err != nil {
+		return err
+	}
+	if len(attrs) > 0 {
+		hdr.PAXRecords = make(map[string]string)
+		for k, v := range attrs {
+			hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+		}
+	}
+
+	err = ac.tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	if entry.Type == "f" {
+		var f *os.File
+		f, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		sum := sha256.New()
+		_, err = io.Copy(ac.tw, io.TeeReader(f, sum))
+		if err != nil {
+			return err
+		}
+		entry.Sha256 = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	return ac.mw.Add(entry)
+}
+
+// Build the manifest entry describing a node of a tree, without any
+// checksum.
+func newManifestEntry(path, rel string, fi os.FileInfo) (entry *ManifestEntry, st *syscall.Stat_t, err error) {
+	st = fi.Sys().(*syscall.Stat_t)
+
+	entry = &ManifestEntry{
+		Path:  rel,
+		Mode:  st.Mode,
+		Uid:   int(st.Uid),
+		Gid:   int(st.Gid),
+		Mtime: fi.ModTime().UnixNano(),
+	}
+
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		entry.Type = "f"
+		entry.Size = st.Size
+	case syscall.S_IFDIR:
+		entry.Type = "d"
+	case syscall.S_IFLNK:
+		entry.Type = "l"
+		entry.Link, err = os.Readlink(path)
+	case syscall.S_IFCHR:
+		entry.Type = "c"
+		entry.Rdev = uint64(st.Rdev)
+	case syscall.S_IFBLK:
+		entry.Type = "b"
+		entry.Rdev = uint64(st.Rdev)
+	case syscall.S_IFIFO:
+		entry.Type = "p"
+	case syscall.S_IFSOCK:
+		entry.Type = "s"
+	}
+	return
+}
+
+// Give a file to the user that invoked sudo, if we were run that way.
+// The other privilege methods are made to pass the user on the same
+// way.
+func chownToSudoUser(f *os.File) {
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return
+	}
+	f.Chown(uid, gid)
+}
+
+// Internal command: tar-verify manifest
+//
+// Read a tar stream from stdin, checking it against the manifest of
+// the archive it came from.
+func tarVerifyCmd(args ...string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("tar-verify expects a manifest")
+		return
+	}
+
+	man, err := readManifest(args[0])
+	if err != nil {
+		return
+	}
+	entries := man.ByPath()
+	seen := make(map[string]bool)
+
+	tr := tar.NewReader(os.Stdin)
+	files := 0
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		name := strings.TrimSuffix(hdr.Name, "/")
+		e, ok := entries[name]
+		if !ok {
+			err = errors.New(fmt.Sprintf("%q is not in the manifest", name))
+			return
+		}
+		seen[name] = true
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		sum := sha256.New()
+		_, err = io.Copy(sum, tr)
+		if err != nil {
+			return
+		}
+		if hex.EncodeToString(sum.Sum(nil)) != e.Sha256 {
+			err = errors.New(fmt.Sprintf("%q doesn't match its checksum", name))
+			return
+		}
+		files++
+	}
+
+	for _, e := range man.Entries {
+		if e.Archive == man.Header.Name && !seen[e.Path] {
+			err = errors.New(fmt.Sprintf("%q is missing from the archive", e.Path))
+			return
+		}
+	}
+
+	fmt.Printf("Verified %d files of %s\n", files, man.Header.Name)
+	return
+}
+
+// Internal command: tar-extract -manifest m -name archive [-prefix path] dest
+//
+// Read a tar stream from stdin, of the named archive, restoring to
+// dest the entries at or below prefix that the manifest (of this or
+// a later incremental) says come from this archive.  The archive the
+// manifest belongs to should be extracted last, since it holds the
+// directories.
+func tarExtractCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("tar-extract", flag.ContinueOnError)
+	manifest := flags.String("manifest", "", "manifest of the snapshot being restored")
+	name := flags.String("name", "", "name of the archive being read")
+	prefix := flags.String("prefix", "", "part of the snapshot to restore")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if flags.NArg() != 1 || *manifest == "" || *name == "" {
+		err = errors.New("tar-extract expects -manifest, -name and a destination")
+		return
+	}
+
+	man, err := readManifest(*manifest)
+	if err != nil {
+		return
+	}
+	entries := man.ByPath()
+
+	x := &extractor{Prefix: *prefix, Dest: flags.Arg(0)}
+	x.plan(man.Entries)
+
+	tr := tar.NewReader(os.Stdin)
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		e, ok := entries[strings.TrimSuffix(hdr.Name, "/")]
+		if !ok || e.Archive != *name {
+			continue
+		}
+
+		var attrs map[string][]byte
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				if attrs == nil {
+					attrs = make(map[string][]byte)
+				}
+				attrs[k[len("SCHILY.xattr."):]] = []byte(v)
+			}
+		}
+
+		err = x.create(e, tr, attrs)
+		if err != nil {
+			return
+		}
+	}
+
+	// Sockets are only in the manifest.
+	if *name == man.Header.Name {
+		for _, e := range man.Entries {
+			if e.Type == "s" {
+				err = x.create(e, nil, nil)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	err = x.finish()
+	return
+}
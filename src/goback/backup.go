@@ -3,12 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
-	"syscall"
 	"time"
 
 	"sudo"
@@ -17,18 +16,50 @@ import (
 // Management of backups themselves.
 
 type Backup struct {
-	conf    Config
-	namer   *Namer
-	host    *Host
-	lvm     *LVInfo
-	logFile *os.File
-	time    time.Time
+	conf     Config
+	namer    *Namer
+	host     *Host
+	lvm      *LVInfo
+	logFile  *os.File
+	logFiles map[*FsInfo]*os.File
+	time     time.Time
+	report   *Report
+
+	// The mirror being pushed to, the engine used to copy to it,
+	// and the statistics for the volume currently being pushed.
+	mirror   string
+	engine   string
+	transfer RsyncStats
+
+	// The detected filesystem types of volumes, by device.
+	fsTypes map[string]string
+
+	// Filesystems left out of this run, because a hook failed.
+	skipped map[*FsInfo]error
+
+	// When set, the only filesystem being pushed, so that its push
+	// hooks run around just its own part.
+	only *FsInfo
 }
 
 func (b *Backup) MakeSnap() (err error) {
 	// Verify that today's snapshot doesn't exist.
 	for _, fs := range b.host.Filesystems {
 		// log.Printf("Checking %s", fs)
+		if fs.Subvolume() {
+			snap := b.subvolSnap(fs)
+			var present bool
+			present, err = fileExists(snap)
+			if err != nil {
+				return
+			}
+			if present {
+				err = errors.New(fmt.Sprintf("Snapshot %s already present", snap))
+				return
+			}
+			continue
+		}
+
 		snap := b.namer.SnapVgName(fs)
 
 		if b.lvm.HasSnap(snap) {
@@ -37,11 +68,40 @@ func (b *Backup) MakeSnap() (err error) {
 		}
 	}
 
-	// Now construct the snapshots.
+	// Consistency groups can't be snapshotted at all on older
+	// kernels, so fail before any are made.
+	for _, group := range b.snapGroups() {
+		if group[0].Group != "" {
+			err = checkFreezeKernel(group[0].Group)
+			if err != nil {
+				return
+			}
+		}
+	}
+
 	for _, fs := range b.host.Filesystems {
-		base := fs.VgName()
-		snap := b.namer.SnapVgName(fs)
-		err = snapshot(base, snap)
+		if !fs.Subvolume() {
+			err = b.checkSnapFsType(fs.VgName())
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// Now construct the snapshots.
+	err = b.runHook("pre-snapshot", nil, "")
+	defer func() {
+		herr := b.runHook("post-snapshot", nil, hookStatus(err))
+		if err == nil {
+			err = herr
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	for _, group := range b.snapGroups() {
+		err = b.snapGroup(group)
 		if err != nil {
 			return
 		}
@@ -50,9 +110,36 @@ func (b *Backup) MakeSnap() (err error) {
 	return
 }
 
+// Snapshot a single filesystem.
+func (b *Backup) snapOne(fs *FsInfo) (err error) {
+	done := logStep("snapshot", "filesystem", fs.Lvname)
+	start := time.Now()
+	base := fs.VgName()
+	snap := b.namer.SnapVgName(fs)
+	if fs.Subvolume() {
+		err = b.snapshotSubvol(fs)
+	} else {
+		err = snapshot(base, snap)
+	}
+	done()
+	if err != nil {
+		return
+	}
+	b.report.AddSnap(&SnapReport{
+		Filesystem: fs.Lvname,
+		Volume:     snap.LV,
+		Size:       b.volSize(base),
+		Duration:   time.Since(start).Round(time.Second),
+	})
+	return
+}
+
 // Invoke gosure on the snapshots.
 func (b *Backup) GoSure() (err error) {
 	for _, fs := range b.host.Filesystems {
+		if _, skipped := b.skipped[fs]; skipped {
+			continue
+		}
 		err = b.goSureOne(fs)
 		if err != nil {
 			return
@@ -63,6 +150,13 @@ func (b *Backup) GoSure() (err error) {
 }
 
 func (b *Backup) goSureOne(fs *FsInfo) (err error) {
+	defer logStep("gosure", "filesystem", fs.Lvname)()
+
+	if fs.Subvolume() {
+		err = b.goSureSubvol(fs)
+		return
+	}
+
 	snap := b.namer.SnapVgName(fs)
 	smount := b.snapName(fs)
 
@@ -71,7 +165,7 @@ func (b *Backup) goSureOne(fs *FsInfo) (err error) {
 	if err != nil {
 		return
 	}
-	defer b.deactivate(snap)
+	defer b.deactivateLater(snap)()
 
 	// for sanity sake, run a fsck.
 	err = b.fsck(snap)
@@ -84,20 +178,26 @@ func (b *Backup) goSureOne(fs *FsInfo) (err error) {
 	if err != nil {
 		return
 	}
-	defer b.umount(snap)
+	defer b.umountLater(snap)()
 
-	err = b.runGosure(fs)
+	err = b.runGosure(fs, smount)
 	if err != nil {
 		return
 	}
 
 	// Remount it rw.
-	err = b.remount(smount, true)
+	err = b.remount(snap, smount, true)
 	if err != nil {
 		return
 	}
 
-	err = b.copyFile(path.Join(fs.Mount, "2sure.dat.gz"), b.snapName(fs))
+	err = b.copySure(fs, smount)
+	return
+}
+
+// Copy the integrity data into the snapshot, now mounted at dir.
+func (b *Backup) copySure(fs *FsInfo, dir string) (err error) {
+	err = b.copyFile(path.Join(fs.Mount, "2sure.dat.gz"), dir)
 	if err != nil {
 		return
 	}
@@ -108,7 +208,7 @@ func (b *Backup) goSureOne(fs *FsInfo) (err error) {
 		return
 	}
 	if exist {
-		err = b.copyFile(backPath, b.snapName(fs))
+		err = b.copyFile(backPath, dir)
 		if err != nil {
 			return
 		}
@@ -123,45 +223,70 @@ func (b *Backup) snapName(fs *FsInfo) string {
 }
 
 func (b *Backup) activate(vol VgName) (err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("lvchange", "-ay", "-K", vol.DevName())
 	cmd = sudo.Sudoify(cmd)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	return
 }
 
 func (b *Backup) deactivate(vol VgName) (err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("lvchange", "-an", vol.DevName())
 	cmd = sudo.Sudoify(cmd)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	return
 }
 
+// Register the deactivation of a volume as a teardown step.  Returns
+// the function that releases it.
+func (b *Backup) deactivateLater(vol VgName) func() {
+	return teardowns.Push("deactivate "+vol.TextName(), func() error {
+		return b.deactivate(vol)
+	})
+}
+
 func (b *Backup) mount(vol VgName, dest string, writable bool) (err error) {
-	sudo.Setup()
+	err = b.checkSnapFsType(vol)
+	if err != nil {
+		return
+	}
+
+	sudo.Setup(runCtx)
 
 	flags := make([]string, 0, 4)
 
 	if !writable {
 		flags = append(flags, "-r")
 	}
+	if opts := b.fsType(vol).MountOpts; len(opts) > 0 {
+		flags = append(flags, "-o", strings.Join(opts, ","))
+	}
 	flags = append(flags, vol.DevName())
 	flags = append(flags, dest)
 
 	cmd := exec.Command("mount", flags...)
 	cmd = sudo.Sudoify(cmd)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	return
 }
 
-func (b *Backup) remount(dest string, writable bool) (err error) {
-	sudo.Setup()
+func (b *Backup) remount(vol VgName, dest string, writable bool) (err error) {
+	if b.fsType(vol).Reopen {
+		err = b.umount(vol)
+		if err != nil {
+			return
+		}
+		err = b.mount(vol, dest, writable)
+		return
+	}
+
+	sudo.Setup(runCtx)
 
 	flag := "ro"
 	if writable {
@@ -172,41 +297,30 @@ func (b *Backup) remount(dest string, writable bool) (err error) {
 	cmd := exec.Command("mount", "-o", flag, dest)
 	cmd = sudo.Sudoify(cmd)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	return
 }
 
 func (b *Backup) umount(vol VgName) (err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("umount", vol.DevName())
 	cmd = sudo.Sudoify(cmd)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	return
 }
 
-func (b *Backup) fsck(vol VgName) (err error) {
-	sudo.Setup()
-
-	cmd := exec.Command("fsck", "-p", "-f", vol.DevName())
-	cmd = sudo.Sudoify(cmd)
-	showCommand(cmd)
-	err = cmd.Run()
-	if err != nil {
-		// Some unsuccessful results are fine.
-		stat := cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
-		log.Printf("Status: %d", stat)
-		if stat == 1 {
-			err = nil
-		}
-	}
-	// Successful error status is fine.
-	return
+// Register the unmounting of a volume as a teardown step.
+func (b *Backup) umountLater(vol VgName) func() {
+	return teardowns.Push("umount "+vol.DevName(), func() error {
+		return b.umount(vol)
+	})
 }
 
-func (b *Backup) runGosure(fs *FsInfo) (err error) {
-	sudo.Setup()
+// Run gosure on the snapshot of a filesystem, found in dir.
+func (b *Backup) runGosure(fs *FsInfo, dir string) (err error) {
+	sudo.Setup(runCtx)
 
 	// TODO: Detect no 2sure.dat.gz file, and run a fresh gosure
 	// instead of this scan.
@@ -215,108 +329,123 @@ func (b *Backup) runGosure(fs *FsInfo) (err error) {
 
 	cmd := exec.Command(gosurePath, "-file", place, "update")
 	cmd = sudo.Sudoify(cmd)
-	cmd.Dir = b.snapName(fs)
+	cmd.Dir = dir
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	if err != nil {
 		return
 	}
 
 	// Run signoff and capture the output.
-	b.message("sure of %s (%s) on %s", fs.Lvname, fs.Mount,
+	b.message(fs, "sure of %s (%s) on %s", fs.Lvname, fs.Mount,
 		b.time.Format("2006-01-02 15:04"))
 
 	cmd = exec.Command(gosurePath, "-file", place, "signoff")
 	cmd = sudo.Sudoify(cmd)
-	cmd.Dir = b.snapName(fs)
-	cmd.Stdout = b.logFile
+	cmd.Dir = dir
+	var changes lineCounter
+	cmd.Stdout = io.MultiWriter(b.surelog(fs), &changes)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
+
+	if rep := b.report.snap(fs); rep != nil {
+		rep.Changes = changes.lines
+	}
 
 	return
 }
 
 func (b *Backup) copyFile(from, to string) (err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("cp", "-p", from, to)
 	cmd = sudo.Sudoify(cmd)
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
 	return
 }
 
-func (b *Backup) rsync(from, to string) (err error) {
-	sudo.Setup()
+// Copy the tree at from to to, with the sync engine configured for
+// the current mirror, logging the changes made.  linkDest, if not
+// empty, is a previous copy to hardlink unchanged files from.
+func (b *Backup) syncTree(vol VgName, from, to, linkDest string) (err error) {
+	cmd, err := b.syncCommand(from, to, linkDest)
+	if err != nil {
+		return
+	}
+
+	err = b.runSync(vol, cmd)
+	return
+}
 
-	cmd := exec.Command("rsync", "-aXHi", "--delete", from, to)
+// Run a sync command for a volume, with privileges, logging and
+// gathering statistics from its output.
+func (b *Backup) runSync(vol VgName, cmd *exec.Cmd) (err error) {
+	sudo.Setup(runCtx)
 	cmd = sudo.Sudoify(cmd)
 
-	// TODO: Setup an rsync log as well.
-	cmd.Stdout = os.Stdout
+	var stats RsyncStats
+	out := []io.Writer{commandStdout(), &stats}
+
+	log, err := b.openRsyncLog(vol)
+	if err != nil {
+		return
+	}
+	if log != nil {
+		defer log.Close()
+		out = append(out, log)
+	}
+
+	cmd.Stdout = io.MultiWriter(out...)
 	cmd.Stderr = os.Stderr
 	showCommand(cmd)
-	err = cmd.Run()
+	err = runCommand(cmd)
+
+	b.transfer.Add(&stats)
 	return
 }
 
 func btrSnap(from, to string) (err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("btrfs", "subvolume", "snapshot", "-r", from, to)
 	cmd = sudo.Sudoify(cmd)
 
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = commandStdout()
 	cmd.Stderr = os.Stderr
 	showCommand(cmd)
-	err = cmd.Run()
-	return
-}
-
-func (b *Backup) LogRotate() (err error) {
-	lname := b.host.Surelog
-	bakname := lname + ".bak"
-
-	err = os.Remove(bakname)
-	if err != nil && !os.IsNotExist(err) {
-		return
-	}
-	err = nil
-
-	err = os.Rename(lname, bakname)
-	if err != nil && !os.IsNotExist(err) {
-		return
-	}
-
-	file, err := os.Create(lname)
-	if err != nil {
-		return
-	}
-
-	b.logFile = file
-
+	err = runCommand(cmd)
 	return
 }
 
-func (b *Backup) message(format string, a ...interface{}) {
-	text := fmt.Sprintf(format, a...)
-	hyphens := strings.Map(func(a rune) rune { return '-' }, text)
-	fmt.Fprintf(b.logFile, "%s\n", hyphens)
-	fmt.Fprintf(b.logFile, "%s\n", text)
-	fmt.Fprintf(b.logFile, "%s\n", hyphens)
-}
-
 // Return a list of all source volumes matching those specified in the
 // backup.
-func (b *Backup) GetSources() (src []VgName, err error) {
-	src = make([]VgName, 0)
+func (b *Backup) GetSources() (src []Source, err error) {
+	src = make([]Source, 0)
 
 	for _, fs := range b.host.Filesystems {
+		if _, skipped := b.skipped[fs]; skipped {
+			continue
+		}
+		if b.only != nil && fs != b.only {
+			continue
+		}
+
 		re := fs.MatchRe()
 
+		if fs.Subvolume() {
+			for _, name := range subvolSnapshots(fs) {
+				src = append(src, Source{
+					VgName: VgName{LV: name},
+					Path:   path.Join(fs.SnapshotDir(), name),
+				})
+			}
+			continue
+		}
+
 		for _, vol := range b.lvm.Volumes {
 			if vol.VG == fs.Volgroup && re.FindString(vol.LV) != "" {
-				src = append(src, vol.VgName())
+				src = append(src, Source{VgName: vol.VgName()})
 			}
 		}
 	}
@@ -324,8 +453,45 @@ func (b *Backup) GetSources() (src []VgName, err error) {
 	return
 }
 
+// Mount a source read-only at dest: an LVM snapshot is activated
+// and mounted, and a btrfs snapshot is bind mounted.  The release
+// function, which must be called even if there is an error, undoes
+// whatever was done.
+func (b *Backup) mountSource(src Source, dest string) (release func(), err error) {
+	var steps []func()
+	release = func() {
+		for i := len(steps) - 1; i >= 0; i-- {
+			steps[i]()
+		}
+	}
+
+	if src.Path != "" {
+		err = b.privileged("mount", "-o", "bind,ro", src.Path, dest)
+		if err != nil {
+			return
+		}
+		steps = append(steps, teardowns.Push("umount "+dest, func() error {
+			return b.umountDir(dest)
+		}))
+		return
+	}
+
+	err = b.activate(src.VgName)
+	if err != nil {
+		return
+	}
+	steps = append(steps, b.deactivateLater(src.VgName))
+
+	err = b.mount(src.VgName, dest, false)
+	if err != nil {
+		return
+	}
+	steps = append(steps, b.umountLater(src.VgName))
+	return
+}
+
 func snapshot(base, snap VgName) (err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("lvcreate", "-s",
 		base.TextName(), "-n", snap.LV)
@@ -333,16 +499,16 @@ func snapshot(base, snap VgName) (err error) {
 
 	showCommand(cmd)
 
-	err = cmd.Run()
+	err = runCommand(cmd)
 
 	return
 }
 
 func showCommand(cmd *exec.Cmd) {
-	log.Printf("%s", strings.Join(cmd.Args, " "))
-
 	if cmd.Dir != "" {
-		log.Printf("  in dir: %q", cmd.Dir)
+		runLog().Info("Running command", "exec", strings.Join(cmd.Args, " "), "dir", cmd.Dir)
+	} else {
+		runLog().Info("Running command", "exec", strings.Join(cmd.Args, " "))
 	}
 }
 
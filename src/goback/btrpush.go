@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"time"
 )
 
 // A btrfs mirror mirrors to snapshots within a btrfs subvolume.
@@ -26,23 +27,28 @@ func (m *btrMirror) Push(b *Backup) (err error) {
 		return
 	}
 
-	sort.Sort(VgNameSlice(src))
+	sort.Sort(SourceSlice(src))
 
 	for _, vg := range src {
 		base := m.Prefix + "/" + undate(vg.LV)
 		btr := m.Prefix + "/" + vg.LV
-		fmt.Printf("Sync: %s to %s then %s\n",
-			vg.TextName(), base, btr)
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
+		runLog().Info("Pushing volume", "source", vg.TextName(),
+			"base", base, "dest", btr)
 
 		err = m.pushVol(vg, base, btr)
 		if err != nil {
+			done()
 			return
 		}
 
 		err = btrSnap(base, btr)
+		done()
 		if err != nil {
 			return
 		}
+		m.backup.pushed(vg.VgName, start)
 	}
 
 	return
@@ -50,13 +56,13 @@ func (m *btrMirror) Push(b *Backup) (err error) {
 
 // Filter out the source volumes to only those that aren't present in
 // the btr tree.
-func (m *btrMirror) filterSource(src []VgName) (result []VgName, err error) {
+func (m *btrMirror) filterSource(src []Source) (result []Source, err error) {
 	dvols, err := m.scanDest()
 	if err != nil {
 		return
 	}
 
-	result = make([]VgName, 0)
+	result = make([]Source, 0)
 
 	for _, vol := range src {
 		_, ok := dvols[vol.LV]
@@ -69,16 +75,21 @@ func (m *btrMirror) filterSource(src []VgName) (result []VgName, err error) {
 }
 
 func (m *btrMirror) scanDest() (names map[string]bool, err error) {
-	fi, err := os.Stat(m.Prefix)
+	return scanNames(m.Prefix)
+}
+
+// Return the set of names within a destination directory.
+func scanNames(dir string) (names map[string]bool, err error) {
+	fi, err := os.Stat(dir)
 	if err != nil {
 		return
 	}
 	if !fi.IsDir() {
-		msg := fmt.Sprintf("%q is not a directory", m.Prefix)
+		msg := fmt.Sprintf("%q is not a directory", dir)
 		err = errors.New(msg)
 		return
 	}
-	d, err := os.Open(m.Prefix)
+	d, err := os.Open(dir)
 	if err != nil {
 		return
 	}
@@ -98,22 +109,15 @@ func (m *btrMirror) scanDest() (names map[string]bool, err error) {
 	return
 }
 
-func (m *btrMirror) pushVol(src VgName, base, dest string) (err error) {
-
-	// Activate the source.
-	err = m.backup.activate(src)
-	if err != nil {
-		return
-	}
-	defer m.backup.deactivate(src)
+func (m *btrMirror) pushVol(src Source, base, dest string) (err error) {
 
-	err = m.backup.mount(src, "/mnt/old", false)
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
 	if err != nil {
 		return
 	}
-	defer m.backup.umount(src)
 
-	err = m.backup.rsync("/mnt/old/.", base)
+	err = m.backup.syncTree(src.VgName, "/mnt/old/.", base, "")
 	if err != nil {
 		return
 	}
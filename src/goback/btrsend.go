@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"sudo"
+)
+
+// A btrfs send mirror keeps a local chain of read-only snapshots,
+// the same way a btrfs mirror does, and then ships each new snapshot
+// elsewhere with 'btrfs send', incrementally against the most recent
+// snapshot that the other side already has (a new destination starts
+// with a full send of the newest snapshot).  The stream either goes
+// straight into 'btrfs receive' on a destination path, or is written
+// to a file.
+//
+// The snapshots the other side has are found by UUID.  A subvolume
+// made by 'btrfs receive' carries the UUID of the snapshot it was
+// sent from as its "Received UUID".  Stream files have a small JSON
+// description written alongside them recording the same thing.
+// When stream files are encrypted, the description is left in the
+// clear, so that the incremental parent can still be found.
+type btrSendMirror struct {
+	local   btrMirror
+	Receive string
+	File    string
+	Crypt   *archiveCrypt
+	backup  *Backup
+}
+
+// Written alongside each stream file.
+type btrStreamInfo struct {
+	Name       string
+	UUID       string
+	Parent     string `json:",omitempty"`
+	ParentUUID string `json:",omitempty"`
+	Size       int64
+	Date       time.Time
+}
+
+func (m *btrSendMirror) Push(b *Backup) (err error) {
+	m.backup = b
+
+	// Bring the local chain up to date.
+	err = m.local.Push(b)
+	if err != nil {
+		return
+	}
+
+	have, err := m.destUUIDs()
+	if err != nil {
+		return
+	}
+
+	chains, err := m.localChains()
+	if err != nil {
+		return
+	}
+
+	for _, chain := range chains {
+		err = m.sendChain(chain, have)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Send the snapshots of a chain newer than the newest one the other
+// side has, each incrementally against the one before.  Older
+// snapshots, including any pruned at the destination, aren't sent
+// again.  When the other side has none of the chain, only the newest
+// snapshot is sent, in full.
+func (m *btrSendMirror) sendChain(chain []string, have map[string]bool) (err error) {
+	uuids := make([]string, len(chain))
+	start, parent := 0, ""
+	for i := len(chain) - 1; i >= 0; i-- {
+		uuids[i], _, err = subvolUUIDs(path.Join(m.local.Prefix, chain[i]))
+		if err != nil {
+			return
+		}
+		if have[uuids[i]] {
+			start, parent = i+1, chain[i]
+			break
+		}
+	}
+	if parent == "" && len(chain) > 0 {
+		start = len(chain) - 1
+	}
+
+	for i := start; i < len(chain); i++ {
+		err = m.send(chain[i], uuids[i], parent)
+		if err != nil {
+			return
+		}
+		parent = chain[i]
+	}
+
+	return
+}
+
+// Return the local snapshots for each filesystem, oldest first.
+func (m *btrSendMirror) localChains() (chains [][]string, err error) {
+	names, err := scanNames(m.local.Prefix)
+	if err != nil {
+		return
+	}
+
+	for _, fs := range m.backup.host.Filesystems {
+		if m.backup.only != nil && fs != m.backup.only {
+			continue
+		}
+		re := fs.MatchRe()
+		chain := make([]string, 0)
+		for n := range names {
+			if re.MatchString(n) {
+				chain = append(chain, n)
+			}
+		}
+		sort.Strings(chain)
+		chains = append(chains, chain)
+	}
+
+	return
+}
+
+// Send a single snapshot, incrementally from parent if it isn't
+// empty.
+func (m *btrSendMirror) send(snap, uuid, parent string) (err error) {
+	done := logStep("send", "filesystem", undate(snap))
+	defer done()
+	start := time.Now()
+
+	sudo.Setup(runCtx)
+
+	args := []string{"send"}
+	var parentUUID string
+	if parent != "" {
+		args = append(args, "-p", path.Join(m.local.Prefix, parent))
+		parentUUID, _, err = subvolUUIDs(path.Join(m.local.Prefix, parent))
+		if err != nil {
+			return
+		}
+	}
+	args = append(args, path.Join(m.local.Prefix, snap))
+
+	send := exec.Command("btrfs", args...)
+	send = sudo.Sudoify(send)
+	send.Stderr = os.Stderr
+	showCommand(send)
+
+	var size int64
+	if m.Receive != "" {
+		recv := exec.Command("btrfs", "receive", m.Receive)
+		recv = sudo.Sudoify(recv)
+		recv.Stdout = commandStdout()
+		recv.Stderr = os.Stderr
+		showCommand(recv)
+
+		size, err = runPipeline(send, recv)
+		if err != nil {
+			return
+		}
+	} else {
+		info := &btrStreamInfo{
+			Name:       snap,
+			UUID:       uuid,
+			Parent:     parent,
+			ParentUUID: parentUUID,
+			Date:       time.Now(),
+		}
+		size, err = m.writeStream(send, info)
+		if err != nil {
+			return
+		}
+	}
+
+	m.backup.report.AddPush(&PushReport{
+		Volume:   snap + " (sent)",
+		Bytes:    size,
+		Duration: time.Since(start).Round(time.Second),
+	})
+	return
+}
+
+// Write the output of the send command to a stream file, followed by
+// its description.
+func (m *btrSendMirror) writeStream(send *exec.Cmd, info *btrStreamInfo) (size int64, err error) {
+	name := path.Join(m.File, info.Name+".btrfs"+m.Crypt.suffix())
+	tmp := path.Join(m.File, "."+path.Base(name)+".partial")
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+
+	cmds := addStage([]*exec.Cmd{send}, m.Crypt.encryptCommand())
+	cmds[len(cmds)-1].Stdout = file
+	_, err = runPipeline(cmds...)
+	if err == nil {
+		err = file.Sync()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return
+	}
+	size = fi.Size()
+	info.Size = size
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return
+	}
+
+	text, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(name+".json", append(text, '\n'), 0644)
+	return
+}
+
+// Return the UUIDs of the snapshots already present at the
+// destination.
+func (m *btrSendMirror) destUUIDs() (have map[string]bool, err error) {
+	have = make(map[string]bool)
+
+	dir := m.Receive
+	if dir == "" {
+		dir = m.File
+	}
+
+	names, err := scanNames(dir)
+	if err != nil {
+		return
+	}
+
+	for n := range names {
+		if m.Receive != "" {
+			var received string
+			_, received, err = subvolUUIDs(path.Join(m.Receive, n))
+			if err != nil {
+				return
+			}
+			if received != "" {
+				have[received] = true
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(n, ".btrfs"+m.Crypt.suffix()+".json") {
+			continue
+		}
+		var text []byte
+		text, err = os.ReadFile(path.Join(m.File, n))
+		if err != nil {
+			return
+		}
+		var info btrStreamInfo
+		err = json.Unmarshal(text, &info)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Decoding %q: %s", n, err))
+			return
+		}
+		have[info.UUID] = true
+	}
+
+	return
+}
+
+// Verify each stream file: it must have the size recorded in its
+// description, and must decode as a send stream.
+func (m *btrSendMirror) Verify(b *Backup) (err error) {
+	m.backup = b
+
+	if m.File == "" {
+		err = errors.New("Only btrfs-send mirrors writing to files can be verified")
+		return
+	}
+
+	names, err := scanNames(m.File)
+	if err != nil {
+		return
+	}
+
+	suffix := ".btrfs" + m.Crypt.suffix() + ".json"
+	streams := make([]string, 0)
+	for n := range names {
+		if strings.HasSuffix(n, suffix) {
+			streams = append(streams, strings.TrimSuffix(n, ".json"))
+		}
+	}
+	sort.Strings(streams)
+
+	failed := 0
+	for _, n := range streams {
+		verr := m.verifyStream(n)
+		if verr != nil {
+			runLog().Error("Stream failed verification", "stream", n, "error", verr)
+			b.report.AddError(verr)
+			failed++
+			continue
+		}
+		runLog().Info("Stream verified", "stream", n)
+	}
+
+	if failed > 0 {
+		err = errors.New(fmt.Sprintf("%d streams failed verification", failed))
+	}
+	return
+}
+
+func (m *btrSendMirror) verifyStream(name string) (err error) {
+	text, err := os.ReadFile(path.Join(m.File, name+".json"))
+	if err != nil {
+		return
+	}
+	var info btrStreamInfo
+	err = json.Unmarshal(text, &info)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(path.Join(m.File, name))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() != info.Size {
+		msg := fmt.Sprintf("Size is %d, expecting %d", fi.Size(), info.Size)
+		err = errors.New(msg)
+		return
+	}
+
+	var cmds []*exec.Cmd
+	cmds = addStage(cmds, m.Crypt.decryptCommand())
+
+	dump := exec.Command("btrfs", "receive", "--dump")
+	dump.Stdout = io.Discard
+	dump.Stderr = os.Stderr
+	showCommand(dump)
+	cmds = append(cmds, dump)
+
+	cmds[0].Stdin = file
+	_, err = runPipeline(cmds...)
+	return
+}
+
+var subvolUUIDRe = regexp.MustCompile(`(?m)^\s*UUID:\s*(\S+)\s*$`)
+var subvolReceivedRe = regexp.MustCompile(`(?m)^\s*Received UUID:\s*(\S+)\s*$`)
+
+// Get the UUID and received UUID of a subvolume.  The received UUID
+// is empty for subvolumes that weren't made by 'btrfs receive'.
+func subvolUUIDs(subvol string) (uuid, received string, err error) {
+	sudo.Setup(runCtx)
+
+	cmd := exec.Command("btrfs", "subvolume", "show", subvol)
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	out, err := commandOutput(cmd)
+	if err != nil {
+		return
+	}
+
+	m := subvolUUIDRe.FindSubmatch(out)
+	if m == nil {
+		err = errors.New(fmt.Sprintf("No UUID shown for subvolume %q", subvol))
+		return
+	}
+	uuid = string(m[1])
+
+	m = subvolReceivedRe.FindSubmatch(out)
+	if m != nil && string(m[1]) != "-" {
+		received = string(m[1])
+	}
+
+	return
+}
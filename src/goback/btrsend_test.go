@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Set up a btrfs send mirror writing stream files, with the given
+// snapshots already in its local chain, and the given UUIDs already
+// sent.
+func fakeBtrSend(t *testing.T, snaps []string, sent ...string) (*btrSendMirror, *fakeRunner) {
+	dir := t.TempDir()
+	local := path.Join(dir, "local")
+	files := path.Join(dir, "files")
+	os.Mkdir(local, 0755)
+	os.Mkdir(files, 0755)
+
+	fake := &fakeRunner{output: make(map[string]string)}
+	for _, n := range snaps {
+		os.Mkdir(path.Join(local, n), 0755)
+		fake.output["btrfs subvolume show "+path.Join(local, n)] =
+			"home\n\tName: " + n + "\n\tUUID: uuid-" + n + "\n\tReceived UUID: -\n"
+	}
+	for _, n := range sent {
+		text, _ := json.Marshal(&btrStreamInfo{Name: n, UUID: "uuid-" + n})
+		os.WriteFile(path.Join(files, n+".btrfs.json"), text, 0644)
+	}
+
+	m, err := GeneralMirror{
+		"name":   "offsite",
+		"style":  "btrfs-send",
+		"prefix": local,
+		"file":   files,
+	}.GetMirror()
+	if err != nil {
+		t.Fatalf("GetMirror: %s", err)
+	}
+	return m.(*btrSendMirror), fake
+}
+
+// The send commands run, with the local prefix removed.
+func sends(m *btrSendMirror, fake *fakeRunner) (result []string) {
+	for _, r := range fake.ran {
+		if strings.HasPrefix(r, "btrfs send") {
+			result = append(result, strings.Replace(r, m.local.Prefix+"/", "", -1))
+		}
+	}
+	return
+}
+
+func TestBtrSendIncremental(t *testing.T) {
+	snaps := []string{"home.2013.06.01", "home.2013.06.02", "home.2013.06.03", "home.2013.06.04"}
+	b := fakeBackup(append([]string{"home"}, snaps...)...)
+
+	// The first snapshot has been pruned at the destination, and
+	// mustn't be sent again.
+	m, fake := fakeBtrSend(t, snaps, "home.2013.06.02")
+
+	var err error
+	withFakeRunner(fake, func() {
+		err = m.Push(b)
+	})
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+
+	got := strings.Join(sends(m, fake), "\n")
+	want := "btrfs send -p home.2013.06.02 home.2013.06.03\n" +
+		"btrfs send -p home.2013.06.03 home.2013.06.04"
+	if got != want {
+		t.Errorf("Sent:\n%s\nwant:\n%s", got, want)
+	}
+
+	text, err := os.ReadFile(path.Join(m.File, "home.2013.06.04.btrfs.json"))
+	if err != nil {
+		t.Fatalf("No description: %s", err)
+	}
+	var info btrStreamInfo
+	json.Unmarshal(text, &info)
+	if info.UUID != "uuid-home.2013.06.04" || info.Parent != "home.2013.06.03" ||
+		info.ParentUUID != "uuid-home.2013.06.03" {
+		t.Errorf("Description %+v", info)
+	}
+
+	// Everything is there now.
+	fake.ran = nil
+	withFakeRunner(fake, func() {
+		err = m.Push(b)
+	})
+	if err != nil || len(sends(m, fake)) != 0 {
+		t.Errorf("Sent again: %q, %v", sends(m, fake), err)
+	}
+}
+
+func TestBtrSendNewDest(t *testing.T) {
+	snaps := []string{"home.2013.06.01", "home.2013.06.02", "home.2013.06.03"}
+	b := fakeBackup(append([]string{"home"}, snaps...)...)
+	m, fake := fakeBtrSend(t, snaps)
+
+	var err error
+	withFakeRunner(fake, func() {
+		err = m.Push(b)
+	})
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+
+	// Only the newest, in full.
+	got := strings.Join(sends(m, fake), "\n")
+	if got != "btrfs send home.2013.06.03" {
+		t.Errorf("Sent:\n%s", got)
+	}
+}
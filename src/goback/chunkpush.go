@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"sudo"
+)
+
+// A chunk mirror stores each dated snapshot in a deduplicating
+// repository: files are split into content-defined chunks, and each
+// distinct chunk is only stored once, however many snapshots, files,
+// or places within a file it appears in.  Renamed and moved files
+// cost nothing beyond their entry in the snapshot's index.
+//
+// Pruning keeps the newest Keep snapshots of each filesystem (all of
+// them, if Keep is zero), and removes the chunks that are no longer
+// referred to.
+type chunkMirror struct {
+	Repo   string
+	Keep   int
+	backup *Backup
+}
+
+func (m *chunkMirror) Push(b *Backup) (err error) {
+	m.backup = b
+
+	src, err := m.backup.GetSources()
+	if err != nil {
+		return
+	}
+
+	src, err = m.filterSource(src)
+	if err != nil {
+		return
+	}
+
+	sort.Sort(SourceSlice(src))
+
+	for _, vg := range src {
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
+		runLog().Info("Pushing volume", "source", vg.TextName(), "repo", m.Repo)
+
+		var stats *chunkStats
+		stats, err = m.pushVol(vg)
+		done()
+		if err != nil {
+			return
+		}
+
+		runLog().Info("Stored snapshot", "files", stats.Files,
+			"chunks", stats.Chunks, "new_chunks", stats.NewChunks,
+			"added", formatBytes(stats.Added))
+
+		m.backup.report.AddPush(&PushReport{
+			Volume:   vg.LV,
+			Size:     m.backup.volSize(vg.VgName),
+			Bytes:    stats.Added,
+			Duration: time.Since(start).Round(time.Second),
+		})
+	}
+
+	return
+}
+
+// Filter out the source volumes that already have a snapshot in the
+// repository.
+func (m *chunkMirror) filterSource(src []Source) (result []Source, err error) {
+	have := make(map[string]bool)
+
+	out, err := m.chunkCommand("chunk-list", "-repo", m.Repo)
+	if err != nil {
+		return
+	}
+	for _, n := range out.Names {
+		have[n] = true
+	}
+
+	result = make([]Source, 0)
+
+	for _, vol := range src {
+		if !have[vol.LV] {
+			result = append(result, vol)
+		}
+	}
+
+	return
+}
+
+func (m *chunkMirror) pushVol(src Source) (stats *chunkStats, err error) {
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
+	if err != nil {
+		return
+	}
+
+	stats, err = m.chunkCommand("chunk-store", "-repo", m.Repo, "-name", src.LV, "/mnt/old")
+	return
+}
+
+func (m *chunkMirror) Prune(b *Backup) (err error) {
+	m.backup = b
+
+	out, err := m.chunkCommand("chunk-prune", "-repo", m.Repo,
+		"-keep", strconv.Itoa(m.Keep))
+	if err != nil {
+		return
+	}
+
+	runLog().Info("Pruned repository", "snapshots", out.Snapshots,
+		"chunks", out.Chunks, "freed", formatBytes(-out.Added))
+	return
+}
+
+func (m *chunkMirror) Check(b *Backup) (err error) {
+	m.backup = b
+
+	out, err := m.chunkCommand("chunk-check", "-repo", m.Repo)
+	if err != nil {
+		return
+	}
+
+	runLog().Info("Checked repository", "snapshots", out.Snapshots,
+		"chunks", out.Chunks, "problems", out.Problems)
+	if out.Problems > 0 {
+		err = errors.New(fmt.Sprintf("Repository %q has %d problems", m.Repo, out.Problems))
+	}
+	return
+}
+
+// Run one of the internal chunk commands with privileges, decoding
+// the stats it prints.
+func (m *chunkMirror) chunkCommand(args ...string) (out *chunkStats, err error) {
+	sudo.Setup(runCtx)
+
+	cmd, err := selfCommand(args...)
+	if err != nil {
+		return
+	}
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+
+	text, err := commandOutput(cmd)
+	if err != nil {
+		return
+	}
+
+	out = &chunkStats{}
+	err = json.Unmarshal(text, out)
+	if err != nil {
+		msg := fmt.Sprintf("Reading output of %s: %s", args[0], err)
+		err = errors.New(msg)
+	}
+	return
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"chunk"
+	"tsync"
+)
+
+// The work of a chunk store mirror.  A repository holds the chunk
+// store itself under "chunks", and an index for each snapshot under
+// "snapshots", named <lv>.<date>.index.  The indexes are manifests,
+// with each file entry listing the chunks holding its contents.
+//
+// These are all run as internal commands, through sudo, since they
+// need to read everything in the snapshots, and the repository is
+// only accessible to root.
+
+const indexSuffix = ".index"
+
+// What each of the chunk commands reports back, as JSON on stdout.
+type chunkStats struct {
+	Files     int
+	Chunks    int
+	NewChunks int
+	Bytes     int64    // Bytes of file contents
+	Added     int64    // Bytes added to, or removed from, the store
+	Snapshots int      `json:",omitempty"`
+	Problems  int      `json:",omitempty"`
+	Names     []string `json:",omitempty"` // Snapshots present
+}
+
+func (s *chunkStats) print() error {
+	return json.NewEncoder(os.Stdout).Encode(s)
+}
+
+// Open the repository, creating it if needed.
+func openRepo(repo string) (store *chunk.Store, err error) {
+	err = os.MkdirAll(filepath.Join(repo, "snapshots"), 0700)
+	if err != nil {
+		return
+	}
+	err = os.Chmod(repo, 0700)
+	if err != nil {
+		return
+	}
+
+	store, err = chunk.Open(filepath.Join(repo, "chunks"))
+	return
+}
+
+// The snapshot indexes in a repository, without their suffix,
+// sorted.
+func repoIndexes(repo string) (names []string, err error) {
+	ents, err := os.ReadDir(filepath.Join(repo, "snapshots"))
+	if err != nil {
+		return
+	}
+
+	for _, e := range ents {
+		n := e.Name()
+		if strings.HasSuffix(n, indexSuffix) && !strings.HasPrefix(n, ".") {
+			names = append(names, strings.TrimSuffix(n, indexSuffix))
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func indexPath(repo, name string) string {
+	return filepath.Join(repo, "snapshots", name+indexSuffix)
+}
+
+// Internal command: chunk-store -repo dir -name name src
+//
+// Store a tree in the repository, as the named snapshot.  Files that
+// are unchanged since the previous snapshot of the same filesystem
+// reuse its chunks without being read again.
+func chunkStoreCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("chunk-store", flag.ContinueOnError)
+	repo := flags.String("repo", "", "repository directory")
+	name := flags.String("name", "", "name of the snapshot")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	args = flags.Args()
+
+	if len(args) != 1 || *repo == "" || *name == "" {
+		err = errors.New("chunk-store expects -repo, -name and a source")
+		return
+	}
+	src := args[0]
+
+	store, err := openRepo(*repo)
+	if err != nil {
+		return
+	}
+
+	indexes, err := repoIndexes(*repo)
+	if err != nil {
+		return
+	}
+
+	var last string
+	for _, n := range indexes {
+		if undate(n) == undate(*name) && n != undate(n) && n < *name {
+			last = n
+		}
+	}
+
+	var prev map[string]*ManifestEntry
+	if last != "" {
+		var man *Manifest
+		man, err = readManifest(indexPath(*repo, last))
+		if err != nil {
+			return
+		}
+		prev = man.ByPath()
+	}
+
+	final := indexPath(*repo, *name)
+	tmp := filepath.Join(*repo, "snapshots", "."+*name+indexSuffix+".partial")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	mw, err := newManifestWriter(file, &ManifestHeader{
+		Name:    *name,
+		Source:  src,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	var stats chunkStats
+	links := make(map[uint64]string)
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		entry, st, err := newManifestEntry(path, rel, fi)
+		if err != nil {
+			return err
+		}
+
+		attrs, err := tsync.GetXattrs(path)
+		if err != nil {
+			return err
+		}
+		if len(attrs) > 0 {
+			entry.Xattrs = attrs
+		}
+
+		if entry.Type != "d" && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				entry.Type = "h"
+				entry.Link = first
+				entry.Size = 0
+				return mw.Add(entry)
+			}
+			links[st.Ino] = rel
+		}
+
+		if entry.Type != "f" {
+			return mw.Add(entry)
+		}
+
+		stats.Files++
+		stats.Bytes += entry.Size
+
+		if old, ok := prev[rel]; ok && old.Same(entry) && haveChunks(store, old.Chunks) {
+			entry.Chunks = old.Chunks
+			stats.Chunks += len(old.Chunks)
+			return mw.Add(entry)
+		}
+
+		err = storeFile(store, path, entry, &stats)
+		if err != nil {
+			return err
+		}
+		return mw.Add(entry)
+	})
+	if err != nil {
+		return
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, final)
+	if err != nil {
+		return
+	}
+
+	err = stats.print()
+	return
+}
+
+// Split a file into chunks, storing them.
+func storeFile(store *chunk.Store, path string, entry *ManifestEntry, stats *chunkStats) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	entry.Chunks = make([]string, 0)
+
+	c := chunk.NewChunker(f)
+	for {
+		var data []byte
+		data, err = c.Next()
+		if err != nil {
+			break
+		}
+
+		var id string
+		var added int64
+		id, added, err = store.Put(data)
+		if err != nil {
+			return
+		}
+		entry.Chunks = append(entry.Chunks, id)
+		stats.Chunks++
+		if added > 0 {
+			stats.NewChunks++
+			stats.Added += added
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func haveChunks(store *chunk.Store, ids []string) bool {
+	for _, id := range ids {
+		if !store.Has(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read every index, returning the set of chunks they refer to.
+func referencedChunks(repo string) (refs map[string]bool, snapshots int, err error) {
+	indexes, err := repoIndexes(repo)
+	if err != nil {
+		return
+	}
+
+	refs = make(map[string]bool)
+	for _, n := range indexes {
+		var man *Manifest
+		man, err = readManifest(indexPath(repo, n))
+		if err != nil {
+			return
+		}
+		for _, e := range man.Entries {
+			for _, id := range e.Chunks {
+				refs[id] = true
+			}
+		}
+	}
+	snapshots = len(indexes)
+	return
+}
+
+// Internal command: chunk-list -repo dir
+//
+// List the snapshots in the repository, if it exists.
+func chunkListCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("chunk-list", flag.ContinueOnError)
+	repo := flags.String("repo", "", "repository directory")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if flags.NArg() != 0 || *repo == "" {
+		err = errors.New("chunk-list expects -repo")
+		return
+	}
+
+	names, err := repoIndexes(*repo)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	stats := chunkStats{Snapshots: len(names), Names: names}
+	err = stats.print()
+	return
+}
+
+// Internal command: chunk-prune -repo dir [-keep n]
+//
+// Remove all but the newest n snapshots of each filesystem (when n is
+// given), and then remove the chunks no snapshot refers to.
+func chunkPruneCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("chunk-prune", flag.ContinueOnError)
+	repo := flags.String("repo", "", "repository directory")
+	keep := flags.Int("keep", 0, "number of snapshots of each filesystem to keep")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if flags.NArg() != 0 || *repo == "" {
+		err = errors.New("chunk-prune expects -repo")
+		return
+	}
+
+	store, err := openRepo(*repo)
+	if err != nil {
+		return
+	}
+
+	if *keep > 0 {
+		var indexes []string
+		indexes, err = repoIndexes(*repo)
+		if err != nil {
+			return
+		}
+
+		// Newest first, so the first n of each are kept.
+		seen := make(map[string]int)
+		for i := len(indexes) - 1; i >= 0; i-- {
+			n := indexes[i]
+			base := undate(n)
+			seen[base]++
+			if seen[base] <= *keep {
+				continue
+			}
+			err = os.Remove(indexPath(*repo, n))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Removed snapshot %s\n", n)
+		}
+	}
+
+	refs, snapshots, err := referencedChunks(*repo)
+	if err != nil {
+		return
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		return
+	}
+
+	stats := chunkStats{Snapshots: snapshots, Chunks: len(ids)}
+	for _, id := range ids {
+		if refs[id] {
+			continue
+		}
+		var size int64
+		size, err = store.Remove(id)
+		if err != nil {
+			return
+		}
+		stats.Chunks--
+		stats.Added -= size
+	}
+
+	err = stats.print()
+	return
+}
+
+// Internal command: chunk-check -repo dir
+//
+// Check that every chunk an index refers to is present, and that
+// every chunk in the store has the contents its name says it does.
+// Each problem is written to stderr, and counted in the stats.
+func chunkCheckCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("chunk-check", flag.ContinueOnError)
+	repo := flags.String("repo", "", "repository directory")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if flags.NArg() != 0 || *repo == "" {
+		err = errors.New("chunk-check expects -repo")
+		return
+	}
+
+	store := &chunk.Store{Dir: filepath.Join(*repo, "chunks")}
+
+	refs, snapshots, err := referencedChunks(*repo)
+	if err != nil {
+		return
+	}
+
+	stats := chunkStats{Snapshots: snapshots}
+
+	for id := range refs {
+		if !store.Has(id) {
+			fmt.Fprintf(os.Stderr, "Missing chunk %s\n", id)
+			stats.Problems++
+		}
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		return
+	}
+
+	unused := 0
+	for _, id := range ids {
+		stats.Chunks++
+		_, gerr := store.Get(id)
+		if gerr != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", gerr)
+			stats.Problems++
+		}
+		if !refs[id] {
+			unused++
+		}
+	}
+	if unused > 0 {
+		fmt.Fprintf(os.Stderr, "%d chunks are unused, and can be pruned\n", unused)
+	}
+
+	err = stats.print()
+	return
+}
+
+// Internal command: chunk-restore -repo dir -name name [-prefix path] dest
+//
+// Restore a snapshot, or just the part of it at prefix, to dest.
+func chunkRestoreCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("chunk-restore", flag.ContinueOnError)
+	repo := flags.String("repo", "", "repository directory")
+	name := flags.String("name", "", "name of the snapshot")
+	prefix := flags.String("prefix", "", "part of the snapshot to restore")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if flags.NArg() != 1 || *repo == "" || *name == "" {
+		err = errors.New("chunk-restore expects -repo, -name and a destination")
+		return
+	}
+
+	store := &chunk.Store{Dir: filepath.Join(*repo, "chunks")}
+
+	man, err := readManifest(indexPath(*repo, *name))
+	if err != nil {
+		return
+	}
+
+	x := &extractor{Prefix: *prefix, Dest: flags.Arg(0)}
+	x.plan(man.Entries)
+
+	found := false
+	for _, e := range man.Entries {
+		if _, ok := x.target(e.Path); !ok {
+			continue
+		}
+		found = true
+
+		var data io.Reader
+		if e.Type == "f" {
+			data = &chunkReader{store: store, ids: e.Chunks}
+		}
+		err = x.create(e, data, e.Xattrs)
+		if err != nil {
+			return
+		}
+	}
+
+	if !found {
+		err = errors.New(fmt.Sprintf("%q is not in snapshot %s", *prefix, *name))
+		return
+	}
+
+	err = x.finish()
+	return
+}
+
+// Read the contents of a file back from its chunks.
+type chunkReader struct {
+	store *chunk.Store
+	ids   []string
+	data  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	for len(r.data) == 0 {
+		if len(r.ids) == 0 {
+			return 0, io.EOF
+		}
+		r.data, err = r.store.Get(r.ids[0])
+		if err != nil {
+			return
+		}
+		r.ids = r.ids[1:]
+	}
+
+	n = copy(p, r.data)
+	r.data = r.data[n:]
+	return
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chunk"
+)
+
+// Run one of the internal chunk commands, decoding the stats it
+// prints.
+func runChunkCmd(t *testing.T, cmd func(...string) error, args ...string) *chunkStats {
+	out, err := os.CreateTemp(t.TempDir(), "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	old := os.Stdout
+	os.Stdout = out
+	err = cmd(args...)
+	os.Stdout = old
+	if err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+
+	text, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &chunkStats{}
+	err = json.Unmarshal(text, stats)
+	if err != nil {
+		t.Fatalf("%v: %s in %q", args, err, text)
+	}
+	return stats
+}
+
+func writeRandom(t *testing.T, name string, size int, seed int64) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	err := os.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkStore(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo")
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "big"), 3<<20, 1)
+	writeRandom(t, filepath.Join(src, "small"), 1000, 2)
+
+	store := func(name string) *chunkStats {
+		return runChunkCmd(t, chunkStoreCmd, "-repo", repo, "-name", name, src)
+	}
+
+	first := store("home.2013.06.01")
+	if first.Files != 2 || first.NewChunks == 0 || first.NewChunks != first.Chunks {
+		t.Fatalf("First store: %+v", first)
+	}
+
+	// Nothing changed, and a copy of a file is only more
+	// references to the same chunks.
+	data, err := os.ReadFile(filepath.Join(src, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(src, "copy"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := store("home.2013.06.02")
+	if second.Files != 3 || second.NewChunks != 0 || second.Added != 0 {
+		t.Errorf("Second store: %+v", second)
+	}
+
+	// Only the changed file adds a chunk.
+	writeRandom(t, filepath.Join(src, "small"), 1000, 3)
+	third := store("home.2013.06.03")
+	if third.NewChunks != 1 {
+		t.Errorf("Third store: %+v", third)
+	}
+
+	list := runChunkCmd(t, chunkListCmd, "-repo", repo)
+	if list.Snapshots != 3 {
+		t.Errorf("Listed %v", list.Names)
+	}
+
+	// Keeping the newest snapshot frees the old contents of the
+	// changed file, and nothing else.
+	pruned := runChunkCmd(t, chunkPruneCmd, "-repo", repo, "-keep", "1")
+	if pruned.Snapshots != 1 || pruned.Chunks != first.NewChunks || pruned.Added >= 0 {
+		t.Errorf("Prune: %+v", pruned)
+	}
+	names, err := repoIndexes(repo)
+	if err != nil || len(names) != 1 || names[0] != "home.2013.06.03" {
+		t.Errorf("Left %v, %v", names, err)
+	}
+
+	checked := runChunkCmd(t, chunkCheckCmd, "-repo", repo)
+	if checked.Problems != 0 || checked.Chunks != pruned.Chunks {
+		t.Errorf("Check: %+v", checked)
+	}
+
+	// A damaged chunk, and a missing one, are both found.
+	cs := &chunk.Store{Dir: filepath.Join(repo, "chunks")}
+	ids, err := cs.List()
+	if err != nil || len(ids) < 2 {
+		t.Fatalf("Chunks %v, %v", ids, err)
+	}
+	err = os.WriteFile(filepath.Join(cs.Dir, ids[0][:2], ids[0]), []byte("damaged"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.Remove(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checked = runChunkCmd(t, chunkCheckCmd, "-repo", repo)
+	if checked.Problems != 2 {
+		t.Errorf("Check of damaged repo: %+v", checked)
+	}
+}
+
+func TestChunkMirrorCheck(t *testing.T) {
+	b := fakeBackup("home")
+	m := &chunkMirror{Repo: "/backup/repo"}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{output: map[string]string{
+		self: `{"Snapshots": 1, "Chunks": 4, "Problems": 1}`,
+	}}
+	withFakeRunner(fake, func() {
+		err = m.Check(b)
+	})
+	if err == nil || !strings.Contains(err.Error(), "1 problems") {
+		t.Errorf("Problems not reported: %v", err)
+	}
+}
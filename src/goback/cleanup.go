@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"sudo"
+)
+
+// Recovery from an interrupted run.  A crash (or a kill) in the
+// middle of a snap or push can leave snapshots activated and mounted.
+// The cleanup command finds anything that looks like it belongs to
+// goback and releases it, apart from what the mount command mounted
+// for browsing.
+
+// Fixed mountpoints used by the mirror pushes.
+var scratchMounts = []string{"/mnt/old", "/mnt/new"}
+
+func (b *Backup) CleanupCmd(args ...string) (err error) {
+	if len(args) != 0 {
+		err = errors.New("'cleanup' command not expecting additional arguments")
+		return
+	}
+
+	mounts, err := GetMounts()
+	if err != nil {
+		return
+	}
+
+	failed := make([]string, 0)
+
+	// Unmount in the reverse of the order things were mounted, so
+	// that anything mounted on top of one of ours goes first.
+	found := b.ourMounts(mounts)
+	for i := len(found) - 1; i >= 0; i-- {
+		mnt := found[i]
+		runLog().Info("Unmounting", "mountpoint", mnt.Mountpoint, "source", mnt.Source)
+		err = b.umountDir(mnt.Mountpoint)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("umount %s: %s", mnt.Mountpoint, err))
+		}
+	}
+
+	// Then deactivate snapshots.  Only volumes that are normally
+	// skipped at activation are touched, anything else active was
+	// not activated by us.
+	var browsing []*browseMount
+	err = b.loadState(browseState, &browsing)
+	if err != nil {
+		return
+	}
+	browsed := make(map[string]bool)
+	for _, bm := range browsing {
+		browsed[bm.Source] = true
+	}
+
+	for _, vol := range b.lvm.Volumes {
+		if !vol.Active() || !vol.SkipActivation() || !b.ownsVolume(vol) {
+			continue
+		}
+		if name := vol.VgName(); browsed[name.DevName()] {
+			continue
+		}
+
+		name := vol.VgName()
+		runLog().Info("Deactivating", "volume", name.TextName())
+		err = b.deactivate(name)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("deactivate %s: %s", name.TextName(), err))
+		}
+	}
+
+	if len(failed) > 0 {
+		for _, msg := range failed {
+			runLog().Error("Unable to release", "item", msg)
+		}
+		err = errors.New(fmt.Sprintf("%d items could not be released", len(failed)))
+		return
+	}
+
+	err = nil
+	runLog().Info("Cleanup complete")
+	return
+}
+
+// Return the mounts that goback is responsible for: anything under
+// the Snapdir, the scratch mountpoints used for pushing, and anything
+// whose source is one of our snapshot volumes.
+func (b *Backup) ourMounts(mounts []*MountEntry) (result []*MountEntry) {
+	result = make([]*MountEntry, 0)
+
+	snapdir := path.Clean(b.host.Snapdir)
+	browse := path.Clean(b.browseDir())
+
+	for _, mnt := range mounts {
+		mine := false
+
+		// Mounts for browsing are deliberate, and left for
+		// the umount command.
+		if strings.HasPrefix(mnt.Mountpoint, browse+"/") {
+			continue
+		}
+
+		if strings.HasPrefix(mnt.Mountpoint, snapdir+"/") {
+			mine = true
+		}
+
+		for _, dir := range scratchMounts {
+			if mnt.Mountpoint == dir {
+				mine = true
+			}
+		}
+
+		for _, vol := range b.lvm.Volumes {
+			name := vol.VgName()
+			if b.ownsVolume(vol) && mnt.Source == name.DevName() {
+				mine = true
+			}
+		}
+
+		if mine {
+			result = append(result, mnt)
+		}
+	}
+
+	return
+}
+
+// Does this volume follow one of the naming conventions that goback
+// uses for snapshots?  This covers both the local snapshots of each
+// filesystem, and the snapshots made within lvm mirrors.
+func (b *Backup) ownsVolume(vol *VolInfo) bool {
+	for _, fs := range b.host.Filesystems {
+		if vol.VG == fs.Volgroup && fs.MatchRe().MatchString(vol.LV) {
+			return true
+		}
+
+		for _, gm := range b.host.Mirrors {
+			m, err := gm.GetMirror()
+			if err != nil {
+				continue
+			}
+			lm, ok := m.(*lvmMirror)
+			if !ok || vol.VG != lm.VgName {
+				continue
+			}
+			if strings.HasPrefix(vol.LV, lm.Prefix) &&
+				fs.MatchRe().MatchString(vol.LV[len(lm.Prefix):]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (b *Backup) umountDir(dir string) (err error) {
+	sudo.Setup(runCtx)
+
+	cmd := exec.Command("umount", dir)
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	err = runCommand(cmd)
+	return
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"errors"
 	"fmt"
+	"path"
 	"regexp"
+	"strconv"
 
 	"github.com/BurntSushi/toml"
 )
@@ -23,25 +25,121 @@ func loadConfig() (conf Config, err error) {
 
 type Config map[string]*Host
 
+// The configuration for the named host, if there is one.
+func (conf Config) host(name string) *Host {
+	for _, hi := range conf {
+		if hi.Host == name {
+			return hi
+		}
+	}
+	return nil
+}
+
 type Host struct {
 	Host        string
 	Snapdir     string
 	Filesystems []*FsInfo
 	Surelog     string
 	Mirrors     []GeneralMirror
+	Notify      []GeneralNotifier
+	Metrics     string
+	Rsynclog    string
+
+	// Commands to run around snapshotting and pushing, and how
+	// long they may take (a duration, default 5m).
+	Hooks
+	HookTimeout string
+
+	// How long a consistency group may stay frozen before it is
+	// thawed regardless (a duration, default 1m).
+	FreezeTimeout string
+
+	// Cron-style schedules for the daemon, by command (snap or
+	// cleanup).  Mirrors have their own schedules.
+	Schedule map[string]string
+
+	// How to run the commands that need privileges, when goback
+	// isn't run as root: sudo (the default), doas, pkexec, or none
+	// to run them directly.  With SudoNonInteractive, a command
+	// that would prompt for a password fails instead, as is
+	// wanted under cron; pkexec can't be used with it.
+	Sudo               string
+	SudoNonInteractive bool
+
+	// Run the commands that need privileges through a single
+	// privileged helper, started once, rather than each one
+	// through sudo.  The helper only runs what the configuration
+	// in /etc/goback/config.toml calls for, so that file, the
+	// directories above it, and gosure and goback themselves, must
+	// belong to root and be writable only by it.  Restores, which
+	// can write anywhere, still go through sudo.
+	Helper bool
+
+	// Where goback keeps state between runs, such as what it has
+	// mounted.  Defaults to /var/lib/goback when goback is run as
+	// root, and to $XDG_STATE_HOME/goback (~/.local/state/goback)
+	// otherwise.  It must be writable by the user goback runs as.
+	Statedir string
+
+	// Surelog rotation.  SurelogKeep is the number of previous
+	// generations to keep (default 1), SurelogCompress gzips
+	// all but the newest of them, and SurelogPerFs writes a separate log for each
+	// filesystem.
+	SurelogKeep     int
+	SurelogCompress bool
+	SurelogPerFs    bool
 }
 
 type FsInfo struct {
 	Volgroup string
 	Lvname   string
 	Mount    string
+
+	// The type of filesystem (ext4, xfs), detected if not given.
+	// A btrfs filesystem has to be configured with Kind = "btrfs"
+	// instead.
+	Fstype string
+
+	// Filesystems that are btrfs subvolumes, rather than LVM
+	// volumes, have the Kind "btrfs", and no Volgroup.  Their
+	// read-only snapshots are kept in Snapshots, by default
+	// .snapshots within the subvolume.
+	Kind      string
+	Snapshots string
+
+	// Commands to run around snapshotting and pushing this
+	// filesystem.
+	Hooks
+
+	// Filesystems with the same Group are frozen while all of
+	// their snapshots are taken, so that the snapshots are
+	// consistent with each other.  This needs Linux 6.6 or later:
+	// older kernels can't snapshot a filesystem that has been
+	// frozen with fsfreeze, since device-mapper tries to freeze it
+	// again and fails with EBUSY.
+	Group string
 }
 
 func (fs *FsInfo) VgName() VgName {
 	return VgName{VG: fs.Volgroup, LV: fs.Lvname}
 }
 
+// Is this filesystem a btrfs subvolume, rather than an LVM volume?
+func (fs *FsInfo) Subvolume() bool {
+	return fs.Kind == "btrfs"
+}
+
+func (fs *FsInfo) SnapshotDir() string {
+	if fs.Snapshots != "" {
+		return fs.Snapshots
+	}
+	return path.Join(fs.Mount, ".snapshots")
+}
+
 func (fs *FsInfo) String() string {
+	if fs.Subvolume() {
+		return fmt.Sprintf("%s (%s, btrfs)", fs.Lvname, fs.Mount)
+	}
 	return fmt.Sprintf("%s/%s (%s)", fs.Volgroup, fs.Lvname, fs.Mount)
 }
 
@@ -70,8 +168,28 @@ type Mirror interface {
 	Push(b *Backup) (err error)
 }
 
+// Mirrors that write archives can also check them.
+type Verifier interface {
+	Verify(b *Backup) (err error)
+}
+
+// Mirrors that can remove old copies.
+type Pruner interface {
+	Prune(b *Backup) (err error)
+}
+
+// Mirrors with a repository that can be checked for consistency.
+type Checker interface {
+	Check(b *Backup) (err error)
+}
+
 // From a general mirror, get one specifically for a certain element.
 func (m GeneralMirror) GetMirror() (result Mirror, err error) {
+	err = checkEngine(m)
+	if err != nil {
+		return
+	}
+
 	switch m["style"] {
 	case "lvm/ext4":
 		vgname, ok := m["vgname"]
@@ -94,6 +212,145 @@ func (m GeneralMirror) GetMirror() (result Mirror, err error) {
 
 		return &btrMirror{Prefix: prefix}, nil
 
+	case "btrfs-send":
+		prefix, ok := m["prefix"]
+		if !ok {
+			return nil, expecting(m["name"], "prefix")
+		}
+
+		receive, file := m["receive"], m["file"]
+		if (receive == "") == (file == "") {
+			msg := fmt.Sprintf("Mirror configuration for %q needs one of %q or %q keys",
+				m["name"], "receive", "file")
+			return nil, errors.New(msg)
+		}
+
+		var crypt *archiveCrypt
+		crypt, err = getCrypt(m)
+		if err != nil {
+			return nil, err
+		}
+		if crypt != nil && receive != "" {
+			msg := fmt.Sprintf("Mirror %q can only encrypt when writing to a %q",
+				m["name"], "file")
+			return nil, errors.New(msg)
+		}
+
+		return &btrSendMirror{
+			local:   btrMirror{Prefix: prefix},
+			Receive: receive,
+			File:    file,
+			Crypt:   crypt,
+		}, nil
+
+	case "zfs":
+		dataset, ok := m["dataset"]
+		if !ok {
+			return nil, expecting(m["name"], "dataset")
+		}
+
+		return &zfsMirror{Dataset: dataset}, nil
+
+	case "dir":
+		prefix, ok := m["prefix"]
+		if !ok {
+			return nil, expecting(m["name"], "prefix")
+		}
+
+		return &dirMirror{Prefix: prefix}, nil
+
+	case "tar":
+		dir, ok := m["dir"]
+		if !ok {
+			return nil, expecting(m["name"], "dir")
+		}
+
+		incremental := false
+		switch m["incremental"] {
+		case "", "false":
+		case "true":
+			incremental = true
+		default:
+			msg := fmt.Sprintf("Mirror %q: incremental should be \"true\" or \"false\", not %q",
+				m["name"], m["incremental"])
+			return nil, errors.New(msg)
+		}
+
+		fullEvery := 7
+		if text, ok := m["fullevery"]; ok {
+			fullEvery, err = strconv.Atoi(text)
+			if err != nil || fullEvery < 1 {
+				msg := fmt.Sprintf("Mirror %q: invalid fullevery %q", m["name"], text)
+				return nil, errors.New(msg)
+			}
+		}
+
+		var crypt *archiveCrypt
+		crypt, err = getCrypt(m)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tarMirror{
+			Dir:         dir,
+			Incremental: incremental,
+			FullEvery:   fullEvery,
+			Crypt:       crypt,
+		}, nil
+
+	case "chunk":
+		repo, ok := m["repo"]
+		if !ok {
+			return nil, expecting(m["name"], "repo")
+		}
+
+		keep := 0
+		if text, ok := m["keep"]; ok {
+			keep, err = strconv.Atoi(text)
+			if err != nil || keep < 0 {
+				msg := fmt.Sprintf("Mirror %q: invalid keep %q", m["name"], text)
+				return nil, errors.New(msg)
+			}
+		}
+
+		return &chunkMirror{Repo: repo, Keep: keep}, nil
+
+	case "ssh":
+		for _, key := range []string{"host", "dir", "snapshot"} {
+			if _, ok := m[key]; !ok {
+				return nil, expecting(m["name"], key)
+			}
+		}
+
+		switch m["snapshot"] {
+		case "btrfs", "cp":
+		case "lvm":
+			if _, ok := m["vgname"]; !ok {
+				return nil, expecting(m["name"], "vgname")
+			}
+		default:
+			msg := fmt.Sprintf("Mirror %q has unknown snapshot method %q", m["name"], m["snapshot"])
+			return nil, errors.New(msg)
+		}
+
+		if m["sync"] == "native" {
+			msg := fmt.Sprintf("Mirror %q: the native sync engine can't push over ssh", m["name"])
+			return nil, errors.New(msg)
+		}
+
+		ssh := m["ssh"]
+		if ssh == "" {
+			ssh = "ssh"
+		}
+
+		return &sshMirror{
+			Host:     m["host"],
+			Dir:      m["dir"],
+			Snapshot: m["snapshot"],
+			Volgroup: m["vgname"],
+			Ssh:      ssh,
+		}, nil
+
 	default:
 		msg := fmt.Sprintf("Unknown mirror style: %q", m["style"])
 		err = errors.New(msg)
@@ -102,9 +359,33 @@ func (m GeneralMirror) GetMirror() (result Mirror, err error) {
 }
 
 func expecting(name, key string) error {
-	msg := fmt.Sprintf("Mirror configuration for %q needs %q key")
+	msg := fmt.Sprintf("Mirror configuration for %q needs %q key", name, key)
 	return errors.New(msg)
 }
 
+// Does this host need any LVM volumes?  Hosts with only btrfs
+// subvolumes might not have LVM at all.
+func (h *Host) UsesLVM() bool {
+	for _, fs := range h.Filesystems {
+		if !fs.Subvolume() {
+			return true
+		}
+	}
+	for _, m := range h.Mirrors {
+		if m["style"] == "lvm/ext4" {
+			return true
+		}
+	}
+	return false
+}
+
 // Within this host, look up a particular mirror returning its
 // information.  Note that the mirror types should be expandable.
+func (h *Host) LookupMirror(name string) GeneralMirror {
+	for _, m := range h.Mirrors {
+		if m["name"] == name {
+			return m
+		}
+	}
+	return nil
+}
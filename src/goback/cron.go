@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron-style schedules, as used by the daemon.  These have the usual
+// five fields: minute, hour, day of month, month and day of week.
+// Each field is "*", or a list of numbers and ranges ("1-5"), either
+// of which can have a step ("*/15", "0-30/10").  Months and days of
+// the week can also be given by their names ("jan", "mon").  As with
+// cron, when both the day of the month and the day of the week are
+// restricted, a day matching either one will do.  The shorthands
+// @hourly, @daily (@midnight), @weekly, @monthly and @yearly
+// (@annually) are also understood.
+type cronSchedule struct {
+	text   string
+	minute cronField
+	hour   cronField
+	dom    cronField
+	month  cronField
+	dow    cronField
+
+	// Whether the day fields were "*".
+	anyDom bool
+	anyDow bool
+}
+
+// The values allowed in a field, as a bit set.
+type cronField uint64
+
+func (f cronField) has(n int) bool {
+	return f&(1<<uint(n)) != 0
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun",
+	"jul", "aug", "sep", "oct", "nov", "dec"}
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseCron(text string) (c *cronSchedule, err error) {
+	spec := strings.TrimSpace(text)
+	if full, ok := cronShorthands[spec]; ok {
+		spec = full
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		err = errors.New(fmt.Sprintf("Schedule %q should have 5 fields", text))
+		return
+	}
+
+	c = &cronSchedule{text: text}
+	parts := []struct {
+		field    *cronField
+		min, max int
+		names    []string
+		base     int
+	}{
+		{&c.minute, 0, 59, nil, 0},
+		{&c.hour, 0, 23, nil, 0},
+		{&c.dom, 1, 31, nil, 0},
+		{&c.month, 1, 12, monthNames, 1},
+		{&c.dow, 0, 7, dayNames, 0},
+	}
+	for i, p := range parts {
+		*p.field, err = parseCronField(fields[i], p.min, p.max, p.names, p.base)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Schedule %q: %s", text, err))
+			c = nil
+			return
+		}
+	}
+
+	// Sunday is both 0 and 7.
+	if c.dow.has(7) {
+		c.dow |= 1
+	}
+	c.anyDom = fields[2] == "*"
+	c.anyDow = fields[4] == "*"
+	return
+}
+
+func parseCronField(text string, min, max int, names []string, base int) (f cronField, err error) {
+	for _, item := range strings.Split(text, ",") {
+		rng, step := item, 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			rng = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				err = errors.New(fmt.Sprintf("invalid step in %q", item))
+				return
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			lo, err = cronValue(bounds[0], names, base)
+			if err != nil {
+				return
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = cronValue(bounds[1], names, base)
+				if err != nil {
+					return
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 onwards.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			err = errors.New(fmt.Sprintf("%q out of range %d-%d", item, min, max))
+			return
+		}
+
+		for n := lo; n <= hi; n += step {
+			f |= 1 << uint(n)
+		}
+	}
+	return
+}
+
+func cronValue(text string, names []string, base int) (n int, err error) {
+	for i, name := range names {
+		if strings.EqualFold(text, name) {
+			n = i + base
+			return
+		}
+	}
+
+	n, err = strconv.Atoi(text)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("invalid value %q", text))
+	}
+	return
+}
+
+func (c *cronSchedule) String() string {
+	return c.text
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom.has(t.Day())
+	dow := c.dow.has(int(t.Weekday()))
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// The first time after t that the schedule matches, or the zero time
+// if it never does (such as on the 31st of February).  The result is
+// always strictly after t, even across daylight saving changes, where
+// rebuilding a time from its fields can land in the earlier of two
+// repeated hours.
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// The schedule repeats at least every 28 years.
+	limit := t.AddDate(28, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		var next time.Time
+		switch {
+		case !c.month.has(int(m)):
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !c.hour.has(t.Hour()):
+			next = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute.has(t.Minute()):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+
+		// Always make progress.
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
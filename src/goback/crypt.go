@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Encryption of the files written by archive mirrors (tar, and
+// btrfs-send writing to files).  Files are encrypted with gpg, either
+// to a public key, or symmetrically with a passphrase.  The config
+// only names the key or passphrase file, with the "publickey" or
+// "passphrasefile" mirror keys; neither is stored there.
+//
+// Archives encrypted to a public key can only be decrypted where the
+// matching secret key is in the gpg keyring, which is intended to
+// not be the case on the machine being backed up.
+type archiveCrypt struct {
+	PublicKey      string
+	PassphraseFile string
+}
+
+const cryptSuffix = ".gpg"
+
+// Get the encryption configured for a mirror, or nil if it doesn't
+// encrypt.
+func getCrypt(m GeneralMirror) (c *archiveCrypt, err error) {
+	key, pass := m["publickey"], m["passphrasefile"]
+	if key == "" && pass == "" {
+		return
+	}
+	if key != "" && pass != "" {
+		msg := fmt.Sprintf("Mirror %q should only have one of %q and %q",
+			m["name"], "publickey", "passphrasefile")
+		err = errors.New(msg)
+		return
+	}
+
+	for _, name := range []string{key, pass} {
+		if name == "" {
+			continue
+		}
+		_, err = os.Stat(name)
+		if err != nil {
+			msg := fmt.Sprintf("Mirror %q: %s", m["name"], err)
+			err = errors.New(msg)
+			return
+		}
+	}
+
+	c = &archiveCrypt{PublicKey: key, PassphraseFile: pass}
+	return
+}
+
+// The suffix added to the names of encrypted files.
+func (c *archiveCrypt) suffix() string {
+	if c == nil {
+		return ""
+	}
+	return cryptSuffix
+}
+
+// Build a command that encrypts its input.  Returns nil if there is
+// no encryption.
+func (c *archiveCrypt) encryptCommand() (cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+
+	args := []string{"--batch", "--quiet", "--no-tty"}
+	if c.PublicKey != "" {
+		args = append(args, "--trust-model", "always",
+			"--recipient-file", c.PublicKey, "--encrypt")
+	} else {
+		args = append(args, "--pinentry-mode", "loopback",
+			"--passphrase-file", c.PassphraseFile,
+			"--cipher-algo", "AES256", "--symmetric")
+	}
+
+	cmd = exec.Command("gpg", args...)
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+	return
+}
+
+// Build a command that decrypts its input.  Returns nil if there is
+// no encryption.
+func (c *archiveCrypt) decryptCommand() (cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+
+	args := []string{"--batch", "--quiet", "--no-tty"}
+	if c.PassphraseFile != "" {
+		args = append(args, "--pinentry-mode", "loopback",
+			"--passphrase-file", c.PassphraseFile)
+	}
+	args = append(args, "--decrypt")
+
+	cmd = exec.Command("gpg", args...)
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+	return
+}
+
+// Read the contents of a possibly encrypted file.
+func (c *archiveCrypt) readFile(name string) (data []byte, err error) {
+	if c == nil {
+		return os.ReadFile(name)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	cmd := c.decryptCommand()
+	cmd.Stdin = file
+	data, err = commandOutput(cmd)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Decrypting %q: %s", name, err))
+	}
+	return
+}
+
+// Copy a plaintext file to dest, encrypting it.
+func (c *archiveCrypt) encryptFile(src, dest string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return
+	}
+
+	cmd := c.encryptCommand()
+	cmd.Stdin = in
+	cmd.Stdout = out
+	err = runCommand(cmd)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return
+}
+
+// Add a command to the end of a pipeline, if it isn't nil.
+func addStage(cmds []*exec.Cmd, cmd *exec.Cmd) []*exec.Cmd {
+	if cmd == nil {
+		return cmds
+	}
+	return append(cmds, cmd)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestCryptPassphrase(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not available")
+	}
+
+	dir := t.TempDir()
+	t.Setenv("GNUPGHOME", dir)
+
+	pass := path.Join(dir, "pass")
+	plain := path.Join(dir, "plain")
+	sealed := path.Join(dir, "sealed.gpg")
+	if err := os.WriteFile(pass, []byte("not very secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(plain, []byte("some manifest\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := getCrypt(GeneralMirror{"name": "usb", "passphrasefile": pass})
+	if err != nil {
+		t.Fatalf("getCrypt: %s", err)
+	}
+
+	err = c.encryptFile(plain, sealed)
+	if err != nil {
+		t.Fatalf("encryptFile: %s", err)
+	}
+
+	data, err := os.ReadFile(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) == "some manifest\n" {
+		t.Fatalf("File was not encrypted")
+	}
+
+	data, err = c.readFile(sealed)
+	if err != nil {
+		t.Fatalf("readFile: %s", err)
+	}
+	if string(data) != "some manifest\n" {
+		t.Errorf("Decrypted to %q", data)
+	}
+
+	_, err = getCrypt(GeneralMirror{"name": "usb", "passphrasefile": pass, "publickey": pass})
+	if err == nil {
+		t.Errorf("Accepted both a public key and a passphrase")
+	}
+}
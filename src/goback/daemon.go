@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The daemon runs goback commands on the schedules given in the
+// config file, instead of leaving that to cron.  The host's Schedule
+// gives one for snap and cleanup, and each mirror can have a
+// push-schedule, verify-schedule, check-schedule and prune-schedule.
+//
+// Each job is a separate run of goback, which takes the run lock, and
+// so waits for anything else that holds it.  Jobs run one at a time,
+// in the order they became due.  When the daemon wakes up (or starts)
+// after a job should have run, it runs it once, however many times it
+// was missed.  The time each job last ran, and how it went, are kept
+// in the Statedir.
+
+const daemonState = "daemon.json"
+const daemonLock = "daemon.lock"
+
+// How long the daemon sleeps for at a time.  Sleeping doesn't count
+// time the machine is suspended for, so it wakes up regularly to check
+// the clock.
+var daemonPoll = time.Minute
+
+// The commands that can be given a schedule for the host, in the
+// order they run in when due at the same time.
+var hostSchedules = []string{"snap", "cleanup"}
+
+// The commands that can be given a schedule for each mirror, by their
+// key in the mirror.
+var mirrorSchedules = []struct {
+	key     string
+	command string
+}{
+	{"push-schedule", "push"},
+	{"verify-schedule", "verify"},
+	{"check-schedule", "check"},
+	{"prune-schedule", "prune"},
+}
+
+type daemonJob struct {
+	name     string
+	args     []string
+	schedule *cronSchedule
+}
+
+// What the daemon remembers about a job between runs.
+type jobState struct {
+	// The schedule the job was last run with.  When it changes,
+	// the job starts over.
+	Schedule string
+	// When the job last ran, or for a new job, when it was set up.
+	Last     time.Time
+	Finished time.Time `json:",omitempty"`
+	Status   string    `json:",omitempty"`
+	Error    string    `json:",omitempty"`
+}
+
+// The jobs in the config file for this host.
+func (b *Backup) daemonJobs() (jobs []*daemonJob, err error) {
+	add := func(text string, args ...string) (err error) {
+		sched, err := parseCron(text)
+		if err != nil {
+			return
+		}
+		jobs = append(jobs, &daemonJob{
+			name:     strings.Join(args, " "),
+			args:     args,
+			schedule: sched,
+		})
+		return
+	}
+
+	for name := range b.host.Schedule {
+		if !isHostSchedule(name) {
+			err = errors.New(fmt.Sprintf("Unknown command %q in schedule, expecting one of %s",
+				name, strings.Join(hostSchedules, ", ")))
+			return
+		}
+	}
+	for _, name := range hostSchedules {
+		if text, ok := b.host.Schedule[name]; ok {
+			err = add(text, name)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	for _, m := range b.host.Mirrors {
+		for _, ms := range mirrorSchedules {
+			if text, ok := m[ms.key]; ok {
+				err = add(text, ms.command, m["name"])
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+func isHostSchedule(name string) bool {
+	for _, n := range hostSchedules {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The arguments a job's run of goback is given ahead of the command.
+// selfCommand already passes on the logging options, so this only
+// needs to wait for the run lock.
+func jobOptions() []string {
+	return []string{"-wait"}
+}
+
+func (b *Backup) DaemonCmd(args ...string) (err error) {
+	if len(args) != 0 {
+		err = errors.New("'daemon' command not expecting additional arguments")
+		return
+	}
+
+	// Each job reports on its own run.
+	b.report = nil
+
+	release, err := b.lock(daemonLock, false)
+	if err == errLocked {
+		err = errors.New("Another goback daemon is running")
+	}
+	if err != nil {
+		return
+	}
+	defer release()
+
+	jobs, err := b.daemonJobs()
+	if err != nil {
+		return
+	}
+	if len(jobs) == 0 {
+		err = errors.New("No schedules for this host in the config file")
+		return
+	}
+
+	state := make(map[string]*jobState)
+	err = b.loadState(daemonState, &state)
+	if err != nil {
+		return
+	}
+	startJobs(jobs, state, time.Now())
+	err = b.saveState(daemonState, state)
+	if err != nil {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	runLog().Info("Daemon started", "jobs", len(jobs))
+	for !teardowns.Aborted() {
+		due, next := dueJobs(jobs, state, time.Now())
+		for _, job := range due {
+			if teardowns.Aborted() {
+				break
+			}
+			b.runJob(job, state[job.name])
+			err = b.saveState(daemonState, state)
+			if err != nil {
+				return
+			}
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		sleep := daemonPoll
+		if until := time.Until(next); until < sleep {
+			sleep = until
+		}
+		runLog().Debug("Sleeping", "next", next.Format(time.RFC3339), "for", sleep.Round(time.Second))
+		select {
+		case <-time.After(sleep):
+		case <-sigs:
+		}
+	}
+	runLog().Info("Daemon stopping")
+	return
+}
+
+// Set up the state of jobs that are new, or whose schedule has
+// changed, so that they first run at their next scheduled time after
+// now.
+func startJobs(jobs []*daemonJob, state map[string]*jobState, now time.Time) {
+	for _, job := range jobs {
+		st := state[job.name]
+		if st != nil && st.Schedule == job.schedule.String() {
+			continue
+		}
+		state[job.name] = &jobState{
+			Schedule: job.schedule.String(),
+			Last:     now,
+		}
+	}
+}
+
+// The jobs that are due at now, in the order they became due, and
+// when the next one not yet due is.
+func dueJobs(jobs []*daemonJob, state map[string]*jobState, now time.Time) (due []*daemonJob, next time.Time) {
+	when := make(map[*daemonJob]time.Time)
+	for _, job := range jobs {
+		at := job.schedule.Next(state[job.name].Last)
+		if at.IsZero() {
+			continue
+		}
+		if at.After(now) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+			continue
+		}
+		when[job] = at
+		due = append(due, job)
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return when[due[i]].Before(when[due[j]])
+	})
+	if next.IsZero() {
+		next = now.Add(daemonPoll)
+	}
+	return
+}
+
+func (b *Backup) runJob(job *daemonJob, st *jobState) {
+	st.Last = time.Now()
+	defer logStep("job", "job", job.name)()
+
+	cmd, err := selfCommand(append(jobOptions(), job.args...)...)
+	if err == nil {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		showCommand(cmd)
+		err = runCommand(cmd)
+	}
+
+	st.Finished = time.Now()
+	st.Status = hookStatus(err)
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+		runLog().Error("Job failed", "error", err)
+	}
+}
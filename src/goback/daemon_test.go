@@ -0,0 +1,216 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	at := func(text string) time.Time {
+		when, err := time.ParseInLocation("2006-01-02 15:04", text, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return when
+	}
+
+	tests := []struct {
+		sched string
+		from  string
+		want  string
+	}{
+		{"* * * * *", "2013-06-01 10:20", "2013-06-01 10:21"},
+		{"30 2 * * *", "2013-06-01 10:20", "2013-06-02 02:30"},
+		{"30 2 * * *", "2013-06-01 02:29", "2013-06-01 02:30"},
+		{"*/15 * * * *", "2013-06-01 10:20", "2013-06-01 10:30"},
+		{"0 9-17/4 * * *", "2013-06-01 14:00", "2013-06-01 17:00"},
+		{"0 0 * * sun", "2013-06-01 10:20", "2013-06-02 00:00"},
+		{"0 0 * * 7", "2013-06-01 10:20", "2013-06-02 00:00"},
+		{"0 0 1 * *", "2013-06-01 10:20", "2013-07-01 00:00"},
+		{"0 0 13 * fri", "2013-06-01 10:20", "2013-06-07 00:00"},
+		{"0 0 29 feb *", "2013-06-01 10:20", "2016-02-29 00:00"},
+		{"@monthly", "2013-12-31 23:59", "2014-01-01 00:00"},
+		{"0 0 31 2 *", "2013-06-01 10:20", ""},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.sched)
+		if err != nil {
+			t.Errorf("%q: %s", tt.sched, err)
+			continue
+		}
+		got := c.Next(at(tt.from))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s: got %s, want never", tt.sched, tt.from, got)
+			}
+			continue
+		}
+		if !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s: got %s, want %s", tt.sched, tt.from, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("No time zone data: %s", err)
+	}
+
+	c, err := parseCron("30 1 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-11-01 01:00-02:00 happens twice, first in PDT, then PST.
+	pdt := time.Date(2026, 11, 1, 8, 30, 5, 0, time.UTC).In(loc)
+	pst := pdt.Add(time.Hour)
+	want := time.Date(2026, 11, 2, 1, 30, 0, 0, loc)
+	for _, from := range []time.Time{pst, pst.Add(15 * time.Minute)} {
+		if got := c.Next(from); !got.Equal(want) {
+			t.Errorf("After %s: got %s, want %s", from, got, want)
+		}
+	}
+	if got := c.Next(pdt); !got.After(pdt) {
+		t.Errorf("After %s: got %s", pdt, got)
+	}
+
+	// Every step through the change moves forward.
+	c, _ = parseCron("*/20 * * * *")
+	when := time.Date(2026, 11, 1, 0, 0, 0, 0, loc)
+	for i := 0; i < 12; i++ {
+		next := c.Next(when)
+		if next.Sub(when) != 20*time.Minute {
+			t.Errorf("After %s: got %s", when, next)
+		}
+		when = next
+	}
+
+	// A time skipped when the clocks go forward waits for the next
+	// day.
+	c, _ = parseCron("30 2 * * *")
+	got := c.Next(time.Date(2026, 3, 8, 0, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 9, 2, 30, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("Spring forward: got %s, want %s", got, want)
+	}
+}
+
+func TestDaemonJobs(t *testing.T) {
+	b := fakeBackup()
+	b.host.Schedule = map[string]string{"snap": "0 2 * * *"}
+	b.host.Mirrors = []GeneralMirror{
+		{"name": "offsite", "style": "rsync", "push-schedule": "30 1 * * *"},
+		{"name": "local", "style": "rsync", "push-schedule": "0 3 * * *"},
+	}
+
+	jobs, err := b.daemonJobs()
+	if err != nil {
+		t.Fatalf("daemonJobs: %s", err)
+	}
+
+	start := time.Date(2013, 6, 1, 12, 0, 0, 0, time.Local)
+	state := make(map[string]*jobState)
+	startJobs(jobs, state, start)
+
+	due, next := dueJobs(jobs, state, start.Add(time.Hour))
+	if len(due) != 0 || !next.Equal(time.Date(2013, 6, 2, 1, 30, 0, 0, time.Local)) {
+		t.Errorf("Before any were due: %d jobs, next at %s", len(due), next)
+	}
+
+	// Woken up after sleeping through all of them, twice.
+	due, _ = dueJobs(jobs, state, start.AddDate(0, 0, 2))
+	names := make([]string, 0, len(due))
+	for _, job := range due {
+		names = append(names, job.name)
+	}
+	if got := strings.Join(names, ", "); got != "push offsite, snap, push local" {
+		t.Errorf("Due: %s", got)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{fail: []string{self + " -wait push local"}}
+	withFakeRunner(fake, func() {
+		for _, job := range due {
+			b.runJob(job, state[job.name])
+		}
+	})
+
+	want := []string{
+		self + " -wait push offsite",
+		self + " -wait snap",
+		self + " -wait push local",
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("Ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+	if st := state["snap"]; st.Status != "ok" || st.Last.Before(start) {
+		t.Errorf("snap state: %+v", st)
+	}
+	if st := state["push local"]; st.Status != "failed" || st.Error == "" {
+		t.Errorf("push local state: %+v", st)
+	}
+
+	// A changed schedule starts over.
+	b.host.Schedule["snap"] = "0 4 * * *"
+	jobs, _ = b.daemonJobs()
+	startJobs(jobs, state, start)
+	if !state["snap"].Last.Equal(start) || state["push offsite"].Last.Equal(start) {
+		t.Errorf("Restarted state wrong")
+	}
+
+	b.host.Schedule["list"] = "@daily"
+	if _, err = b.daemonJobs(); err == nil {
+		t.Errorf("Expected an error for an unschedulable command")
+	}
+}
+
+func TestRunLock(t *testing.T) {
+	b := fakeBackup()
+	b.host.Statedir = t.TempDir()
+
+	release, err := b.lock(runLock, false)
+	if err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	if _, err = b.lock(runLock, false); err != errLocked {
+		t.Errorf("Second lock: %v", err)
+	}
+	release()
+
+	release, err = b.lock(runLock, false)
+	if err != nil {
+		t.Fatalf("lock after release: %s", err)
+	}
+	release()
+}
+
+// The run lock is taken without privileges, so with no Statedir it
+// must be somewhere the user can write.
+func TestRunLockDefault(t *testing.T) {
+	defer func() { geteuid = os.Geteuid }()
+	geteuid = func() int { return 1000 }
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+
+	b := fakeBackup()
+	release, err := b.lock(runLock, false)
+	if err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	release()
+	if _, err = os.Stat(path.Join(state, "goback", runLock)); err != nil {
+		t.Errorf("Not in the user's state directory: %s", err)
+	}
+}
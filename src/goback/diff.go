@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sudo"
+)
+
+// Comparison of two dated copies of a filesystem.  The integrity data
+// gosure saved in each copy is used when both have it, which also
+// catches changed contents.  Otherwise, both trees are walked, and
+// only the metadata is compared.
+
+// A single difference between the copies.
+type diffChange struct {
+	Path   string
+	Change string // added, removed or modified
+	Type   string // of the new entry, if there is one
+
+	// For modifications, what changed: type, mode, owner, size,
+	// mtime, contents, target or device.
+	Fields []string `json:",omitempty"`
+
+	OldSize int64  `json:",omitempty"`
+	NewSize int64  `json:",omitempty"`
+	OldMode string `json:",omitempty"`
+	NewMode string `json:",omitempty"`
+}
+
+type diffResult struct {
+	Filesystem string `json:",omitempty"`
+	From       string `json:",omitempty"`
+	To         string `json:",omitempty"`
+	Method     string // sure or live
+
+	Added    int
+	Removed  int
+	Modified int
+	Changes  []*diffChange
+}
+
+// One side of a comparison.  Hashes is empty for a live tree.
+type diffTree struct {
+	Entries map[string]*ManifestEntry
+	Hashes  map[string]string
+}
+
+func (b *Backup) DiffCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "write the differences as JSON")
+	args, err = parseInterspersed(flags, args)
+	if err != nil {
+		return
+	}
+
+	if len(args) != 3 {
+		err = errors.New("'diff' command expects a filesystem and two dates")
+		return
+	}
+	for _, date := range args[1:] {
+		if !browseDateRe.MatchString(date) {
+			err = errors.New(fmt.Sprintf("Invalid date %q, expecting yyyy.mm.dd", date))
+			return
+		}
+	}
+
+	fs, err := b.lookupFs(args[0])
+	if err != nil {
+		return
+	}
+	defer logWith("filesystem", fs.Lvname)()
+
+	roots := make([]string, 2)
+	for i, date := range args[1:] {
+		src, ok := b.browseSource(fs, date, "")
+		if !ok {
+			err = errors.New(fmt.Sprintf("No copy of %s from %s", fs.Lvname, date))
+			return
+		}
+		runLog().Debug("Comparing copy", "date", date, "from", src.From)
+
+		var release func()
+		roots[i], release, err = b.mountCopy(src, scratchMounts[i])
+		defer release()
+		if err != nil {
+			return
+		}
+	}
+
+	sudo.Setup(runCtx)
+
+	cmd, err := selfCommand("tree-diff", roots[0], roots[1])
+	if err != nil {
+		return
+	}
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+
+	text, err := commandOutput(cmd)
+	if err != nil {
+		return
+	}
+
+	result := &diffResult{}
+	err = json.Unmarshal(text, result)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Reading output of tree-diff: %s", err))
+		return
+	}
+	result.Filesystem = fs.Lvname
+	result.From = args[1]
+	result.To = args[2]
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+		return
+	}
+
+	result.show(os.Stdout)
+	return
+}
+
+// Internal command: tree-diff old new
+//
+// Compare two trees, printing the differences as JSON.
+func treeDiffCmd(args ...string) (err error) {
+	if len(args) != 2 {
+		err = errors.New("tree-diff expects two directories")
+		return
+	}
+
+	result, err := compareTrees(args[0], args[1])
+	if err != nil {
+		return
+	}
+
+	err = json.NewEncoder(os.Stdout).Encode(result)
+	return
+}
+
+func compareTrees(oldDir, newDir string) (result *diffResult, err error) {
+	oldSure := filepath.Join(oldDir, sureName)
+	newSure := filepath.Join(newDir, sureName)
+
+	haveOld, err := fileExists(oldSure)
+	if err != nil {
+		return
+	}
+	haveNew, err := fileExists(newSure)
+	if err != nil {
+		return
+	}
+
+	var trees [2]*diffTree
+	method := "sure"
+	if haveOld && haveNew {
+		for i, name := range []string{oldSure, newSure} {
+			trees[i] = &diffTree{}
+			trees[i].Entries, trees[i].Hashes, err = readSure(name)
+			if err != nil {
+				return
+			}
+		}
+	} else {
+		method = "live"
+		for i, dir := range []string{oldDir, newDir} {
+			trees[i], err = walkTree(dir)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	result = diffTrees(trees[0], trees[1])
+	result.Method = method
+	return
+}
+
+// Read the metadata of everything in a tree.
+func walkTree(root string) (tree *diffTree, err error) {
+	tree = &diffTree{Entries: make(map[string]*ManifestEntry)}
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e, _, err := newManifestEntry(p, rel, fi)
+		if err != nil {
+			return err
+		}
+		tree.Entries[rel] = e
+		return nil
+	})
+	return
+}
+
+// The integrity data itself is always different, and isn't shown.
+func diffSkip(p string) bool {
+	return !strings.Contains(p, "/") && strings.HasPrefix(p, "2sure.")
+}
+
+func diffTrees(old, new *diffTree) (result *diffResult) {
+	result = &diffResult{Changes: make([]*diffChange, 0)}
+
+	paths := make([]string, 0, len(new.Entries))
+	for p := range new.Entries {
+		paths = append(paths, p)
+	}
+	for p := range old.Entries {
+		if _, ok := new.Entries[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		if diffSkip(p) {
+			continue
+		}
+		o, n := old.Entries[p], new.Entries[p]
+
+		switch {
+		case o == nil:
+			result.Added++
+			result.Changes = append(result.Changes, &diffChange{
+				Path: p, Change: "added", Type: n.Type,
+				NewSize: n.Size, NewMode: diffMode(n),
+			})
+		case n == nil:
+			result.Removed++
+			result.Changes = append(result.Changes, &diffChange{
+				Path: p, Change: "removed", Type: o.Type,
+				OldSize: o.Size, OldMode: diffMode(o),
+			})
+		default:
+			fields := diffFields(o, n, old.Hashes[p], new.Hashes[p])
+			if len(fields) == 0 {
+				continue
+			}
+			result.Modified++
+			result.Changes = append(result.Changes, &diffChange{
+				Path: p, Change: "modified", Type: n.Type, Fields: fields,
+				OldSize: o.Size, NewSize: n.Size,
+				OldMode: diffMode(o), NewMode: diffMode(n),
+			})
+		}
+	}
+	return
+}
+
+// What is different between two entries.  Directory times are
+// ignored, since they change with any change to their contents.
+func diffFields(o, n *ManifestEntry, oldHash, newHash string) (fields []string) {
+	if o.Type != n.Type {
+		return []string{"type"}
+	}
+
+	if o.Mode&07777 != n.Mode&07777 {
+		fields = append(fields, "mode")
+	}
+	if o.Uid != n.Uid || o.Gid != n.Gid {
+		fields = append(fields, "owner")
+	}
+
+	switch o.Type {
+	case "f":
+		if o.Size != n.Size {
+			fields = append(fields, "size")
+		}
+		if o.Mtime != n.Mtime {
+			fields = append(fields, "mtime")
+		}
+		if oldHash != "" && newHash != "" && oldHash != newHash {
+			fields = append(fields, "contents")
+		}
+	case "l":
+		if o.Link != n.Link {
+			fields = append(fields, "target")
+		}
+	case "c", "b":
+		if o.Rdev != n.Rdev {
+			fields = append(fields, "device")
+		}
+	}
+	return
+}
+
+func diffMode(e *ManifestEntry) string {
+	return fmt.Sprintf("%04o", e.Mode&07777)
+}
+
+// Write the differences as text, one line per change, marked with +,
+// - or M.
+func (r *diffResult) show(w io.Writer) {
+	how := "integrity data"
+	if r.Method == "live" {
+		how = "tree comparison"
+	}
+	fmt.Fprintf(w, "%s: %s to %s (%s)\n", r.Filesystem, r.From, r.To, how)
+
+	for _, c := range r.Changes {
+		name := c.Path
+		if c.Type == "d" {
+			name += "/"
+		}
+
+		switch c.Change {
+		case "added":
+			if c.Type == "f" {
+				fmt.Fprintf(w, "+ %s (%s)\n", name, formatBytes(c.NewSize))
+			} else {
+				fmt.Fprintf(w, "+ %s\n", name)
+			}
+		case "removed":
+			fmt.Fprintf(w, "- %s\n", name)
+		case "modified":
+			details := make([]string, 0, len(c.Fields))
+			for _, f := range c.Fields {
+				switch f {
+				case "size":
+					f = fmt.Sprintf("size %s -> %s", formatBytes(c.OldSize), formatBytes(c.NewSize))
+				case "mode":
+					f = fmt.Sprintf("mode %s -> %s", c.OldMode, c.NewMode)
+				}
+				details = append(details, f)
+			}
+			fmt.Fprintf(w, "M %s: %s\n", name, strings.Join(details, ", "))
+		}
+	}
+
+	fmt.Fprintf(w, "%d added, %d removed, %d modified\n", r.Added, r.Removed, r.Modified)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const sureOld = `asure-2.0
+-----
+d__root__ [gid 0 kind dir perm 493 uid 0 ]
+duser [gid 100 kind dir perm 493 uid 1000 ]
+-
+fnotes [gid 100 kind file mtime 1370000000 perm 420 sha1 aaaa size 10 uid 1000 ]
+fold=20file [gid 100 kind file mtime 1370000000 perm 420 sha1 bbbb size 5 uid 1000 ]
+flink [gid 100 kind lnk perm 511 targ notes uid 1000 ]
+u
+-
+f2sure.bak.gz [gid 0 kind file mtime 1370000000 perm 420 sha1 cccc size 5 uid 0 ]
+u
+`
+
+const sureNew = `asure-2.0
+-----
+d__root__ [gid 0 kind dir perm 493 uid 0 ]
+duser [gid 100 kind dir perm 493 uid 1000 ]
+-
+fnotes [gid 100 kind file mtime 1370000000 perm 384 sha1 dddd size 10 uid 1000 ]
+fnew [gid 100 kind file mtime 1370086400 perm 420 sha1 eeee size 2048 uid 1000 ]
+flink [gid 100 kind lnk perm 511 targ notes uid 1000 ]
+u
+-
+f2sure.bak.gz [gid 0 kind file mtime 1370086400 perm 420 sha1 ffff size 6 uid 0 ]
+u
+`
+
+func TestSureDiff(t *testing.T) {
+	var trees [2]*diffTree
+	for i, text := range []string{sureOld, sureNew} {
+		entries, hashes, err := decodeSure(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("decode: %s", err)
+		}
+		trees[i] = &diffTree{Entries: entries, Hashes: hashes}
+	}
+
+	if e := trees[0].Entries["user/old file"]; e == nil || e.Size != 5 || e.Type != "f" {
+		t.Errorf("Escaped name not decoded: %+v", e)
+	}
+	if e := trees[0].Entries["user/link"]; e == nil || e.Link != "notes" {
+		t.Errorf("Symlink not decoded: %+v", e)
+	}
+
+	result := diffTrees(trees[0], trees[1])
+	got := make([]string, 0)
+	for _, c := range result.Changes {
+		got = append(got, c.Change+" "+c.Path+" "+strings.Join(c.Fields, ","))
+	}
+	want := []string{
+		"added user/new ",
+		"modified user/notes mode,contents",
+		"removed user/old file ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Changes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if result.Added != 1 || result.Removed != 1 || result.Modified != 1 {
+		t.Errorf("Counts %d %d %d", result.Added, result.Removed, result.Modified)
+	}
+
+	var out strings.Builder
+	result.show(&out)
+	if !strings.Contains(out.String(), "M user/notes: mode 0644 -> 0600, contents\n") {
+		t.Errorf("Unexpected text output:\n%s", out.String())
+	}
+}
+
+func TestSureBadHeader(t *testing.T) {
+	_, _, err := decodeSure(strings.NewReader("asure-1.0\n-----\n"))
+	if err == nil {
+		t.Errorf("Accepted a file in the wrong format")
+	}
+}
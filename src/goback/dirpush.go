@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"sudo"
+)
+
+// A dir mirror keeps each dated snapshot as a plain directory under
+// the prefix, so works on any filesystem that supports hardlinks.
+// Files that haven't changed since the previous date are hardlinked
+// to the previous copy, so each date only costs the space of what
+// changed.
+//
+// Each volume is copied into a ".partial" directory first, and only
+// renamed to its dated name once complete, so an interrupted push
+// is never mistaken for a finished one.
+type dirMirror struct {
+	Prefix string
+	backup *Backup
+	names  map[string]bool
+}
+
+func (m *dirMirror) Push(b *Backup) (err error) {
+	m.backup = b
+
+	src, err := m.backup.GetSources()
+	if err != nil {
+		return
+	}
+
+	src, err = m.filterSource(src)
+	if err != nil {
+		return
+	}
+
+	sort.Sort(SourceSlice(src))
+
+	for _, vg := range src {
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
+
+		dest := path.Join(m.Prefix, vg.LV)
+		partial := path.Join(m.Prefix, "."+vg.LV+".partial")
+		prev := m.previous(vg.LV)
+		if prev != "" {
+			prev = path.Join(m.Prefix, prev)
+		}
+
+		runLog().Info("Pushing volume", "source", vg.TextName(),
+			"dest", dest, "previous", prev)
+
+		err = m.pushVol(vg, partial, prev)
+		if err == nil {
+			err = m.backup.rename(partial, dest)
+		}
+		done()
+		if err != nil {
+			return
+		}
+		m.backup.pushed(vg.VgName, start)
+
+		m.names[vg.LV] = true
+	}
+
+	return
+}
+
+// Filter out the source volumes that already have a directory under
+// the prefix.
+func (m *dirMirror) filterSource(src []Source) (result []Source, err error) {
+	m.names, err = scanNames(m.Prefix)
+	if err != nil {
+		return
+	}
+
+	result = make([]Source, 0)
+
+	for _, vol := range src {
+		if !m.names[vol.LV] {
+			result = append(result, vol)
+		}
+	}
+
+	return
+}
+
+// Find the most recent copy of the same filesystem that is older
+// than this one.  Returns an empty string if there isn't one.
+func (m *dirMirror) previous(lv string) (prev string) {
+	base := undate(lv)
+
+	for n := range m.names {
+		if strings.HasPrefix(n, ".") || undate(n) != base || n == base {
+			continue
+		}
+		if n < lv && n > prev {
+			prev = n
+		}
+	}
+
+	return
+}
+
+func (m *dirMirror) pushVol(src Source, dest, prev string) (err error) {
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
+	if err != nil {
+		return
+	}
+
+	err = m.backup.syncTree(src.VgName, "/mnt/old/.", dest, prev)
+	return
+}
+
+func (b *Backup) rename(from, to string) (err error) {
+	sudo.Setup(runCtx)
+
+	cmd := exec.Command("mv", "-T", from, to)
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	err = runCommand(cmd)
+	return
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"tsync"
+)
+
+// Recreation of files from archives and chunk stores, as described by
+// their manifest entries.  Part of a tree, everything at or below
+// Prefix, is restored to Dest.  Each item is shown on stdout in the
+// same itemized format that the sync engines use.
+type extractor struct {
+	Prefix string
+	Dest   string
+
+	// Directories have their metadata set at the end, once their
+	// contents have been written.
+	dirs []*ManifestEntry
+
+	// Files outside of the part being restored that are hardlinked
+	// to from inside it, and where they go instead.
+	redirect map[string]string
+}
+
+// Prepare to restore from the entries of a manifest.
+func (x *extractor) plan(entries []*ManifestEntry) {
+	x.redirect = make(map[string]string)
+	for _, e := range entries {
+		if e.Type != "h" {
+			continue
+		}
+		if _, ok := x.target(e.Link); ok {
+			continue
+		}
+		if dest, ok := x.target(e.Path); ok {
+			x.redirect[e.Link] = dest
+		}
+	}
+}
+
+// Where a path from the manifest goes, if it is within the part
+// being restored.
+func (x *extractor) target(p string) (dest string, ok bool) {
+	if dest, ok = x.redirect[p]; ok {
+		return
+	}
+
+	switch {
+	case x.Prefix == "" || x.Prefix == ".":
+		return filepath.Join(x.Dest, p), true
+	case p == x.Prefix:
+		return x.Dest, true
+	case strings.HasPrefix(p, x.Prefix+"/"):
+		return filepath.Join(x.Dest, p[len(x.Prefix)+1:]), true
+	}
+	return
+}
+
+// Make the node for an entry, with content read from data for regular
+// files.
+func (x *extractor) create(e *ManifestEntry, data io.Reader, xattrs map[string][]byte) (err error) {
+	dest, ok := x.target(e.Path)
+	if !ok {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return
+	}
+
+	// Anything in the way is replaced, apart from directories,
+	// which are merged into.
+	if e.Type == "h" && x.redirect[e.Link] == dest {
+		// Already written, as the first link.
+	} else if fi, lerr := os.Lstat(dest); lerr == nil && !(fi.IsDir() && e.Type == "d") {
+		err = os.RemoveAll(dest)
+		if err != nil {
+			return
+		}
+	}
+
+	kind := "f"
+	switch e.Type {
+	case "f":
+		err = writeData(dest, data)
+	case "d":
+		err = os.Mkdir(dest, 0700)
+		if os.IsExist(err) {
+			err = nil
+		}
+		kind = "d"
+	case "l":
+		err = os.Symlink(e.Link, dest)
+		kind = "L"
+	case "h":
+		// When the first link is outside what is being
+		// restored, its contents were written here.
+		first, _ := x.target(e.Link)
+		if first == dest {
+			return
+		}
+		err = os.Link(first, dest)
+		if err == nil {
+			fmt.Printf("hf+++++++++ %s => %s\n", x.show(dest, false), x.show(first, false))
+		}
+		return
+	case "c", "b", "p", "s":
+		var mode uint32
+		switch e.Type {
+		case "c":
+			mode = syscall.S_IFCHR
+		case "b":
+			mode = syscall.S_IFBLK
+		case "p":
+			mode = syscall.S_IFIFO
+		case "s":
+			mode = syscall.S_IFSOCK
+		}
+		err = syscall.Mknod(dest, mode|e.Mode&07777, int(e.Rdev))
+		if err != nil {
+			err = &os.PathError{Op: "mknod", Path: dest, Err: err}
+		}
+		kind = "D"
+	}
+	if err != nil {
+		return
+	}
+
+	for k, v := range xattrs {
+		err = tsync.SetXattr(dest, k, v)
+		if err != nil {
+			return &os.PathError{Op: "setxattr " + k, Path: dest, Err: err}
+		}
+	}
+
+	if e.Type == "d" {
+		x.dirs = append(x.dirs, e)
+		fmt.Printf("cd+++++++++ %s\n", x.show(dest, true))
+		return
+	}
+
+	err = setEntryMeta(dest, e)
+	if err != nil {
+		return
+	}
+
+	flag := "c"
+	if kind == "f" {
+		flag = ">"
+	}
+	fmt.Printf("%s%s+++++++++ %s\n", flag, kind, x.show(dest, false))
+	return
+}
+
+// The name of a restored item, as shown in the itemized output,
+// relative to Dest.
+func (x *extractor) show(dest string, dir bool) string {
+	rel, err := filepath.Rel(x.Dest, dest)
+	if err != nil || rel == "." {
+		return "./"
+	}
+	if dir {
+		rel += "/"
+	}
+	return rel
+}
+
+// Set the metadata of the directories, innermost first.
+func (x *extractor) finish() (err error) {
+	sort.Slice(x.dirs, func(i, j int) bool {
+		return x.dirs[i].Path > x.dirs[j].Path
+	})
+
+	for _, e := range x.dirs {
+		dest, _ := x.target(e.Path)
+		err = setEntryMeta(dest, e)
+		if err != nil {
+			return
+		}
+	}
+	x.dirs = nil
+	return
+}
+
+func setEntryMeta(dest string, e *ManifestEntry) (err error) {
+	err = os.Lchown(dest, e.Uid, e.Gid)
+	if err != nil {
+		return
+	}
+
+	if e.Type != "l" {
+		err = syscall.Chmod(dest, e.Mode&07777)
+		if err != nil {
+			return &os.PathError{Op: "chmod", Path: dest, Err: err}
+		}
+	}
+
+	err = tsync.SetMtime(dest, e.Mtime)
+	if err != nil {
+		err = &os.PathError{Op: "utimensat", Path: dest, Err: err}
+	}
+	return
+}
+
+func writeData(dest string, data io.Reader) (err error) {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+
+	if data != nil {
+		_, err = io.Copy(f, data)
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return
+}
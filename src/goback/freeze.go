@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"sudo"
+)
+
+// Consistency groups.  The filesystems of a group are frozen with
+// fsfreeze, all of their snapshots taken, and then they are thawed,
+// so that, say, a database spread across several filesystems has
+// snapshots from the same instant.
+//
+// The freezing and thawing is done by a separate privileged process,
+// the freezer, which also acts as a watchdog: it thaws the group when
+// told to, when goback goes away, when it is signalled, or when the
+// group has been frozen for longer than FreezeTimeout.
+//
+// The snapshots are made with lvcreate while the group is frozen.
+// Before Linux 6.6, device-mapper's suspend tries to freeze the
+// filesystem again, which fails with EBUSY when it has already been
+// frozen from userspace, so groups are refused on older kernels.
+
+const defaultFreezeTimeout = time.Minute
+
+// The first kernel that can snapshot a filesystem frozen by fsfreeze.
+var minFreezeKernel = [2]int{6, 6}
+
+// The running kernel's release, as in uname -r.
+var kernelRelease = func() (release string, err error) {
+	var uts syscall.Utsname
+	err = syscall.Uname(&uts)
+	if err != nil {
+		return
+	}
+
+	var buf strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		buf.WriteByte(byte(c))
+	}
+	release = buf.String()
+	return
+}
+
+// The major and minor version from a kernel release such as
+// "6.1.0-18-amd64".
+func parseKernelRelease(release string) (version [2]int, err error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) >= 2 {
+		minor := parts[1]
+		if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+			minor = minor[:i]
+		}
+		version[0], err = strconv.Atoi(parts[0])
+		if err == nil {
+			version[1], err = strconv.Atoi(minor)
+		}
+	}
+	if len(parts) < 2 || err != nil {
+		err = errors.New(fmt.Sprintf("Unable to parse kernel release %q", release))
+	}
+	return
+}
+
+// Check that the kernel can snapshot frozen filesystems.
+func checkFreezeKernel(name string) (err error) {
+	release, err := kernelRelease()
+	if err != nil {
+		return
+	}
+	version, err := parseKernelRelease(release)
+	if err != nil {
+		return
+	}
+
+	if version[0] < minFreezeKernel[0] ||
+		version[0] == minFreezeKernel[0] && version[1] < minFreezeKernel[1] {
+		err = errors.New(fmt.Sprintf("Group %q needs Linux %d.%d or later to snapshot frozen filesystems, "+
+			"and this is %s", name, minFreezeKernel[0], minFreezeKernel[1], release))
+	}
+	return
+}
+
+// The filesystems, grouped for snapshotting.  Each filesystem not in
+// a group is in a group of its own.
+func (b *Backup) snapGroups() (groups [][]*FsInfo) {
+	index := make(map[string]int)
+	for _, fs := range b.host.Filesystems {
+		if fs.Group == "" {
+			groups = append(groups, []*FsInfo{fs})
+			continue
+		}
+		if i, ok := index[fs.Group]; ok {
+			groups[i] = append(groups[i], fs)
+			continue
+		}
+		index[fs.Group] = len(groups)
+		groups = append(groups, []*FsInfo{fs})
+	}
+	return
+}
+
+// Snapshot the filesystems of a group, with their hooks around it.
+// Filesystems whose pre hook fails are left out.
+func (b *Backup) snapGroup(group []*FsInfo) (err error) {
+	members := make([]*FsInfo, 0, len(group))
+	for _, fs := range group {
+		herr := b.runHook("pre-snapshot", fs, "")
+		if herr != nil {
+			b.skipFs(fs, herr)
+			err = b.runHook("post-snapshot", fs, "failed")
+			if err != nil {
+				return
+			}
+			continue
+		}
+		members = append(members, fs)
+	}
+
+	defer func() {
+		for _, fs := range members {
+			herr := b.runHook("post-snapshot", fs, hookStatus(err))
+			if err == nil {
+				err = herr
+			}
+		}
+	}()
+
+	if len(members) == 0 {
+		return
+	}
+
+	var f *freezer
+	if group[0].Group != "" {
+		f, err = b.freeze(group[0].Group, members)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, fs := range members {
+		err = b.snapOne(fs)
+		if err != nil {
+			break
+		}
+	}
+
+	if f != nil {
+		terr := f.thaw()
+		if err == nil {
+			err = terr
+		}
+	}
+	return
+}
+
+// A running freezer.  The group stays frozen until it is thawed.
+type freezer struct {
+	name  string
+	stdin io.WriteCloser
+	done  chan error
+}
+
+func (b *Backup) freeze(name string, members []*FsInfo) (f *freezer, err error) {
+	timeout := defaultFreezeTimeout
+	if b.host.FreezeTimeout != "" {
+		timeout, err = time.ParseDuration(b.host.FreezeTimeout)
+		if err != nil {
+			return
+		}
+	}
+
+	args := []string{"freeze", "-timeout", timeout.String()}
+	for _, fs := range members {
+		// Freezing a btrfs filesystem would stop its own
+		// snapshot from being made.
+		if fs.Subvolume() {
+			err = errors.New(fmt.Sprintf("Filesystem %s is a btrfs subvolume, and can't be in group %q",
+				fs.Lvname, name))
+			return
+		}
+		args = append(args, fs.Mount)
+	}
+
+	sudo.Setup(runCtx)
+
+	cmd, err := selfCommand(args...)
+	if err != nil {
+		return
+	}
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stderr = os.Stderr
+	// Interrupting goback mustn't interrupt the freezer, which
+	// thaws when goback goes away.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	// Closed once the freezer exits, even with a runner that
+	// never starts it.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return
+	}
+	defer stdout.Close()
+	cmd.Stdout = w
+
+	defer logStep("freeze", "group", name)()
+	showCommand(cmd)
+
+	f = &freezer{name: name, stdin: stdin, done: make(chan error, 1)}
+	go func() {
+		err := runCommand(cmd)
+		w.Close()
+		f.done <- err
+	}()
+
+	// The freezer says when everything is frozen.
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if strings.TrimSpace(line) != "frozen" {
+		stdin.Close()
+		err = <-f.done
+		if err == nil {
+			err = errors.New(fmt.Sprintf("Unable to freeze group %q", name))
+		}
+		f = nil
+		return
+	}
+	runLog().Info("Group frozen", "group", name, "filesystems", len(members))
+	return
+}
+
+// Thaw the group.  An error means it had already been thawed, before
+// the snapshots were finished.
+func (f *freezer) thaw() (err error) {
+	f.stdin.Close()
+	err = <-f.done
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Group %q thawed early: %s", f.name, err))
+		return
+	}
+	runLog().Info("Group thawed", "group", f.name)
+	return
+}
+
+// Internal command: freeze [-timeout d] mountpoint...
+//
+// Freeze the filesystems, print "frozen", and then thaw them when
+// stdin is closed.  They are also thawed, with a failure status, on
+// a signal or after the timeout.
+func freezeCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("freeze", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", defaultFreezeTimeout, "longest time to stay frozen")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	args = flags.Args()
+
+	if len(args) == 0 {
+		err = errors.New("freeze expects the filesystems to freeze")
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	frozen := make([]string, 0, len(args))
+	defer func() {
+		for i := len(frozen) - 1; i >= 0; i-- {
+			terr := fsfreeze("-u", frozen[i])
+			if err == nil {
+				err = terr
+			}
+		}
+	}()
+
+	for _, mp := range args {
+		err = fsfreeze("-f", mp)
+		if err != nil {
+			return
+		}
+		frozen = append(frozen, mp)
+	}
+
+	fmt.Println("frozen")
+
+	closed := make(chan bool)
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case sig := <-sigs:
+		err = errors.New(fmt.Sprintf("Thawing on signal %s", sig))
+	case <-time.After(*timeout):
+		err = errors.New(fmt.Sprintf("Thawing after %s timeout", *timeout))
+	}
+	return
+}
+
+func fsfreeze(op, mp string) (err error) {
+	cmd := exec.Command("fsfreeze", op, mp)
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		err = errors.New(fmt.Sprintf("fsfreeze %s %s: %s", op, mp, err))
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Run f as if on the given kernel.
+func withKernel(release string, f func()) {
+	old := kernelRelease
+	kernelRelease = func() (string, error) { return release, nil }
+	defer func() { kernelRelease = old }()
+
+	f()
+}
+
+func TestFreezeGroup(t *testing.T) {
+	b := fakeBackup()
+	b.host.Filesystems = []*FsInfo{
+		{Volgroup: "vg", Lvname: "var", Mount: "/var", Group: "db"},
+		{Volgroup: "vg", Lvname: "home", Mount: "/home"},
+		{Volgroup: "vg", Lvname: "srv", Mount: "/srv", Group: "db"},
+	}
+	b.host.FreezeTimeout = "30s"
+	date := b.namer.date
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{output: map[string]string{self + " freeze": "frozen\n"}}
+	withKernel("6.6.0", func() {
+		withFakeRunner(fake, func() {
+			err = b.MakeSnap()
+		})
+	})
+	if err != nil {
+		t.Fatalf("MakeSnap: %s", err)
+	}
+
+	want := []string{
+		"blkid -o value -s TYPE /dev/mapper/vg-var",
+		"blkid -o value -s TYPE /dev/mapper/vg-home",
+		"blkid -o value -s TYPE /dev/mapper/vg-srv",
+		self + " freeze -timeout 30s /var /srv",
+		"lvcreate -s vg/var -n var." + date,
+		"lvcreate -s vg/srv -n srv." + date,
+		"lvcreate -s vg/home -n home." + date,
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("Ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	// A freezer that doesn't manage to freeze.
+	b = fakeBackup()
+	b.host.Filesystems[0].Group = "db"
+	fake = &fakeRunner{fail: []string{self + " freeze"}}
+	withKernel("6.6.0", func() {
+		withFakeRunner(fake, func() {
+			err = b.MakeSnap()
+		})
+	})
+	if err == nil {
+		t.Errorf("Snapshot made without freezing")
+	}
+	if len(fake.ran) != 2 {
+		t.Errorf("Ran after the freeze failed: %v", fake.ran)
+	}
+}
+
+func TestFreezeKernel(t *testing.T) {
+	for _, c := range []struct {
+		release string
+		major   int
+		minor   int
+	}{
+		{"6.6.0", 6, 6},
+		{"6.1.0-18-amd64", 6, 1},
+		{"5.15.0-105-generic", 5, 15},
+		{"6.10-rc1", 6, 10},
+		{"6.18.44-fc-v139", 6, 18},
+	} {
+		v, err := parseKernelRelease(c.release)
+		if err != nil || v != [2]int{c.major, c.minor} {
+			t.Errorf("%q: got %v, %v", c.release, v, err)
+		}
+	}
+	for _, bad := range []string{"", "6", "x.y"} {
+		if _, err := parseKernelRelease(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+
+	// Older kernels refuse groups before anything is done.
+	b := fakeBackup()
+	b.host.Filesystems[0].Group = "db"
+	fake := &fakeRunner{}
+	var err error
+	withKernel("6.1.0-18-amd64", func() {
+		withFakeRunner(fake, func() {
+			err = b.MakeSnap()
+		})
+	})
+	if err == nil || !strings.Contains(err.Error(), "needs Linux 6.6") {
+		t.Errorf("Got %v", err)
+	}
+	if len(fake.ran) != 0 {
+		t.Errorf("Ran %q", fake.ran)
+	}
+
+	// Without groups, the kernel doesn't matter.
+	b = fakeBackup()
+	fake = &fakeRunner{}
+	withKernel("5.4.0", func() {
+		withFakeRunner(fake, func() {
+			err = b.MakeSnap()
+		})
+	})
+	if err != nil {
+		t.Errorf("Ungrouped snapshot on an old kernel: %s", err)
+	}
+}
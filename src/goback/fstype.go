@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"sudo"
+)
+
+// Handling of the different types of filesystem that can be on a
+// volume.  A filesystem's type comes from its Fstype, or is detected
+// with blkid, as are the types of any other volumes mounted.  Types
+// that aren't known are mounted without any options, and not checked.
+
+type fsType struct {
+	// Options for mounting a volume.
+	MountOpts []string
+
+	// The command to check a snapshot before it is mounted, which
+	// is given the device, and the exit statuses, besides 0, that
+	// mean it is fine.
+	Check   []string
+	CheckOk []int
+
+	// Rather than remounting it in place, unmount the volume and
+	// mount it again, to make it writable.
+	Reopen bool
+}
+
+var fsTypes = map[string]*fsType{
+	"ext2": extFsType,
+	"ext3": extFsType,
+	"ext4": extFsType,
+
+	// A snapshot has the same UUID as its origin, which xfs
+	// refuses to mount twice.
+	"xfs": {
+		MountOpts: []string{"nouuid"},
+		Check:     []string{"xfs_repair", "-n"},
+		Reopen:    true,
+	},
+}
+
+// An fsck that fixes things (status 1) is fine.
+var extFsType = &fsType{
+	Check:   []string{"fsck", "-p", "-f"},
+	CheckOk: []int{1},
+}
+
+// Filesystems whose type couldn't be found are assumed to be ext4, as
+// all of them used to be.
+const defaultFsType = "ext4"
+
+// The type of filesystem on a volume.  Snapshots of a configured
+// filesystem have its type.
+func (b *Backup) fsTypeName(vol VgName) string {
+	if b.fsTypes == nil {
+		b.fsTypes = make(map[string]string)
+	}
+	if name, ok := b.fsTypes[vol.DevName()]; ok {
+		return name
+	}
+
+	dev := vol
+	for _, fs := range b.host.Filesystems {
+		if fs.Volgroup == vol.VG && fs.Lvname == undate(vol.LV) {
+			if fs.Fstype != "" {
+				b.fsTypes[vol.DevName()] = fs.Fstype
+				return fs.Fstype
+			}
+			dev = fs.VgName()
+		}
+	}
+
+	name, err := blkidType(dev)
+	if err != nil || name == "" {
+		runLog().Debug("Unable to detect filesystem type", "volume", dev.TextName(), "error", err)
+		name = defaultFsType
+	}
+	b.fsTypes[vol.DevName()] = name
+	return name
+}
+
+func (b *Backup) fsType(vol VgName) *fsType {
+	if t, ok := fsTypes[b.fsTypeName(vol)]; ok {
+		return t
+	}
+	return &fsType{}
+}
+
+// An LVM snapshot of btrfs has the same fsid as its origin, and the
+// kernel takes the two for the same filesystem, so these have to be
+// configured as btrfs subvolumes instead.
+func (b *Backup) checkSnapFsType(vol VgName) (err error) {
+	if b.fsTypeName(vol) == "btrfs" {
+		err = errors.New(fmt.Sprintf("Volume %s is btrfs, which can't be snapshotted with LVM; configure it with Kind = \"btrfs\"",
+			vol.TextName()))
+	}
+	return
+}
+
+func blkidType(vol VgName) (name string, err error) {
+	sudo.Setup(runCtx)
+
+	cmd := exec.Command("blkid", "-o", "value", "-s", "TYPE", vol.DevName())
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	out, err := commandOutput(cmd)
+	name = strings.TrimSpace(string(out))
+	return
+}
+
+// Check the filesystem on a volume, which must not be mounted.
+func (b *Backup) fsck(vol VgName) (err error) {
+	t := b.fsType(vol)
+	if len(t.Check) == 0 {
+		runLog().Warn("Not checking filesystem of unknown type",
+			"volume", vol.TextName(), "type", b.fsTypeName(vol))
+		return
+	}
+
+	sudo.Setup(runCtx)
+
+	args := append(append([]string{}, t.Check[1:]...), vol.DevName())
+	cmd := exec.Command(t.Check[0], args...)
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	err = runCommand(cmd)
+	if err != nil && cmd.ProcessState != nil {
+		// Some unsuccessful results are fine.
+		stat := cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		runLog().Debug("Check result", "status", stat)
+		for _, ok := range t.CheckOk {
+			if stat == ok {
+				err = nil
+			}
+		}
+	}
+	return
+}
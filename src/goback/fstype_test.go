@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFsTypes(t *testing.T) {
+	b := fakeBackup("home", "home.2013.06.01")
+	b.host.Filesystems[0].Fstype = "xfs"
+	snap := VgName{VG: "vg", LV: "home.2013.06.01"}
+
+	fake := &fakeRunner{}
+	var err error
+	withFakeRunner(fake, func() {
+		err = b.fsck(snap)
+		if err == nil {
+			err = b.mount(snap, "/mnt/snap/home", false)
+		}
+		if err == nil {
+			err = b.remount(snap, "/mnt/snap/home", true)
+		}
+	})
+	if err != nil {
+		t.Fatalf("xfs: %s", err)
+	}
+
+	want := []string{
+		"xfs_repair -n /dev/mapper/vg-home.2013.06.01",
+		"mount -r -o nouuid /dev/mapper/vg-home.2013.06.01 /mnt/snap/home",
+		"umount /dev/mapper/vg-home.2013.06.01",
+		"mount -o nouuid /dev/mapper/vg-home.2013.06.01 /mnt/snap/home",
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("xfs ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	// Detected from the origin, and remembered.
+	b = fakeBackup("home", "home.2013.06.01")
+	fake = &fakeRunner{output: map[string]string{"blkid": "ext4\n"}}
+	withFakeRunner(fake, func() {
+		err = b.fsck(snap)
+		if err == nil {
+			err = b.remount(snap, "/mnt/snap/home", true)
+		}
+	})
+	if err != nil {
+		t.Fatalf("ext4: %s", err)
+	}
+
+	want = []string{
+		"blkid -o value -s TYPE /dev/mapper/vg-home",
+		"fsck -p -f /dev/mapper/vg-home.2013.06.01",
+		"mount -o remount,rw /mnt/snap/home",
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("ext4 ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+// LVM snapshots of btrfs are refused, before any are made.
+func TestFsTypeBtrfs(t *testing.T) {
+	b := fakeBackup("home")
+	fake := &fakeRunner{output: map[string]string{"blkid": "btrfs\n"}}
+	var err error
+	withFakeRunner(fake, func() {
+		err = b.MakeSnap()
+	})
+	if err == nil || !strings.Contains(err.Error(), `Kind = "btrfs"`) {
+		t.Fatalf("MakeSnap: %v", err)
+	}
+	for _, cmd := range fake.ran {
+		if strings.HasPrefix(cmd, "lvcreate") {
+			t.Errorf("snapshot made: %s", cmd)
+		}
+	}
+
+	b = fakeBackup("home", "home.2013.06.01")
+	b.host.Filesystems[0].Fstype = "btrfs"
+	fake = &fakeRunner{}
+	withFakeRunner(fake, func() {
+		err = b.mount(VgName{VG: "vg", LV: "home.2013.06.01"}, "/mnt/snap/home", false)
+	})
+	if err == nil {
+		t.Fatal("btrfs snapshot mounted")
+	}
+	if len(fake.ran) != 0 {
+		t.Errorf("ran: %q", fake.ran)
+	}
+}
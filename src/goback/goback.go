@@ -1,82 +1,188 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
 	"time"
+
+	"sudo"
 )
 
+var logFormat = flag.String("log", "text", "log output format: text, json or syslog")
+var quiet = flag.Bool("quiet", false, "only log warnings and errors")
+var debug = flag.Bool("debug", false, "include debugging records in the log")
+var wait = flag.Bool("wait", false, "wait for another run to finish, rather than failing")
+
+// The context privileges are set up in, which lasts for the whole run.
+var runCtx = context.Background()
+
 func main() {
-	log.Printf("Godump!")
+	flag.Parse()
+
+	err := setupLogging(*logFormat, *quiet, *debug)
+	if err != nil {
+		fatal("Unable to setup logging", "error", err)
+	}
+
+	runLog().Debug("Godump!")
+
+	if flag.NArg() > 0 {
+		if icmd, ok := internalCommands[flag.Arg(0)]; ok {
+			err = icmd(flag.Args()[1:]...)
+			if err != nil {
+				fatal("Internal command failed", "command", flag.Arg(0), "error", err)
+			}
+			return
+		}
+	}
 
-	var err error
 	conf, err := loadConfig()
 	if err != nil {
-		log.Printf("Unable to load config file: %s", err)
-		return
+		fatal("Unable to load config file", "error", err)
 	}
 
 	host, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("Unable to get current hostname: %s", err)
+		fatal("Unable to get current hostname", "error", err)
 	}
-	log.Printf("Hostname: %q", host)
 
-	var info *Host
-	for _, hi := range conf {
-		if hi.Host == host {
-			info = hi
-			break
-		}
-	}
+	info := conf.host(host)
 	if info == nil {
-		log.Fatalf("Host %q not found in config file", host)
+		fatal("Host not found in config file", "host", host)
 	}
 
-	namer := newNamer()
+	// The various parts of the backup.  The report is made as soon
+	// as the host is known, so that the notifiers hear about runs
+	// that fail early.
+	var backup Backup
+	backup.conf = conf
+	backup.namer = newNamer()
+	backup.host = info
+	backup.time = time.Now()
+	backup.report = newReport(host, flag.Arg(0))
+
+	err = sudo.Configure(info.Sudo, info.SudoNonInteractive)
+	if err != nil {
+		backup.abort("Unable to configure privileges", err)
+	}
+	if info.Helper && !unhelpedCommands[flag.Arg(0)] {
+		useHelper()
+	}
 
 	// log.Printf("info: %#v", info)
 	// for _, fs := range info.Filesystems {
 	// 	log.Printf("fs: %#v", fs)
-	// 	log.Printf("volname: %q", namer.Snapvol(fs))
-	// 	log.Printf("dev: %q", namer.Snapdev(fs))
+	// 	log.Printf("volname: %q", backup.namer.Snapvol(fs))
+	// 	log.Printf("dev: %q", backup.namer.Snapdev(fs))
 	// }
 
-	lvm, err := GetLVM()
+	// Get the command.
+	if flag.NArg() < 1 {
+		backup.abort("Usage error",
+			errors.New(fmt.Sprintf("Usage: %s [options] command", os.Args[0])))
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		backup.abort("Unknown command",
+			errors.New(fmt.Sprintf("Unknown command: %q", flag.Arg(0))))
+	}
+
+	slog.SetDefault(slog.Default().With("host", host, "command", flag.Arg(0)))
+	curLog.Store(slog.Default())
+
+	if !unlockedCommands[flag.Arg(0)] {
+		var release func()
+		release, err = backup.lock(runLock, *wait)
+		if err == errLocked {
+			err = errors.New("Another run of goback is in progress")
+		}
+		if err != nil {
+			backup.abort("Unable to take the run lock", err)
+		}
+		defer release()
+	}
+
+	if info.UsesLVM() {
+		backup.lvm, err = GetLVM()
+	} else {
+		backup.lvm = &LVInfo{ByName: make(map[VgName]*VolInfo)}
+	}
 	if err != nil {
-		log.Fatalf("Error getting lvm info: %s", err)
+		backup.abort("Error getting lvm info", err)
 	}
 
-	// The various parts of the backup.
-	var backup Backup
-	backup.conf = conf
-	backup.namer = namer
-	backup.host = info
-	backup.lvm = lvm
-	backup.time = time.Now()
+	teardowns.CatchSignals()
 
-	// Get the command.
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: %s command", os.Args[0])
+	err = cmd(&backup, flag.Args()[1:]...)
+
+	// Undo anything left mounted or activated.
+	sig := teardowns.Finish()
+	stopHelper()
+	sudo.Stop()
+
+	backup.report.Finish(err, sig)
+	backup.notify()
+
+	merr := backup.writeMetrics()
+	if merr != nil {
+		runLog().Error("Unable to write metrics", "error", merr)
 	}
 
-	cmd, ok := commands[os.Args[1]]
-	if !ok {
-		log.Fatalf("Unknown command: %q", os.Args[1])
+	if sig != nil {
+		fatal("Run aborted", "signal", sig.String())
 	}
 
-	err = cmd(&backup, os.Args[2:]...)
 	if err != nil {
-		log.Fatalf("Error running snapshot: %s", err)
+		fatal("Command failed", "error", err,
+			"duration", time.Since(backup.time).Round(time.Millisecond))
 	}
+
+	runLog().Info("Command finished",
+		"duration", time.Since(backup.time).Round(time.Millisecond))
+}
+
+// Give up on a run before the command itself has started, reporting
+// the failure to the notifiers.
+func (b *Backup) abort(msg string, err error) {
+	b.report.Finish(err, nil)
+	b.notify()
+	fatal(msg, "error", err)
 }
 
 type command func(*Backup, ...string) error
 
 var commands = map[string]command{
-	"snap": (*Backup).SnapCmd,
-	"push": (*Backup).PushCmd,
+	"snap":    (*Backup).SnapCmd,
+	"push":    (*Backup).PushCmd,
+	"cleanup": (*Backup).CleanupCmd,
+	"list":    (*Backup).ListCmd,
+	"verify":  (*Backup).VerifyCmd,
+	"prune":   (*Backup).PruneCmd,
+	"check":   (*Backup).CheckCmd,
+	"mount":   (*Backup).MountCmd,
+	"umount":  (*Backup).UmountCmd,
+	"restore": (*Backup).RestoreCmd,
+	"diff":    (*Backup).DiffCmd,
+	"daemon":  (*Backup).DaemonCmd,
+}
+
+// Commands that run without the run lock.  Each of the daemon's jobs
+// takes it instead.
+var unlockedCommands = map[string]bool{
+	"list":   true,
+	"daemon": true,
+}
+
+// Commands that don't use the privileged helper even when it is
+// configured.  A restore writes wherever it is asked to, which the
+// helper won't do.
+var unhelpedCommands = map[string]bool{
+	"restore": true,
 }
 
 func (b *Backup) SnapCmd(args ...string) (err error) {
@@ -102,36 +208,116 @@ func (b *Backup) SnapCmd(args ...string) (err error) {
 		return
 	}
 
+	err = b.skippedError()
 	return
 }
 
 func (b *Backup) PushCmd(args ...string) (err error) {
-	if len(args) != 1 {
-		err = errors.New("'push' command expects one argument")
+	m, done, err := b.selectMirror("push", args)
+	if err != nil {
 		return
 	}
+	defer done()
 
-	var info GeneralMirror
-	for _, m := range b.host.Mirrors {
-		if m["name"] == args[0] {
-			info = m
-			break
-		}
+	err = b.pushWithHooks(m)
+	return
+}
+
+func (b *Backup) VerifyCmd(args ...string) (err error) {
+	m, done, err := b.selectMirror("verify", args)
+	if err != nil {
+		return
+	}
+	defer done()
+
+	v, ok := m.(Verifier)
+	if !ok {
+		err = errors.New(fmt.Sprintf("Mirror %q has no archives to verify", args[0]))
+		return
+	}
+
+	err = v.Verify(b)
+	return
+}
+
+func (b *Backup) PruneCmd(args ...string) (err error) {
+	m, done, err := b.selectMirror("prune", args)
+	if err != nil {
+		return
+	}
+	defer done()
+
+	p, ok := m.(Pruner)
+	if !ok {
+		err = errors.New(fmt.Sprintf("Mirror %q can't be pruned", args[0]))
+		return
+	}
+
+	err = p.Prune(b)
+	return
+}
+
+func (b *Backup) CheckCmd(args ...string) (err error) {
+	m, done, err := b.selectMirror("check", args)
+	if err != nil {
+		return
 	}
+	defer done()
 
+	c, ok := m.(Checker)
+	if !ok {
+		err = errors.New(fmt.Sprintf("Mirror %q has no repository to check", args[0]))
+		return
+	}
+
+	err = c.Check(b)
+	return
+}
+
+// Find the mirror named by the single argument of a command, and
+// make it the current one.  The returned function restores the
+// logging context.
+func (b *Backup) selectMirror(command string, args []string) (m Mirror, done func(), err error) {
+	if len(args) != 1 {
+		err = errors.New(fmt.Sprintf("'%s' command expects one argument", command))
+		return
+	}
+
+	info := b.host.LookupMirror(args[0])
 	if info == nil {
-		err = errors.New("'push argument doesn't match a mirrors entry")
+		err = errors.New(fmt.Sprintf("'%s' argument doesn't match a mirrors entry", command))
 		return
 	}
 
-	m, err := info.GetMirror()
+	m, err = info.GetMirror()
 	if err != nil {
 		return
 	}
 
-	err = m.Push(b)
+	done = logWith("mirror", args[0])
+	b.mirror = args[0]
+	b.engine = info["sync"]
+	b.report.Mirror = args[0]
 	return
 }
 
+// Commands that goback runs itself, generally through sudo, to do
+// work that needs privileges.  These don't use the config file.
+var internalCommands = map[string]func(...string) error{
+	"tsync":         tsyncCmd,
+	"tar-create":    tarCreateCmd,
+	"tar-verify":    tarVerifyCmd,
+	"tar-extract":   tarExtractCmd,
+	"chunk-store":   chunkStoreCmd,
+	"chunk-list":    chunkListCmd,
+	"chunk-prune":   chunkPruneCmd,
+	"chunk-check":   chunkCheckCmd,
+	"chunk-restore": chunkRestoreCmd,
+	"tree-diff":     treeDiffCmd,
+	"freeze":        freezeCmd,
+	"helper":        helperCmd,
+	"helper-call":   helperCallCmd,
+}
+
 // This probably should be in the config file.
 var gosurePath = "/home/davidb/bin/gosure"
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"sudo"
+)
+
+// The privileged helper.  With Helper set for the host, goback starts
+// one privileged process, through sudo, the first time it needs
+// privileges, and runs every command that would otherwise have gone
+// through sudo by asking the helper to run it.  The helper only runs
+// the commands its policy allows, built from the configuration it
+// reads itself (see helperpolicy.go), and stops when goback does.
+//
+// The helper listens on a socket in a directory of its own, which
+// belongs to root, and which only the user goback runs as can use.  Each command is run by a small unprivileged
+// stand-in, "goback helper-call", which takes the place of the sudo
+// command.  It hands its standard input and outputs to the helper,
+// which runs the command with them, passes on any signals, and then
+// exits with the command's status.  So the rest of goback runs and
+// stops these commands just as it would any other.
+
+const helperSocket = "helper.sock"
+
+// A request to run a command, sent with the descriptors for its
+// standard input, output and error.  Signals for it follow.
+type helperRequest struct {
+	Args   []string `json:",omitempty"`
+	Dir    string   `json:",omitempty"`
+	Signal int      `json:",omitempty"`
+}
+
+// How the command went.
+type helperReply struct {
+	Error  string `json:",omitempty"`
+	Status int
+	Signal int `json:",omitempty"`
+}
+
+// Runs the commands that need privileges through the helper, and
+// everything else directly.
+type helperRunner struct {
+	lock   sync.Mutex
+	sock   string
+	cmd    *exec.Cmd
+	stdin  *os.File
+	err    error
+	direct execRunner
+}
+
+var helper *helperRunner
+
+// Run privileged commands through the helper from now on.  The
+// helper itself is started when it is first needed.
+func useHelper() {
+	helper = &helperRunner{}
+	runner = helper
+
+	// Only the helper itself is started with sudo.
+	sudo.TickInterval = 0
+}
+
+func (h *helperRunner) Run(cmds ...*exec.Cmd) (moved int64, err error) {
+	for _, cmd := range cmds {
+		args, ok := sudo.Unwrap(cmd)
+		if !ok {
+			continue
+		}
+
+		err = h.start()
+		if err != nil {
+			return
+		}
+
+		// Run the stand-in instead.
+		var self string
+		self, err = os.Executable()
+		if err != nil {
+			return
+		}
+		cmd.Path = self
+		cmd.Args = append([]string{self, "helper-call", h.sock}, args...)
+	}
+
+	return h.direct.Run(cmds...)
+}
+
+func (h *helperRunner) start() (err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.cmd != nil || h.err != nil {
+		return h.err
+	}
+	defer func() { h.err = err }()
+
+	err = sudo.Setup(runCtx)
+	if err != nil {
+		return
+	}
+
+	cmd, err := selfCommand("helper", "-uid", strconv.Itoa(os.Getuid()))
+	if err != nil {
+		return
+	}
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stderr = os.Stderr
+	// The helper goes away when goback does, and mustn't be
+	// interrupted before it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer stdin.Close()
+	cmd.Stdin = stdin
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		w.Close()
+		return
+	}
+
+	showCommand(cmd)
+	err = cmd.Start()
+	if err != nil {
+		w.Close()
+		return
+	}
+
+	// It says where its socket is once it is listening.
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	sock, ok := strings.CutPrefix(strings.TrimSpace(line), "ready ")
+	if !ok {
+		w.Close()
+		cmd.Wait()
+		err = errors.New("Privileged helper didn't start")
+		return
+	}
+
+	h.sock, h.cmd, h.stdin = sock, cmd, w
+	runLog().Info("Privileged helper started", "pid", cmd.Process.Pid)
+	return
+}
+
+// Stop the helper, if it was started.
+func stopHelper() {
+	h := helper
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.cmd == nil {
+		return
+	}
+	h.stdin.Close()
+	err := h.cmd.Wait()
+	if err != nil {
+		runLog().Error("Privileged helper failed", "error", err)
+	}
+	h.cmd = nil
+}
+
+// Where the helper makes the directory for its socket.
+var helperRundir = "/run"
+
+// Internal command: helper -uid n
+//
+// The privileged helper.  Runs the commands sent to it by the given
+// user, until stdin is closed.  What it runs is limited by the
+// configuration of this host in helperConfigFile.  Once it is
+// listening, it prints "ready" and the name of its socket.
+func helperCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("helper", flag.ContinueOnError)
+	uid := flags.Int("uid", -1, "the user allowed to connect")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if flags.NArg() != 0 || *uid < 0 {
+		err = errors.New("helper expects -uid")
+		return
+	}
+
+	conf, err := loadHelperConfig(helperConfigFile)
+	if err != nil {
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	info := conf.host(host)
+	if info == nil {
+		err = errors.New(fmt.Sprintf("Host %q not found in config file", host))
+		return
+	}
+
+	policy, err := newHelperPolicy(info, *uid)
+	if err != nil {
+		return
+	}
+
+	l, sock, err := listenHelper(helperRundir, *uid)
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(path.Dir(sock))
+
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		l.Close()
+	}()
+
+	fmt.Println("ready", sock)
+	serveHelper(l, policy)
+	return
+}
+
+// Listen on a socket for the user, in a new directory in base.  The
+// directory is made here and belongs to root, so nothing can be put in
+// it or renamed, and others can only pass through it.
+func listenHelper(base string, uid int) (l *net.UnixListener, sock string, err error) {
+	dir, err := os.MkdirTemp(base, "goback-helper")
+	if err != nil {
+		return
+	}
+	err = os.Chmod(dir, 0711)
+	if err != nil {
+		os.Remove(dir)
+		return
+	}
+	sock = path.Join(dir, helperSocket)
+
+	old := syscall.Umask(0177)
+	l, err = net.ListenUnix("unixpacket", &net.UnixAddr{Name: sock, Net: "unixpacket"})
+	syscall.Umask(old)
+	if err != nil {
+		os.Remove(dir)
+		return
+	}
+
+	err = os.Lchown(sock, uid, -1)
+	if err != nil {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// Serve requests until the listener is closed.
+func serveHelper(l *net.UnixListener, policy *helperPolicy) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			err := helperServe(conn, policy)
+			if err != nil {
+				reply, _ := json.Marshal(helperReply{Error: err.Error()})
+				conn.Write(reply)
+			}
+		}()
+	}
+}
+
+// Run a single command for a client.
+func helperServe(conn *net.UnixConn, policy *helperPolicy) (err error) {
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return
+	}
+
+	files, err := receiveFiles(oob[:oobn])
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	// Read first, so that the refusal reaches the client.
+	err = checkPeer(conn, policy.uid)
+	if err != nil {
+		return
+	}
+
+	var req helperRequest
+	err = json.Unmarshal(buf[:n], &req)
+	if err != nil {
+		return
+	}
+
+	exe, err := policy.command(req)
+	if err != nil {
+		return
+	}
+
+	cmd := exec.Command(exe, req.Args[1:]...)
+	cmd.Args[0] = req.Args[0]
+	cmd.Dir = req.Dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = files[0], files[1], files[2]
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	// Pass on signals until the client goes quiet.
+	go func() {
+		for {
+			n, rerr := conn.Read(buf)
+			if rerr != nil || n == 0 {
+				return
+			}
+			var sig helperRequest
+			if json.Unmarshal(buf[:n], &sig) == nil && sig.Signal > 0 {
+				cmd.Process.Signal(syscall.Signal(sig.Signal))
+			}
+		}
+	}()
+
+	var reply helperReply
+	werr := cmd.Wait()
+	reply.Status = cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		reply.Signal = int(ws.Signal())
+	} else if werr != nil && reply.Status < 0 {
+		reply.Error = werr.Error()
+	}
+
+	text, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(text)
+	return
+}
+
+// Only the user that started the helper may use it.
+func checkPeer(conn *net.UnixConn, uid int) (err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred *syscall.Ucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	if int(cred.Uid) != uid {
+		err = errors.New(fmt.Sprintf("User %d may not use the helper", cred.Uid))
+	}
+	return
+}
+
+func receiveFiles(oob []byte) (files []*os.File, err error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+
+	for _, msg := range msgs {
+		var fds []int
+		fds, err = syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "fd"+strconv.Itoa(fd)))
+		}
+	}
+
+	if len(files) != 3 {
+		err = errors.New(fmt.Sprintf("Expecting 3 descriptors, got %d", len(files)))
+	}
+	return
+}
+
+// Internal command: helper-call socket command args...
+//
+// Stand in for a command run by the helper, giving it this process's
+// standard input and outputs, and exiting as the command did.
+func helperCallCmd(args ...string) (err error) {
+	if len(args) < 2 {
+		err = errors.New("helper-call expects a socket and a command")
+		return
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return
+	}
+
+	reply, err := helperCall(args[0], helperRequest{Args: args[1:], Dir: dir},
+		[]*os.File{os.Stdin, os.Stdout, os.Stderr})
+	if err != nil {
+		return
+	}
+
+	if reply.Signal > 0 {
+		sig := syscall.Signal(reply.Signal)
+		signal.Reset(sig)
+		syscall.Kill(os.Getpid(), sig)
+	}
+	if reply.Status != 0 {
+		os.Exit(reply.Status)
+	}
+	return
+}
+
+// Ask the helper to run a command with the given files as its
+// standard input, output and error, and wait for it.
+func helperCall(sock string, req helperRequest, files []*os.File) (reply helperReply, err error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: sock, Net: "unixpacket"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	text, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	_, _, err = conn.WriteMsgUnix(text, syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}()
+	go func() {
+		for sig := range sigs {
+			text, _ := json.Marshal(helperRequest{Signal: int(sig.(syscall.Signal))})
+			conn.Write(text)
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Lost the privileged helper: %s", err))
+		return
+	}
+	err = json.Unmarshal(buf[:n], &reply)
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+	return
+}
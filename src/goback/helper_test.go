@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// A policy for a host with an LVM filesystem, a btrfs subvolume,
+// and dir and ssh mirrors, all under dir.
+func fakePolicy(t *testing.T, dir string) *helperPolicy {
+	host := &Host{
+		Snapdir: path.Join(dir, "snap"),
+		Filesystems: []*FsInfo{
+			{Volgroup: "vg", Lvname: "home", Mount: "/home"},
+			{Kind: "btrfs", Lvname: "data", Mount: "/data"},
+		},
+		Mirrors: []GeneralMirror{
+			{"name": "usb", "style": "dir", "prefix": path.Join(dir, "usb")},
+			{"name": "offsite", "style": "ssh", "host": "backup", "dir": "/backup",
+				"snapshot": "cp", "ssh": "ssh -p 2222"},
+		},
+	}
+	p, err := newHelperPolicy(host, os.Getuid())
+	if err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+	return p
+}
+
+func TestHelperPolicy(t *testing.T) {
+	dir := t.TempDir()
+	p := fakePolicy(t, dir)
+	snap := path.Join(dir, "snap", "home")
+	usb := path.Join(dir, "usb")
+
+	for _, args := range [][]string{
+		{"lvchange", "-ay", "-K", "/dev/mapper/vg-home.2013.06.01"},
+		{"lvchange", "-an", "/dev/mapper/vg-home.2013.06.01"},
+		{"lvcreate", "-s", "vg/home", "-n", "home.2013.06.01"},
+		{"/usr/bin/mount", "-r", "/dev/mapper/vg-home.2013.06.01", "/mnt/old"},
+		{"mount", "/dev/mapper/vg-home.2013.06.01", snap},
+		{"mount", "-o", "remount,ro", snap},
+		{"mount", "-o", "bind,ro", "/data/.snapshots/data.2013.06.01", "/mnt/old"},
+		{"umount", "/dev/mapper/vg-home.2013.06.01"},
+		{"mkdir", "-p", path.Join(dir, "snap", "browse", "usb")},
+		{"cp", "-p", "/home/2sure.dat.gz", snap},
+		{"mv", "-T", path.Join(usb, ".home.partial"), path.Join(usb, "home.2013.06.01")},
+		{"rsync", "-aXHi", "--stats", "--delete", "--link-dest=" + path.Join(usb, "home.2013.05.31"),
+			"/mnt/old/.", path.Join(usb, ".home.partial")},
+		{"rsync", "-aXHi", "--stats", "--delete", "--protect-args", "-e", "ssh -p 2222",
+			"/mnt/old/.", "backup:/backup/home"},
+		{"ssh", "-p", "2222", "backup", "ls /backup"},
+		{"btrfs", "subvolume", "snapshot", "-r", "/data", "/data/.snapshots/data.2013.06.01"},
+		{p.self, "-log=json", "tsync", "-link-dest", "", "/mnt/old/.", path.Join(usb, "home")},
+		{gosurePath, "-file", "/home/2sure", "update"},
+	} {
+		if !p.allowed(helperRequest{Args: args, Dir: snap}) {
+			t.Errorf("%q: refused", args)
+		}
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"sh", "-c", "true"},
+		{p.self},
+		{p.self, "helper"},
+		{p.self, "tar-extract", "-manifest", "m", "-name", "a", "/etc"},
+		{"lvchange", "-ay", "/dev/mapper/other-root"},
+		{"lvchange", "-ay", "-K", "/dev/mapper/other-root"},
+		{"lvcreate", "-s", "other/root", "-n", "x"},
+		{"mount", "/dev/mapper/vg-home", "/usr/bin"},
+		{"mount", "-o", "exec,suid", "/dev/mapper/vg-home", "/mnt/old"},
+		{"mount", "-o", "bind,ro", "/etc", "/mnt/old"},
+		{"mount", "/dev/mapper/vg-home", path.Join(dir, "snap", "..", "etc")},
+		{"umount", "/proc"},
+		{"mkdir", "-p", "/etc/cron.d"},
+		{"cp", "-p", "/etc/shadow", snap},
+		{"cp", "-p", "/home/2sure.dat.gz", "/etc/sudoers.d/x"},
+		{"mv", "-T", path.Join(usb, "home"), "/etc/passwd"},
+		{"rsync", "-aXHi", "--stats", "--delete", "-e", "sh -c 'id>/tmp/x'", "/mnt/old/.", "x:/y"},
+		{"rsync", "-aXHi", "--stats", "--delete", "--rsh=ssh", "/mnt/old/.", usb},
+		{"rsync", "-aXHi", "--stats", "--delete", "--protect-args", "-e", "ssh -o ProxyCommand=id",
+			"/mnt/old/.", "backup:/backup/home"},
+		{"rsync", "-aXHi", "--stats", "--delete", "/mnt/old/.", "/etc"},
+		{"rsync", "-aXHi", "--stats", "--delete", "/etc/.", usb},
+		{"ssh", "-o", "ProxyCommand=id", "backup", "ls"},
+		{"ssh", "-p", "2222", "elsewhere", "ls"},
+		{gosurePath, "-file", "/etc/2sure", "update"},
+	} {
+		if p.allowed(helperRequest{Args: args, Dir: snap}) {
+			t.Errorf("%q: expected it to be refused", args)
+		}
+	}
+
+	// Nor is gosure run outside a snapshot.
+	if p.allowed(helperRequest{Args: []string{gosurePath, "-file", "/home/2sure", "update"}, Dir: "/etc"}) {
+		t.Errorf("gosure in /etc: expected it to be refused")
+	}
+
+	// A configured ssh command that could run something else isn't
+	// trusted either.
+	p.ssh[0].Ssh = "ssh -o ProxyCommand=id"
+	if p.allowed(helperRequest{Args: []string{"ssh", "-o", "ProxyCommand=id", "backup", "ls"}}) {
+		t.Errorf("Configured -o: expected it to be refused")
+	}
+}
+
+func TestHelperTrust(t *testing.T) {
+	// Nothing in a directory anyone can write to is trusted.
+	dir := t.TempDir()
+	name := path.Join(dir, "config.toml")
+	os.WriteFile(name, []byte(""), 0644)
+	if _, err := loadHelperConfig(name); err == nil {
+		t.Errorf("Config in %s: expected it to be refused", dir)
+	}
+	os.Symlink(name, path.Join(dir, "link.toml"))
+	if _, err := loadHelperConfig(path.Join(dir, "link.toml")); err == nil {
+		t.Errorf("Symlinked config: expected it to be refused")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() != 0 {
+		if _, err := rootExecutable(self); err == nil {
+			t.Errorf("%s: expected it to be refused", self)
+		}
+	}
+	os.WriteFile(path.Join(dir, "gosure"), []byte(""), 0755)
+	if _, err := rootExecutable(path.Join(dir, "gosure")); err == nil {
+		t.Errorf("gosure in %s: expected it to be refused", dir)
+	}
+
+	// The system's own commands are.
+	if err := rootDirs("/etc"); err != nil {
+		t.Errorf("/etc: %s", err)
+	}
+	mkdir, err := exec.LookPath("mkdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rootExecutable(mkdir); err != nil {
+		t.Errorf("mkdir: %s", err)
+	}
+}
+
+func TestHelper(t *testing.T) {
+	dir := t.TempDir()
+	p := fakePolicy(t, dir)
+	l, sock, err := listenHelper(dir, os.Getuid())
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go serveHelper(l, p)
+
+	// The socket is in a directory of the helper's own, that others
+	// can only pass through.
+	if info, err := os.Stat(path.Dir(sock)); err != nil || info.Mode().Perm() != 0711 {
+		t.Errorf("Socket directory: %v", err)
+	}
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	out, err := os.Create(path.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	files := []*os.File{null, out, out}
+
+	made := path.Join(dir, "snap", "made")
+	reply, err := helperCall(sock, helperRequest{Args: []string{"mkdir", "-p", made}}, files)
+	if err != nil || reply.Status != 0 {
+		t.Fatalf("mkdir: %v %+v", err, reply)
+	}
+	if _, err = os.Stat(made); err != nil {
+		t.Errorf("mkdir didn't: %s", err)
+	}
+
+	// The command's status and output come back.
+	reply, err = helperCall(sock, helperRequest{Args: []string{"rmdir", path.Join(dir, "snap", "none")}}, files)
+	if err != nil || reply.Status != 1 {
+		t.Errorf("rmdir: %v %+v", err, reply)
+	}
+
+	text, _ := os.ReadFile(out.Name())
+	if !strings.Contains(string(text), "No such file") {
+		t.Errorf("Output: %q", text)
+	}
+
+	_, err = helperCall(sock, helperRequest{Args: []string{"sh", "-c", "true"}}, files)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("sh: %v", err)
+	}
+
+	// Only for the user it was started for.
+	other := t.TempDir()
+	l2, sock2, err := listenHelper(other, os.Getuid()+1)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l2.Close()
+	other2 := *p
+	other2.uid = os.Getuid() + 1
+	go serveHelper(l2, &other2)
+
+	_, err = helperCall(sock2, helperRequest{Args: []string{"mkdir", "-p", made}}, files)
+	if err == nil || !strings.Contains(err.Error(), "may not use") {
+		t.Errorf("Other user: %v", err)
+	}
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+// What the privileged helper will run.  A command is only run if its
+// arguments have the form goback itself gives them, and everything
+// they name belongs to the host's configuration: volumes in its volume
+// groups, mount points under Snapdir and the scratch mounts, copies in
+// its mirrors.  The helper reads the configuration itself, from a file
+// only root can change, so the user it runs commands for can't widen
+// any of this.
+type helperPolicy struct {
+	uid  int
+	self string
+
+	// Volume groups snapshotted or mirrored to.
+	vgs map[string]bool
+
+	// The configured filesystems, by where they are mounted.
+	filesystems map[string]*FsInfo
+
+	// Where filesystems are mounted, and directories made and
+	// removed.
+	mounts []string
+
+	// Where btrfs subvolumes keep their snapshots.
+	snapshots []string
+
+	// Copies that can be browsed and diffed.
+	browse []string
+
+	// Where mirror copies are written.
+	dests []string
+
+	// Where the btrfs send mirrors keep and receive snapshots.
+	sends    []string
+	receives []string
+
+	tarDirs  []string
+	repos    []string
+	datasets []string
+	ssh      []*sshMirror
+}
+
+// Build the policy for a host.  Only commands on behalf of the user
+// uid are run.
+func newHelperPolicy(host *Host, uid int) (p *helperPolicy, err error) {
+	p = &helperPolicy{
+		uid:         uid,
+		vgs:         make(map[string]bool),
+		filesystems: make(map[string]*FsInfo),
+	}
+
+	p.self, err = os.Executable()
+	if err != nil {
+		return
+	}
+
+	if host.Snapdir != "" {
+		p.mounts = append(p.mounts, host.Snapdir)
+	}
+	p.mounts = append(p.mounts, scratchMounts...)
+
+	for _, fs := range host.Filesystems {
+		p.filesystems[fs.Mount] = fs
+		if fs.Subvolume() {
+			p.snapshots = append(p.snapshots, fs.SnapshotDir())
+		} else {
+			p.vgs[fs.Volgroup] = true
+		}
+	}
+	p.browse = append(p.browse, p.snapshots...)
+
+	for _, gm := range host.Mirrors {
+		var m Mirror
+		m, err = gm.GetMirror()
+		if err != nil {
+			return
+		}
+
+		switch m := m.(type) {
+		case *lvmMirror:
+			p.vgs[m.VgName] = true
+		case *btrMirror:
+			p.dests = append(p.dests, m.Prefix)
+			p.browse = append(p.browse, m.Prefix)
+		case *btrSendMirror:
+			p.dests = append(p.dests, m.local.Prefix)
+			p.browse = append(p.browse, m.local.Prefix)
+			p.sends = append(p.sends, m.local.Prefix)
+			if m.Receive != "" {
+				p.receives = append(p.receives, m.Receive)
+			}
+		case *dirMirror:
+			p.dests = append(p.dests, m.Prefix)
+			p.browse = append(p.browse, m.Prefix)
+		case *zfsMirror:
+			p.datasets = append(p.datasets, m.Dataset)
+		case *tarMirror:
+			p.tarDirs = append(p.tarDirs, m.Dir)
+		case *chunkMirror:
+			p.repos = append(p.repos, m.Repo)
+		case *sshMirror:
+			p.ssh = append(p.ssh, m)
+		}
+	}
+	return
+}
+
+// The configuration the helper reads.  Only root may be able to change
+// it, since it says what the helper will do.
+const helperConfigFile = "/etc/goback/config.toml"
+
+// Read the helper's configuration.  The file is opened once, and the
+// file that was opened is the one checked and decoded, so it can't be
+// swapped in between.  It, and every directory above it, must belong
+// to root and be writable only by it.
+func loadHelperConfig(name string) (conf Config, err error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if !info.Mode().IsRegular() || !rootOnly(info) {
+		err = errors.New(fmt.Sprintf("Config %q must belong to root and be writable only by it", name))
+		return
+	}
+	err = rootDirs(path.Dir(name))
+	if err != nil {
+		return
+	}
+
+	conf = make(Config)
+	_, err = toml.DecodeReader(f, conf)
+	return
+}
+
+// Does the file belong to root, with nobody else able to write it?
+func rootOnly(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Uid == 0 && info.Mode().Perm()&0022 == 0
+}
+
+// Check that the directory, and every one above it, belongs to root
+// and is writable only by it.  Symlinks aren't followed.
+func rootDirs(dir string) (err error) {
+	if !path.IsAbs(dir) {
+		return errors.New(fmt.Sprintf("Directory %q isn't absolute", dir))
+	}
+
+	for {
+		var info os.FileInfo
+		info, err = os.Lstat(dir)
+		if err != nil {
+			return
+		}
+		if !info.IsDir() || !rootOnly(info) {
+			return errors.New(fmt.Sprintf("Directory %q must belong to root and be writable only by it", dir))
+		}
+		if dir == "/" {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// The file to run for an executable, if only root could have put it
+// there: it, and the directories it is in once symlinks are followed,
+// belong to root and are writable only by it.  gosure and goback
+// itself may well be installed somewhere a user can change.
+func rootExecutable(name string) (exe string, err error) {
+	exe, err = filepath.EvalSymlinks(name)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(exe)
+	if err != nil {
+		return
+	}
+	if !info.Mode().IsRegular() || !rootOnly(info) {
+		err = errors.New(fmt.Sprintf("%q must belong to root and be writable only by it", exe))
+		return
+	}
+	err = rootDirs(path.Dir(exe))
+	return
+}
+
+// The executable the helper runs for a request, if it will run it at
+// all.  Only the name is taken from the request; the command itself
+// is found by the helper.
+func (p *helperPolicy) command(req helperRequest) (exe string, err error) {
+	if len(req.Args) == 0 {
+		err = errors.New("No command given")
+		return
+	}
+	if !p.allowed(req) {
+		err = errors.New(fmt.Sprintf("Command %q not allowed", strings.Join(req.Args, " ")))
+		return
+	}
+
+	switch req.Args[0] {
+	case p.self, gosurePath:
+		exe = req.Args[0]
+	default:
+		exe, err = exec.LookPath(path.Base(req.Args[0]))
+		if err != nil {
+			return
+		}
+	}
+
+	exe, err = rootExecutable(exe)
+	return
+}
+
+// Will the helper run this?
+func (p *helperPolicy) allowed(req helperRequest) bool {
+	args := req.Args
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case p.self:
+		args = args[1:]
+		for len(args) > 0 && p.logOption(args[0]) {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return false
+		}
+		check := helperInternal[args[0]]
+		return check != nil && check(p, args[1:])
+	case gosurePath:
+		return p.gosure(args[1:], req.Dir)
+	}
+
+	check := helperCommands[path.Base(args[0])]
+	return check != nil && check(p, args[1:])
+}
+
+// Internal commands are given the logging options of the goback that
+// asked for them.
+func (p *helperPolicy) logOption(arg string) bool {
+	name, _, ok := strings.Cut(strings.TrimPrefix(arg, "-"), "=")
+	return ok && strings.HasPrefix(arg, "-") && logFlags[name]
+}
+
+type helperCheck func(p *helperPolicy, args []string) bool
+
+// The commands the helper will run, found in its own PATH, and what
+// they may be asked to do.
+var helperCommands = map[string]helperCheck{
+	"blkid":      (*helperPolicy).blkid,
+	"btrfs":      (*helperPolicy).btrfs,
+	"cp":         (*helperPolicy).cp,
+	"fsck":       checkFs("fsck"),
+	"lvchange":   (*helperPolicy).lvchange,
+	"lvcreate":   (*helperPolicy).lvcreate,
+	"lvs":        (*helperPolicy).lvs,
+	"mkdir":      (*helperPolicy).mkdir,
+	"mount":      (*helperPolicy).mount,
+	"mv":         (*helperPolicy).mv,
+	"rmdir":      (*helperPolicy).rmdir,
+	"rsync":      (*helperPolicy).rsync,
+	"ssh":        (*helperPolicy).sshCmd,
+	"umount":     (*helperPolicy).umount,
+	"xfs_repair": checkFs("xfs_repair"),
+	"zfs":        (*helperPolicy).zfs,
+}
+
+// The internal commands it will run.  Restoring writes wherever it is
+// asked to, so is never done through the helper.
+var helperInternal = map[string]helperCheck{
+	"tsync":       (*helperPolicy).tsync,
+	"tar-create":  (*helperPolicy).tarCreate,
+	"chunk-store": chunkArgs("-name", "", "/mnt/old"),
+	"chunk-list":  chunkArgs(),
+	"chunk-prune": chunkArgs("-keep", ""),
+	"chunk-check": chunkArgs(),
+	"tree-diff":   (*helperPolicy).treeDiff,
+	"freeze":      (*helperPolicy).freeze,
+}
+
+// Does the path name one of roots, or something in it?  The path must
+// be absolute and clean, and still be there once any symlinks on the
+// way are followed.
+func (p *helperPolicy) under(name string, roots []string) bool {
+	if !path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+
+	resolved := resolve(name)
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		if within(name, root) && within(resolved, resolve(root)) {
+			return true
+		}
+	}
+	return false
+}
+
+func within(name, root string) bool {
+	root = path.Clean(root)
+	return name == root || strings.HasPrefix(name, strings.TrimSuffix(root, "/")+"/")
+}
+
+// Follow the symlinks in as much of the path as exists.
+func resolve(name string) string {
+	rest := ""
+	for dir := name; ; dir = path.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return path.Join(resolved, rest)
+		}
+		if dir == "/" {
+			return name
+		}
+		rest = path.Join(path.Base(dir), rest)
+	}
+}
+
+// Is this the device of a volume in one of the volume groups?
+func (p *helperPolicy) device(dev string) bool {
+	rest, ok := strings.CutPrefix(dev, "/dev/mapper/")
+	if !ok || strings.Contains(rest, "/") || path.Clean(dev) != dev {
+		return false
+	}
+	for vg := range p.vgs {
+		if vg != "" && strings.HasPrefix(rest, vg+"-") && len(rest) > len(vg)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// A volume or snapshot name, which mustn't look like an option or
+// a path.
+func plainName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "-") && !strings.Contains(name, "/")
+}
+
+// Do the arguments start with exactly these?
+func hasArgs(args []string, want ...string) bool {
+	if len(args) < len(want) {
+		return false
+	}
+	for i, w := range want {
+		if args[i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *helperPolicy) lvchange(args []string) bool {
+	switch {
+	case len(args) == 3 && hasArgs(args, "-ay", "-K"):
+		return p.device(args[2])
+	case len(args) == 2 && hasArgs(args, "-an"):
+		return p.device(args[1])
+	}
+	return false
+}
+
+func (p *helperPolicy) lvcreate(args []string) bool {
+	if len(args) != 4 || args[0] != "-s" || args[2] != "-n" {
+		return false
+	}
+	vg, lv, ok := strings.Cut(args[1], "/")
+	return ok && p.vgs[vg] && plainName(lv) && plainName(args[3])
+}
+
+func (p *helperPolicy) lvs(args []string) bool {
+	return len(args) == 2 && hasArgs(args, "--separator", "|")
+}
+
+func (p *helperPolicy) blkid(args []string) bool {
+	return len(args) == 5 && hasArgs(args, "-o", "value", "-s", "TYPE") && p.device(args[4])
+}
+
+// Check a volume's filesystem the way its type is checked.
+func checkFs(name string) helperCheck {
+	return func(p *helperPolicy, args []string) bool {
+		for _, t := range fsTypes {
+			if len(t.Check) == 0 || t.Check[0] != name || len(args) != len(t.Check) {
+				continue
+			}
+			if hasArgs(args, t.Check[1:]...) && p.device(args[len(args)-1]) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// The options filesystems are mounted with.
+func mountOption(opt string) bool {
+	for _, t := range fsTypes {
+		for _, o := range t.MountOpts {
+			if o == opt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mount [-r] [-o opts] device dir, mount -o remount,ro|rw dir, or
+// mount -o bind,ro copy dir.
+func (p *helperPolicy) mount(args []string) bool {
+	readonly := len(args) > 0 && args[0] == "-r"
+	if readonly {
+		args = args[1:]
+	}
+	opts := ""
+	if len(args) > 1 && args[0] == "-o" {
+		opts = args[1]
+		args = args[2:]
+	}
+
+	switch {
+	case opts == "remount,ro" || opts == "remount,rw":
+		return !readonly && len(args) == 1 && p.under(args[0], p.mounts)
+	case opts == "bind,ro":
+		return !readonly && len(args) == 2 && p.under(args[0], p.browse) &&
+			p.under(args[1], p.mounts)
+	}
+
+	if len(args) != 2 || !p.device(args[0]) || !p.under(args[1], p.mounts) {
+		return false
+	}
+	if opts != "" {
+		for _, o := range strings.Split(opts, ",") {
+			if !mountOption(o) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *helperPolicy) umount(args []string) bool {
+	return len(args) == 1 && (p.device(args[0]) || p.under(args[0], p.mounts))
+}
+
+func (p *helperPolicy) mkdir(args []string) bool {
+	return len(args) == 2 && args[0] == "-p" &&
+		(p.under(args[1], p.mounts) || p.under(args[1], p.snapshots))
+}
+
+func (p *helperPolicy) rmdir(args []string) bool {
+	return len(args) == 1 && p.under(args[0], p.mounts)
+}
+
+// Only the integrity data is copied, into a snapshot.
+func (p *helperPolicy) cp(args []string) bool {
+	if len(args) != 3 || args[0] != "-p" {
+		return false
+	}
+	fs := p.filesystems[path.Dir(args[1])]
+	if fs == nil {
+		return false
+	}
+	switch path.Base(args[1]) {
+	case "2sure.dat.gz", "2sure.bak.gz":
+	default:
+		return false
+	}
+	return p.under(args[2], p.mounts) || p.under(args[2], p.snapshots)
+}
+
+// Only finished copies are renamed, within a dir mirror.
+func (p *helperPolicy) mv(args []string) bool {
+	return len(args) == 3 && args[0] == "-T" &&
+		p.under(args[1], p.dests) && p.under(args[2], p.dests)
+}
+
+// rsync -aXHi --stats --delete [--link-dest=dir] [--protect-args -e
+// ssh] from to, from a scratch mount into a mirror.
+func (p *helperPolicy) rsync(args []string) bool {
+	if len(args) < 5 || !hasArgs(args, "-aXHi", "--stats", "--delete") {
+		return false
+	}
+	from, to := args[len(args)-2], args[len(args)-1]
+	args = args[3 : len(args)-2]
+
+	if len(args) > 0 {
+		if dir, ok := strings.CutPrefix(args[0], "--link-dest="); ok {
+			if !p.under(dir, p.localDests()) {
+				return false
+			}
+			args = args[1:]
+		}
+	}
+
+	if !p.under(path.Clean(from), scratchMounts) {
+		return false
+	}
+
+	switch {
+	case len(args) == 0:
+		return !strings.HasPrefix(to, "-") && p.under(to, p.localDests())
+	case len(args) == 3 && hasArgs(args, "--protect-args", "-e"):
+		for _, m := range p.ssh {
+			host, dir, _ := strings.Cut(to, ":")
+			if args[2] == m.Ssh && safeSsh(strings.Fields(m.Ssh)) && host == m.Host &&
+				path.IsAbs(dir) && path.Clean(dir) == dir && within(dir, m.Dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Where local copies are written, including the mounts of the zfs
+// datasets, found as they are needed.
+func (p *helperPolicy) localDests() []string {
+	dests := append(append([]string{}, p.dests...), "/mnt/new")
+	for _, ds := range p.datasets {
+		out, err := exec.Command("zfs", "get", "-H", "-o", "value", "mountpoint", ds).Output()
+		if err == nil && strings.HasPrefix(string(out), "/") {
+			dests = append(dests, strings.TrimSpace(string(out)))
+		}
+	}
+	return dests
+}
+
+// ssh [options] host command, with a mirror's ssh command and host.
+func (p *helperPolicy) sshCmd(args []string) bool {
+	for _, m := range p.ssh {
+		words := strings.Fields(m.Ssh)
+		if path.Base(words[0]) != "ssh" || !safeSsh(words) {
+			continue
+		}
+		if len(args) == len(words)+1 && hasArgs(args, append(words[1:], m.Host)...) {
+			return true
+		}
+	}
+	return false
+}
+
+// The ssh options a mirror may use.  Anything that would run a command
+// or read another configuration, like -o ProxyCommand or -F, isn't one
+// of them.
+var sshOptions = map[string]bool{
+	"-4": false, "-6": false, "-C": false, "-q": false, "-T": false, "-x": false,
+	"-i": true, "-l": true, "-p": true,
+}
+
+func safeSsh(words []string) bool {
+	if len(words) == 0 || path.Base(words[0]) != "ssh" {
+		return false
+	}
+	for i := 1; i < len(words); i++ {
+		arg, ok := sshOptions[words[i]]
+		if !ok {
+			return false
+		}
+		if arg {
+			i++
+			if i == len(words) || strings.HasPrefix(words[i], "-") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *helperPolicy) dataset(name string) bool {
+	for _, ds := range p.datasets {
+		if name == ds {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *helperPolicy) zfs(args []string) bool {
+	switch {
+	case len(args) == 9 && hasArgs(args, "list", "-H", "-t", "snapshot", "-o", "name", "-d", "1"):
+		return p.dataset(args[8])
+	case len(args) == 6 && hasArgs(args, "get", "-H", "-o", "value", "mountpoint"):
+		return p.dataset(args[5])
+	case len(args) == 2 && args[0] == "snapshot":
+		ds, snap, ok := strings.Cut(args[1], "@")
+		return ok && p.dataset(ds) && plainName(snap)
+	}
+	return false
+}
+
+func (p *helperPolicy) btrfs(args []string) bool {
+	switch {
+	case len(args) == 5 && hasArgs(args, "subvolume", "snapshot", "-r"):
+		// A subvolume into its snapshots, or a mirror copy
+		// within the mirror.
+		if fs := p.filesystems[args[3]]; fs != nil && fs.Subvolume() {
+			return p.under(args[4], []string{fs.SnapshotDir()})
+		}
+		return p.under(args[3], p.dests) && p.under(args[4], p.dests)
+	case len(args) == 3 && hasArgs(args, "subvolume", "show"):
+		return p.under(args[2], p.sends) || p.under(args[2], p.receives)
+	case len(args) == 6 && hasArgs(args, "property", "set", "-ts") &&
+		args[4] == "ro" && (args[5] == "true" || args[5] == "false"):
+		return p.under(args[3], p.snapshots)
+	case len(args) == 2 && args[0] == "send":
+		return p.under(args[1], p.sends)
+	case len(args) == 4 && hasArgs(args, "send", "-p"):
+		return p.under(args[2], p.sends) && p.under(args[3], p.sends)
+	case len(args) == 2 && args[0] == "receive":
+		for _, r := range p.receives {
+			if args[1] == r {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// gosure -file <mount>/2sure update|signoff, run in a snapshot.
+func (p *helperPolicy) gosure(args []string, dir string) bool {
+	if len(args) != 3 || args[0] != "-file" || path.Base(args[1]) != "2sure" ||
+		p.filesystems[path.Dir(args[1])] == nil {
+		return false
+	}
+	if args[2] != "update" && args[2] != "signoff" {
+		return false
+	}
+	return p.under(dir, p.mounts) || p.under(dir, p.snapshots)
+}
+
+// tsync -link-dest dir from to, from a scratch mount into a mirror.
+func (p *helperPolicy) tsync(args []string) bool {
+	if len(args) != 4 || args[0] != "-link-dest" {
+		return false
+	}
+	dests := p.localDests()
+	return (args[1] == "" || p.under(args[1], dests)) &&
+		p.under(path.Clean(args[2]), scratchMounts) && p.under(args[3], dests)
+}
+
+// tar-create -name name [-prev manifest] /mnt/old manifest.  The
+// manifests are in a tar mirror, or in a directory of the user's own.
+func (p *helperPolicy) tarCreate(args []string) bool {
+	if len(args) < 4 || args[0] != "-name" || !plainName(args[1]) {
+		return false
+	}
+	args = args[2:]
+	if args[0] == "-prev" {
+		if len(args) != 4 || !p.manifest(args[1]) {
+			return false
+		}
+		args = args[2:]
+	}
+	return len(args) == 2 && args[0] == "/mnt/old" && p.manifest(args[1])
+}
+
+func (p *helperPolicy) manifest(name string) bool {
+	if p.under(name, p.tarDirs) {
+		return true
+	}
+	if !path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+	info, err := os.Stat(path.Dir(name))
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == p.uid
+}
+
+// chunk-... -repo repo followed by the given arguments, where an
+// empty one can be anything that isn't an option.
+func chunkArgs(want ...string) helperCheck {
+	return func(p *helperPolicy, args []string) bool {
+		if len(args) != 2+len(want) || args[0] != "-repo" {
+			return false
+		}
+		found := false
+		for _, r := range p.repos {
+			found = found || args[1] == r
+		}
+		if !found {
+			return false
+		}
+		for i, w := range want {
+			a := args[2+i]
+			if (w == "" && !plainName(a)) || (w != "" && a != w) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// tree-diff a b, between copies.
+func (p *helperPolicy) treeDiff(args []string) bool {
+	roots := append(append([]string{}, scratchMounts...), p.browse...)
+	return len(args) == 2 && p.under(args[0], roots) && p.under(args[1], roots)
+}
+
+// freeze -timeout d mounts..., of filesystems in consistency groups.
+func (p *helperPolicy) freeze(args []string) bool {
+	if len(args) < 3 || args[0] != "-timeout" {
+		return false
+	}
+	for _, m := range args[2:] {
+		fs := p.filesystems[m]
+		if fs == nil || fs.Group == "" || fs.Subvolume() {
+			return false
+		}
+	}
+	return true
+}
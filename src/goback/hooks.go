@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Hooks are shell commands run around taking snapshots and pushing
+// them, for example to flush a database before its filesystem is
+// snapshotted, and to let it continue afterwards.  The host's hooks
+// run once, around the whole snapshot or push, and each filesystem's
+// around its own part.  Hooks run as the user goback runs as, with a
+// timeout (HookTimeout, default 5m), and with these set in the
+// environment:
+//
+//	GOBACK_HOST      the host from the config file
+//	GOBACK_HOOK      which hook this is (pre-snapshot, ...)
+//	GOBACK_DATE      the date of today's snapshots
+//	GOBACK_FS        the filesystem (Lvname), for its hooks
+//	GOBACK_MOUNT     where the filesystem is mounted
+//	GOBACK_SNAPSHOT  the name of today's snapshot of it
+//	GOBACK_MIRROR    the mirror, for push hooks
+//	GOBACK_STATUS    ok or failed, for post hooks
+//
+// A failed pre hook means that filesystem (or with the host's hook,
+// every filesystem) is skipped.  The post hook is still run, with a
+// status of failed, so that it can undo whatever the pre hook
+// managed to do.
+type Hooks struct {
+	PreSnapshot  string
+	PostSnapshot string
+	PrePush      string
+	PostPush     string
+}
+
+const defaultHookTimeout = 5 * time.Minute
+
+func (h *Hooks) command(name string) string {
+	switch name {
+	case "pre-snapshot":
+		return h.PreSnapshot
+	case "post-snapshot":
+		return h.PostSnapshot
+	case "pre-push":
+		return h.PrePush
+	case "post-push":
+		return h.PostPush
+	}
+	return ""
+}
+
+// Run a hook of a filesystem, or of the host if fs is nil.  Status is
+// given to post hooks.
+func (b *Backup) runHook(name string, fs *FsInfo, status string) (err error) {
+	hooks := &b.host.Hooks
+	if fs != nil {
+		hooks = &fs.Hooks
+	}
+	text := hooks.command(name)
+	if text == "" {
+		return
+	}
+
+	timeout := defaultHookTimeout
+	if b.host.HookTimeout != "" {
+		timeout, err = time.ParseDuration(b.host.HookTimeout)
+		if err != nil {
+			return
+		}
+	}
+
+	args := []any{}
+	if fs != nil {
+		args = append(args, "filesystem", fs.Lvname)
+	}
+	defer logStep(name, args...)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", text)
+	cmd.Env = append(os.Environ(), b.hookEnv(name, fs, status)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// On a timeout, kill everything the hook started, not just the
+	// shell.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	showCommand(cmd)
+
+	err = runCommand(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New(fmt.Sprintf("Hook %s timed out after %s", name, timeout))
+	} else if err != nil {
+		err = errors.New(fmt.Sprintf("Hook %s failed: %s", name, err))
+	}
+	return
+}
+
+func (b *Backup) hookEnv(name string, fs *FsInfo, status string) []string {
+	env := []string{
+		"GOBACK_HOST=" + b.host.Host,
+		"GOBACK_HOOK=" + name,
+		"GOBACK_DATE=" + b.namer.date,
+	}
+	if fs != nil {
+		env = append(env,
+			"GOBACK_FS="+fs.Lvname,
+			"GOBACK_MOUNT="+fs.Mount,
+			"GOBACK_SNAPSHOT="+b.namer.Snapvol(fs))
+	}
+	if strings.HasSuffix(name, "-push") {
+		env = append(env, "GOBACK_MIRROR="+b.mirror)
+	}
+	if status != "" {
+		env = append(env, "GOBACK_STATUS="+status)
+	}
+	return env
+}
+
+func hookStatus(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+// Skip a filesystem for the rest of this run, because one of its hooks
+// failed.
+func (b *Backup) skipFs(fs *FsInfo, err error) {
+	runLog().Error("Skipping filesystem", "filesystem", fs.Lvname, "error", err)
+	b.report.AddError(err)
+	if b.skipped == nil {
+		b.skipped = make(map[*FsInfo]error)
+	}
+	b.skipped[fs] = err
+}
+
+// An error for the filesystems that were skipped, if any were.
+func (b *Backup) skippedError() error {
+	if len(b.skipped) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(b.skipped))
+	for _, fs := range b.host.Filesystems {
+		if _, ok := b.skipped[fs]; ok {
+			names = append(names, fs.Lvname)
+		}
+	}
+	return errors.New(fmt.Sprintf("Skipped filesystems: %s", strings.Join(names, ", ")))
+}
+
+// Push to a mirror, with the push hooks around it.  The host's hooks
+// run around the whole push.  When filesystems have push hooks of
+// their own, each filesystem is pushed separately, with its hooks
+// around just its part, so that (for instance) a paused database
+// isn't kept waiting while the others are pushed.  A filesystem whose
+// pre hook fails isn't pushed.
+func (b *Backup) pushWithHooks(m Mirror) (err error) {
+	err = b.runHook("pre-push", nil, "")
+	defer func() {
+		herr := b.runHook("post-push", nil, hookStatus(err))
+		if err == nil {
+			err = herr
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	if !b.fsPushHooks() {
+		return m.Push(b)
+	}
+
+	defer func() { b.only = nil }()
+	for _, fs := range b.host.Filesystems {
+		if _, skipped := b.skipped[fs]; skipped {
+			continue
+		}
+
+		herr := b.runHook("pre-push", fs, "")
+		if herr == nil {
+			b.only = fs
+			err = m.Push(b)
+		} else {
+			b.skipFs(fs, herr)
+		}
+
+		status := hookStatus(err)
+		if herr != nil {
+			status = "failed"
+		}
+		herr = b.runHook("post-push", fs, status)
+		if err == nil {
+			err = herr
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	err = b.skippedError()
+	return
+}
+
+// Do any of the filesystems have push hooks?
+func (b *Backup) fsPushHooks() bool {
+	for _, fs := range b.host.Filesystems {
+		if fs.PrePush != "" || fs.PostPush != "" {
+			return true
+		}
+	}
+	return false
+}
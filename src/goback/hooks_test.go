@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestHookEnv(t *testing.T) {
+	b := fakeBackup()
+	fs := b.host.Filesystems[0]
+	out := path.Join(t.TempDir(), "env")
+	fs.PostSnapshot = "env | grep ^GOBACK_ | sort > " + out
+
+	err := b.runHook("post-snapshot", fs, "ok")
+	if err != nil {
+		t.Fatalf("hook: %s", err)
+	}
+
+	text, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook output: %s", err)
+	}
+	for _, w := range []string{
+		"GOBACK_FS=home",
+		"GOBACK_HOOK=post-snapshot",
+		"GOBACK_HOST=test",
+		"GOBACK_MOUNT=/home",
+		"GOBACK_SNAPSHOT=home." + b.namer.date,
+		"GOBACK_STATUS=ok",
+	} {
+		if !strings.Contains(string(text), w+"\n") {
+			t.Errorf("Missing %q in hook environment:\n%s", w, text)
+		}
+	}
+
+	b.host.HookTimeout = "100ms"
+	fs.PreSnapshot = "sleep 5"
+	err = b.runHook("pre-snapshot", fs, "")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Hook didn't time out: %v", err)
+	}
+}
+
+func TestHookSkipsFs(t *testing.T) {
+	b := fakeBackup("home")
+	fs := b.host.Filesystems[0]
+	fs.PreSnapshot = "pause-db"
+	fs.PostSnapshot = "resume-db"
+	b.host.PostSnapshot = "host-done"
+
+	fake := &fakeRunner{fail: []string{"sh -c pause-db"}}
+	var err error
+	withFakeRunner(fake, func() {
+		err = b.MakeSnap()
+	})
+	if err != nil {
+		t.Fatalf("MakeSnap: %s", err)
+	}
+
+	want := []string{
+		"blkid -o value -s TYPE /dev/mapper/vg-home",
+		"sh -c pause-db",
+		"sh -c resume-db",
+		"sh -c host-done",
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("Ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	if _, skipped := b.skipped[fs]; !skipped || b.skippedError() == nil {
+		t.Errorf("Filesystem not skipped")
+	}
+	src, _ := b.GetSources()
+	if len(src) != 0 {
+		t.Errorf("Skipped filesystem still a source: %v", src)
+	}
+}
+
+// A mirror that records the sources it is asked to push.
+type recordMirror struct {
+	fake *fakeRunner
+}
+
+func (m *recordMirror) Push(b *Backup) (err error) {
+	src, err := b.GetSources()
+	for _, s := range src {
+		m.fake.ran = append(m.fake.ran, "push "+s.LV)
+	}
+	return
+}
+
+func TestPushHooks(t *testing.T) {
+	b := fakeBackup("home", "home.2013.06.01", "var", "var.2013.06.01", "tmp", "tmp.2013.06.01")
+	home := b.host.Filesystems[0]
+	home.PrePush = "pause-db"
+	home.PostPush = "resume-db"
+	b.host.Filesystems = append(b.host.Filesystems,
+		&FsInfo{Volgroup: "vg", Lvname: "var", Mount: "/var",
+			Hooks: Hooks{PrePush: "pause-var", PostPush: "resume-var"}},
+		&FsInfo{Volgroup: "vg", Lvname: "tmp", Mount: "/tmp"})
+	b.host.PrePush = "host-start"
+	b.host.PostPush = "host-done"
+
+	fake := &fakeRunner{fail: []string{"sh -c pause-var"}}
+	var err error
+	withFakeRunner(fake, func() {
+		err = b.pushWithHooks(&recordMirror{fake: fake})
+	})
+	if err == nil || !strings.Contains(err.Error(), "var") {
+		t.Errorf("Skipped filesystem not reported: %v", err)
+	}
+
+	// Each filesystem's hooks are around only its own push.
+	want := []string{
+		"sh -c host-start",
+		"sh -c pause-db",
+		"push home.2013.06.01",
+		"sh -c resume-db",
+		"sh -c pause-var",
+		"sh -c resume-var",
+		"push tmp.2013.06.01",
+		"sh -c host-done",
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("Ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
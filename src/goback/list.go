@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// List the local snapshots, and what has been pushed to each mirror.
+func (b *Backup) ListCmd(args ...string) (err error) {
+	if len(args) != 0 {
+		err = errors.New("'list' command not expecting additional arguments")
+		return
+	}
+
+	for _, fs := range b.host.Filesystems {
+		fmt.Printf("%s\n", fs)
+
+		if fs.Subvolume() {
+			for _, name := range subvolSnapshots(fs) {
+				fmt.Printf("  %s\n", name)
+			}
+			continue
+		}
+
+		re := fs.MatchRe()
+		names := make([]string, 0)
+		for _, vol := range b.lvm.Volumes {
+			if vol.VG == fs.Volgroup && re.MatchString(vol.LV) {
+				names = append(names, vol.LV)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			vol := b.lvm.ByName[VgName{VG: fs.Volgroup, LV: name}]
+			fmt.Printf("  %-30s %8s %6s%%\n", name, vol.Lsize, vol.Dataused)
+		}
+	}
+
+	if b.host.Rsynclog == "" {
+		return
+	}
+
+	for _, m := range b.host.Mirrors {
+		err = b.listMirror(m["name"])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Show the pushes recorded in the rsync logs of a mirror.
+func (b *Backup) listMirror(name string) (err error) {
+	fmt.Printf("\nmirror %s\n", name)
+
+	dir := b.rsyncLogDir(name)
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+
+	sort.Strings(names)
+
+	for _, n := range names {
+		if !strings.HasSuffix(n, ".log") {
+			continue
+		}
+
+		var stats *RsyncStats
+		stats, err = readRsyncLog(path.Join(dir, n))
+		if err != nil {
+			return
+		}
+		fmt.Printf("  %-30s %s\n", strings.TrimSuffix(n, ".log"), stats)
+	}
+
+	return
+}
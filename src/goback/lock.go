@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Runs of goback that change anything hold the run lock, a file in
+// the Statedir locked with flock, so that a run from cron or the
+// daemon can't overlap one started by hand.  The lock goes away with
+// the process, however it exits.  It is taken without privileges,
+// which is why the default Statedir is the user's own unless goback
+// runs as root.
+
+const runLock = "run.lock"
+
+var errLocked = errors.New("locked")
+
+// Take a lock file in the Statedir, waiting for whoever holds it if
+// wait is set.
+func (b *Backup) lock(name string, wait bool) (release func(), err error) {
+	full := b.statePath(name)
+	err = os.MkdirAll(path.Dir(full), 0755)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(full, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK && wait {
+		runLog().Info("Waiting for lock", "lock", full)
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	}
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		err = errLocked
+		return
+	}
+	if err != nil {
+		file.Close()
+		err = errors.New(fmt.Sprintf("Unable to lock %s: %s", full, err))
+		return
+	}
+
+	// Only informational, for whoever finds it locked.
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+
+	release = func() {
+		file.Close()
+	}
+	return
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Structured logging.  Records are written through log/slog, and
+// carry a consistent set of fields so that the output can be
+// filtered and parsed:
+//
+//	command     the goback command being run (snap, push, ...)
+//	host        the host from the config file
+//	filesystem  the filesystem (Lvname) being worked on
+//	mirror      the name of the mirror being pushed to
+//	step        the step within the command (gosure, rsync, ...)
+//	duration    how long a step or child command took
+//	status      the exit status of a child command
+
+// The logger for the current step.  Steps add their fields to this
+// while they run, so that the commands they invoke are logged with
+// them.  It is read from other goroutines (the signal handler, and
+// the pipelines), so is only ever swapped atomically.
+var curLog atomic.Pointer[slog.Logger]
+
+func init() {
+	curLog.Store(slog.Default())
+}
+
+// The logger to use for the current step.
+func runLog() *slog.Logger {
+	return curLog.Load()
+}
+
+// Configure the default logger.  The format is one of "text",
+// "json" or "syslog".  In quiet mode only warnings and errors are
+// shown, and debug adds the records normally suppressed.
+func setupLogging(format string, quiet, debug bool) (err error) {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	if quiet {
+		level = slog.LevelWarn
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "syslog":
+		handler, err = newSyslogHandler(opts)
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Unknown log format: %q", format))
+		return
+	}
+
+	slog.SetDefault(slog.New(handler))
+	curLog.Store(slog.Default())
+	return
+}
+
+// The options that select the logging, which are passed on to the
+// runs of goback made by this one.
+var logFlags = map[string]bool{"log": true, "quiet": true, "debug": true}
+
+// The logging options this run was given, as arguments for another.
+func logOptions() []string {
+	return logOptionsFrom(flag.CommandLine)
+}
+
+// The logging options set in flags.
+func logOptionsFrom(flags *flag.FlagSet) (opts []string) {
+	flags.Visit(func(f *flag.Flag) {
+		if logFlags[f.Name] {
+			opts = append(opts, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return
+}
+
+// Add fields to the logging context for all records made until the
+// returned function is called.
+func logWith(args ...any) func() {
+	prev := curLog.Swap(runLog().With(args...))
+	return func() { curLog.Store(prev) }
+}
+
+// Start a named step, adding it and any other fields to the logging
+// context.  The returned function logs the completion of the step,
+// with its duration, and restores the previous context.
+func logStep(step string, args ...any) func() {
+	prev := curLog.Swap(runLog().With(append([]any{"step", step}, args...)...))
+	start := time.Now()
+	runLog().Debug("Step starting")
+
+	return func() {
+		runLog().Info("Step finished", "duration", time.Since(start).Round(time.Millisecond))
+		curLog.Store(prev)
+	}
+}
+
+// Log an error and exit.
+func fatal(msg string, args ...any) {
+	runLog().Error(msg, args...)
+	os.Exit(1)
+}
+
+// A handler that sends records to the local syslog (which journald
+// also listens on).  The text formatting is done by a TextHandler,
+// and the level selects the syslog priority.
+type syslogHandler struct {
+	w    *syslog.Writer
+	text slog.Handler
+	buf  *bytes.Buffer
+	lock *sync.Mutex
+}
+
+func newSyslogHandler(opts *slog.HandlerOptions) (h *syslogHandler, err error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "goback")
+	if err != nil {
+		return
+	}
+
+	// Syslog timestamps the records itself.
+	topts := *opts
+	topts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+
+	var buf bytes.Buffer
+	h = &syslogHandler{
+		w:    w,
+		text: slog.NewTextHandler(&buf, &topts),
+		buf:  &buf,
+		lock: new(sync.Mutex),
+	}
+	return
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) (err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.buf.Reset()
+	err = h.text.Handle(ctx, r)
+	if err != nil {
+		return
+	}
+	msg := string(bytes.TrimRight(h.buf.Bytes(), "\n"))
+
+	switch {
+	case r.Level >= slog.LevelError:
+		err = h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		err = h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		err = h.w.Info(msg)
+	default:
+		err = h.w.Debug(msg)
+	}
+	return
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.text = h.text.WithAttrs(attrs)
+	return &nh
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.text = h.text.WithGroup(name)
+	return &nh
+}
+
+// Used for the output of child commands that are shown to the user
+// directly, which are discarded in quiet mode.
+func commandStdout() io.Writer {
+	if !runLog().Enabled(context.Background(), slog.LevelInfo) {
+		return io.Discard
+	}
+	return os.Stdout
+}
@@ -64,13 +64,39 @@ func (v *VolInfo) VgName() VgName {
 	return VgName{VG: v.VG, LV: v.LV}
 }
 
+// Decode the lv_attr bits.  See lvs(8) for the meaning of each
+// position.
+func (v *VolInfo) attrBit(pos int) byte {
+	if len(v.Attr) <= pos {
+		return '-'
+	}
+	return v.Attr[pos]
+}
+
+// Is the volume currently active?
+func (v *VolInfo) Active() bool {
+	return v.attrBit(4) == 'a'
+}
+
+// Is the volume currently open (mounted or otherwise in use)?
+func (v *VolInfo) Open() bool {
+	return v.attrBit(5) == 'o'
+}
+
+// Is the volume flagged to be skipped during activation?  Thin
+// snapshots are created this way, and are only active when goback
+// has explicitly activated them with 'lvchange -K'.
+func (v *VolInfo) SkipActivation() bool {
+	return v.attrBit(9) == 'k'
+}
+
 func GetLVM() (info *LVInfo, err error) {
-	sudo.Setup()
+	sudo.Setup(runCtx)
 
 	cmd := exec.Command("lvs", "--separator", "|")
 	cmd = sudo.Sudoify(cmd)
 
-	text, err := cmd.Output()
+	text, err := commandOutput(cmd)
 	if err != nil {
 		return
 	}
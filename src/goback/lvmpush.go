@@ -1,8 +1,8 @@
 package main
 
 import (
-	"log"
 	"sort"
+	"time"
 )
 
 // An extMirror is capable of mirroring the current local snapshots to
@@ -26,13 +26,16 @@ func (m *lvmMirror) Push(b *Backup) (err error) {
 		return
 	}
 
-	sort.Sort(VgNameSlice(src))
+	sort.Sort(SourceSlice(src))
 
 	for _, vg := range src {
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
 		base := VgName{VG: m.VgName, LV: undate(m.Prefix + vg.LV)}
 		dest := VgName{VG: m.VgName, LV: m.Prefix + vg.LV}
 		err = m.pushVol(vg, dest, base)
 		if err != nil {
+			done()
 			return
 		}
 
@@ -40,9 +43,11 @@ func (m *lvmMirror) Push(b *Backup) (err error) {
 		// the 'pushVol' function so that the volumes are
 		// cleanly unmounted before making the snapshot.
 		err = snapshot(base, dest)
+		done()
 		if err != nil {
 			return
 		}
+		m.backup.pushed(vg.VgName, start)
 	}
 
 	return nil
@@ -50,9 +55,9 @@ func (m *lvmMirror) Push(b *Backup) (err error) {
 
 // Given a list of source volumes, remove all that are present in the
 // destination mirror, and return the result.
-func (m *lvmMirror) filterSource(src []VgName) (result []VgName, err error) {
+func (m *lvmMirror) filterSource(src []Source) (result []Source, err error) {
 
-	sbits := make(map[VgName]bool)
+	sbits := make(map[Source]bool)
 
 	for _, svol := range src {
 		sbits[svol] = true
@@ -70,7 +75,7 @@ func (m *lvmMirror) filterSource(src []VgName) (result []VgName, err error) {
 		}
 	}
 
-	result = make([]VgName, 0, len(sbits))
+	result = make([]Source, 0, len(sbits))
 
 	for k := range sbits {
 		result = append(result, k)
@@ -80,29 +85,23 @@ func (m *lvmMirror) filterSource(src []VgName) (result []VgName, err error) {
 }
 
 // Mirror a single volume.
-func (m *lvmMirror) pushVol(src, dest, base VgName) (err error) {
-	log.Printf("Pushing %s to %s (base = %s)", src.TextName(), dest.TextName(), base.TextName())
+func (m *lvmMirror) pushVol(src Source, dest, base VgName) (err error) {
+	runLog().Info("Pushing volume", "source", src.TextName(),
+		"dest", dest.TextName(), "base", base.TextName())
 
-	// Activate the source.
-	err = m.backup.activate(src)
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
 	if err != nil {
 		return
 	}
-	defer m.backup.deactivate(src)
-
-	err = m.backup.mount(src, "/mnt/old", false)
-	if err != nil {
-		return
-	}
-	defer m.backup.umount(src)
 
 	err = m.backup.mount(base, "/mnt/new", true)
 	if err != nil {
 		return
 	}
-	defer m.backup.umount(base)
+	defer m.backup.umountLater(base)()
 
-	err = m.backup.rsync("/mnt/old/.", "/mnt/new")
+	err = m.backup.syncTree(src.VgName, "/mnt/old/.", "/mnt/new", "")
 	if err != nil {
 		return
 	}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A manifest describes the contents of an archive.  It is written as
+// JSON lines: a header, followed by one entry for every node of the
+// source tree.  For incremental archives, the manifest still lists
+// the whole tree, but the data for unchanged files is found in an
+// earlier archive, named by the entry's Archive field.  The snapshot
+// indexes of a chunk store are manifests too.
+type ManifestHeader struct {
+	Name    string
+	Source  string
+	Parent  string `json:",omitempty"`
+	Created time.Time
+}
+
+type ManifestEntry struct {
+	Path    string
+	Type    string // f d l h c b p s, as in find -type, plus h for hardlinks
+	Mode    uint32
+	Uid     int
+	Gid     int
+	Size    int64  `json:",omitempty"`
+	Mtime   int64  // nanoseconds
+	Rdev    uint64 `json:",omitempty"`
+	Link    string `json:",omitempty"`
+	Sha256  string `json:",omitempty"`
+	Archive string `json:",omitempty"`
+
+	// For chunk store snapshots, the chunks holding the
+	// contents, in order, and the extended attributes, which tar
+	// archives hold themselves.
+	Chunks []string          `json:",omitempty"`
+	Xattrs map[string][]byte `json:",omitempty"`
+}
+
+type Manifest struct {
+	Header  ManifestHeader
+	Entries []*ManifestEntry
+}
+
+// Is the entry the same file (as far as the quick check is concerned)
+// as another?
+func (e *ManifestEntry) Same(other *ManifestEntry) bool {
+	return e.Type == other.Type && e.Mode == other.Mode &&
+		e.Uid == other.Uid && e.Gid == other.Gid &&
+		e.Size == other.Size && e.Mtime == other.Mtime &&
+		e.Rdev == other.Rdev && e.Link == other.Link
+}
+
+// Index the entries by path.
+func (m *Manifest) ByPath() map[string]*ManifestEntry {
+	result := make(map[string]*ManifestEntry)
+	for _, e := range m.Entries {
+		result[e.Path] = e
+	}
+	return result
+}
+
+// Write a manifest out.
+type manifestWriter struct {
+	enc *json.Encoder
+}
+
+func newManifestWriter(w io.Writer, header *ManifestHeader) (mw *manifestWriter, err error) {
+	mw = &manifestWriter{enc: json.NewEncoder(w)}
+	err = mw.enc.Encode(header)
+	return
+}
+
+func (mw *manifestWriter) Add(e *ManifestEntry) error {
+	return mw.enc.Encode(e)
+}
+
+// Write a whole manifest to a file.
+func writeManifest(name string, m *Manifest) (err error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(f)
+	mw, err := newManifestWriter(w, &m.Header)
+	for _, e := range m.Entries {
+		if err != nil {
+			break
+		}
+		err = mw.Add(e)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return
+}
+
+func readManifest(name string) (m *Manifest, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	m, err = decodeManifest(f)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Reading manifest %q: %s", name, err))
+	}
+	return
+}
+
+// Read just the header of a manifest.
+func decodeManifestHeader(r io.Reader) (header *ManifestHeader, err error) {
+	var result ManifestHeader
+	err = json.NewDecoder(bufio.NewReader(r)).Decode(&result)
+	if err != nil {
+		return
+	}
+
+	header = &result
+	return
+}
+
+func decodeManifest(r io.Reader) (m *Manifest, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var result Manifest
+	err = dec.Decode(&result.Header)
+	if err != nil {
+		return
+	}
+
+	for {
+		var e ManifestEntry
+		err = dec.Decode(&e)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		result.Entries = append(result.Entries, &e)
+	}
+
+	m = &result
+	return
+}
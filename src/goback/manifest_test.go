@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	man := &Manifest{
+		Header: ManifestHeader{
+			Name:    "home.2013.06.02",
+			Source:  "/mnt/old",
+			Parent:  "home.2013.06.01",
+			Created: time.Date(2013, 6, 2, 2, 30, 0, 0, time.UTC),
+		},
+		Entries: []*ManifestEntry{
+			{Path: ".", Type: "d", Mode: 0755, Mtime: 1},
+			{Path: "a.txt", Type: "f", Mode: 0644, Uid: 1000, Gid: 100, Size: 3,
+				Mtime: 1370140200000000001, Sha256: "abc", Archive: "home.2013.06.01"},
+			{Path: "b.txt", Type: "h", Link: "a.txt"},
+			{Path: "sym", Type: "l", Mode: 0777, Link: "a.txt"},
+			{Path: "null", Type: "c", Mode: 0666, Rdev: 0x103},
+			{Path: "big", Type: "f", Size: 10, Chunks: []string{"c1", "c2"},
+				Xattrs: map[string][]byte{"user.tag": []byte("\x00\xff")}},
+		},
+	}
+
+	name := path.Join(t.TempDir(), "home.manifest")
+	err := writeManifest(name, man)
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	got, err := readManifest(name)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !got.Header.Created.Equal(man.Header.Created) {
+		t.Errorf("Created %s", got.Header.Created)
+	}
+	got.Header.Created = man.Header.Created
+	if !reflect.DeepEqual(got, man) {
+		t.Errorf("Got %+v, want %+v", got, man)
+	}
+
+	// One JSON line for the header and each entry, leaving out
+	// empty fields.
+	text, _ := os.ReadFile(name)
+	lines := strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+	if len(lines) != 1+len(man.Entries) {
+		t.Errorf("%d lines:\n%s", len(lines), text)
+	}
+	if strings.Contains(lines[1], "Archive") || strings.Contains(lines[1], "Sha256") {
+		t.Errorf("Empty fields written: %s", lines[1])
+	}
+
+	header, err := decodeManifestHeader(bytes.NewReader(text))
+	if err != nil || header.Parent != "home.2013.06.01" {
+		t.Errorf("Header %+v, %v", header, err)
+	}
+
+	byPath := got.ByPath()
+	if !byPath["a.txt"].Same(man.Entries[1]) || byPath["a.txt"].Same(byPath["b.txt"]) {
+		t.Errorf("Same is wrong")
+	}
+
+	_, err = decodeManifest(strings.NewReader(lines[0] + "\n{bad\n"))
+	if err == nil {
+		t.Errorf("Decoded a bad manifest")
+	}
+}
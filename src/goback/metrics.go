@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metrics for the node_exporter textfile collector.  At the end of
+// each run, the file named by the host's Metrics setting is
+// rewritten (atomically) with the health of the backups.  Timestamps
+// of the last successful operations are carried forward from the
+// previous contents of the file, since a single run only updates
+// some of them.
+
+type metricDef struct {
+	name string
+	help string
+	// Persistent metrics are kept from earlier runs, the rest are
+	// computed fresh each time.
+	persistent bool
+}
+
+var metricDefs = []metricDef{
+	{"goback_last_snap_timestamp_seconds", "Time of the last successful snapshot of a filesystem.", true},
+	{"goback_last_push_timestamp_seconds", "Time of the last successful push of a volume to a mirror.", true},
+	{"goback_push_bytes_transferred", "Bytes sent by the last push of a volume to a mirror.", true},
+	{"goback_push_files_changed", "Files created, updated or deleted by the last push of a volume.", true},
+	{"goback_last_run_timestamp_seconds", "Time the last run of a command finished.", true},
+	{"goback_last_run_success", "Whether the last run of a command succeeded.", true},
+	{"goback_run_duration_seconds", "Duration of the last run of a command.", true},
+	{"goback_snapshot_data_percent", "Data% of each local snapshot volume, from lvs.", false},
+	{"goback_local_snapshots", "Number of local snapshots of a filesystem.", false},
+}
+
+// Samples, by metric name, then by formatted label set.
+type metricSet map[string]map[string]float64
+
+func (ms metricSet) set(name string, value float64, labels ...string) {
+	samples, ok := ms[name]
+	if !ok {
+		samples = make(map[string]float64)
+		ms[name] = samples
+	}
+	samples[formatLabels(labels)] = value
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format label pairs (name, value, name, value, ...) the way the
+// exposition format wants them.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i],
+			labelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Read the samples from a previously written metrics file.
+func readMetrics(name string) (ms metricSet, err error) {
+	ms = make(metricSet)
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := scan.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		sp := strings.LastIndexByte(line, ' ')
+		if sp < 0 {
+			continue
+		}
+		value, perr := strconv.ParseFloat(line[sp+1:], 64)
+		if perr != nil {
+			continue
+		}
+
+		series := line[:sp]
+		metric, labels := series, ""
+		if br := strings.IndexByte(series, '{'); br >= 0 {
+			metric, labels = series[:br], series[br:]
+		}
+
+		samples, ok := ms[metric]
+		if !ok {
+			samples = make(map[string]float64)
+			ms[metric] = samples
+		}
+		samples[labels] = value
+	}
+	err = scan.Err()
+	return
+}
+
+// Write the metrics for this run.
+func (b *Backup) writeMetrics() (err error) {
+	name := b.host.Metrics
+	if name == "" || b.report == nil {
+		return
+	}
+
+	old, err := readMetrics(name)
+	if err != nil {
+		return
+	}
+
+	ms := make(metricSet)
+	for _, def := range metricDefs {
+		if samples, ok := old[def.name]; ok && def.persistent {
+			ms[def.name] = samples
+		}
+	}
+
+	r := b.report
+	end := float64(r.End.Unix())
+
+	ms.set("goback_last_run_timestamp_seconds", end, "command", r.Command)
+	ms.set("goback_run_duration_seconds", r.Duration.Seconds(), "command", r.Command)
+	success := 0.0
+	if !r.Failed() {
+		success = 1.0
+	}
+	ms.set("goback_last_run_success", success, "command", r.Command)
+
+	if r.Command == "snap" && !r.Failed() {
+		for _, s := range r.Snapshots {
+			ms.set("goback_last_snap_timestamp_seconds", end, "filesystem", s.Filesystem)
+		}
+	}
+
+	for _, p := range r.Pushes {
+		ms.set("goback_last_push_timestamp_seconds", end,
+			"mirror", r.Mirror, "volume", undate(p.Volume))
+		ms.set("goback_push_bytes_transferred", float64(p.Bytes),
+			"mirror", r.Mirror, "volume", undate(p.Volume))
+		ms.set("goback_push_files_changed", float64(p.Created+p.Updated+p.Deleted),
+			"mirror", r.Mirror, "volume", undate(p.Volume))
+	}
+
+	// The snapshots themselves are taken from a fresh look at the
+	// volumes, since this run may have changed them.
+	lvm := b.lvm
+	if b.host.UsesLVM() {
+		fresh, lerr := GetLVM()
+		if lerr != nil {
+			runLog().Warn("Unable to refresh lvm info for metrics", "error", lerr)
+		} else {
+			lvm = fresh
+		}
+	}
+	if lvm != nil {
+		for _, fs := range b.host.Filesystems {
+			if fs.Subvolume() {
+				ms.set("goback_local_snapshots", float64(len(subvolSnapshots(fs))),
+					"filesystem", fs.Lvname)
+				continue
+			}
+			re := fs.MatchRe()
+			count := 0
+			for _, vol := range lvm.Volumes {
+				if vol.VG != fs.Volgroup || !re.MatchString(vol.LV) {
+					continue
+				}
+				count++
+				pct, perr := strconv.ParseFloat(strings.TrimSpace(vol.Dataused), 64)
+				if perr == nil {
+					ms.set("goback_snapshot_data_percent", pct,
+						"vg", vol.VG, "lv", vol.LV)
+				}
+			}
+			ms.set("goback_local_snapshots", float64(count), "filesystem", fs.Lvname)
+		}
+	}
+
+	return writeMetricFile(name, ms)
+}
+
+// Write the metrics out, replacing the file atomically so that the
+// collector never sees a partial file.
+func writeMetricFile(name string, ms metricSet) (err error) {
+	var buf bytes.Buffer
+
+	for _, def := range metricDefs {
+		samples, ok := ms[def.name]
+		if !ok || len(samples) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "# HELP %s %s\n", def.name, def.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", def.name)
+
+		keys := make([]string, 0, len(samples))
+		for k := range samples {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "%s%s %s\n", def.name, k,
+				strconv.FormatFloat(samples[k], 'g', -1, 64))
+		}
+	}
+
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+	err = os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, name)
+	return
+}
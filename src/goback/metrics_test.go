@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir := t.TempDir()
+	name := path.Join(dir, "goback.prom")
+
+	// Something from before, that isn't carried forward.
+	err := os.WriteFile(name, []byte("goback_local_snapshots{filesystem=\"old\"} 4\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backup{host: &Host{Metrics: name}}
+
+	b.report = newReport("host", "snap")
+	b.report.AddSnap(&SnapReport{Filesystem: "home", Volume: "home.2013.06.01"})
+	b.report.Finish(nil, nil)
+	b.report.End = time.Unix(1000, 0)
+	if err = b.writeMetrics(); err != nil {
+		t.Fatalf("snap metrics: %s", err)
+	}
+
+	b.report = newReport("host", "push")
+	b.report.Mirror = "external"
+	b.report.AddPush(&PushReport{Volume: "home.2013.06.01", Created: 1, Updated: 2, Bytes: 4096})
+	b.report.Finish(nil, nil)
+	b.report.End = time.Unix(2000, 0)
+	if err = b.writeMetrics(); err != nil {
+		t.Fatalf("push metrics: %s", err)
+	}
+
+	text, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{
+		"# TYPE goback_last_snap_timestamp_seconds gauge\n",
+		"goback_last_snap_timestamp_seconds{filesystem=\"home\"} 1000\n",
+		"goback_last_run_timestamp_seconds{command=\"snap\"} 1000\n",
+		"goback_last_run_timestamp_seconds{command=\"push\"} 2000\n",
+		"goback_last_run_success{command=\"push\"} 1\n",
+		"goback_last_push_timestamp_seconds{mirror=\"external\",volume=\"home\"} 2000\n",
+		"goback_push_bytes_transferred{mirror=\"external\",volume=\"home\"} 4096\n",
+		"goback_push_files_changed{mirror=\"external\",volume=\"home\"} 3\n",
+	} {
+		if !strings.Contains(string(text), w) {
+			t.Errorf("Missing %q:\n%s", w, text)
+		}
+	}
+	if strings.Contains(string(text), "goback_local_snapshots") {
+		t.Errorf("Carried forward a fresh metric:\n%s", text)
+	}
+
+	// Only the metrics file itself is left behind.
+	if got := listDir(t, dir); len(got) != 1 || got[0] != "goback.prom" {
+		t.Errorf("Directory has %q", got)
+	}
+
+	ms, err := readMetrics(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ms["goback_last_snap_timestamp_seconds"][`{filesystem="home"}`]; v != 1000 {
+		t.Errorf("Read back %v", v)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	if got := formatLabels(nil); got != "" {
+		t.Errorf("Got %q", got)
+	}
+	got := formatLabels([]string{"a", `x"y\z` + "\n", "b", "c"})
+	if want := `{a="x\"y\\z\n",b="c"}`; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
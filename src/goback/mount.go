@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sudo"
+)
+
+// Browsing of old snapshots.  The mount command mounts a dated copy
+// of a filesystem read-only at <Snapdir>/browse/<date>/<lv>, from the
+// local snapshot if it is still present, or otherwise from a copy in
+// a btrfs, lvm, dir or zfs mirror.  Everything done is recorded in a
+// state file, so that the umount command undoes exactly that, and
+// cleanup leaves it alone.
+
+const browseState = "browse.json"
+
+// A single mount made for browsing.
+type browseMount struct {
+	Mountpoint string
+	Source     string
+
+	// The volume activated for the mount, if it wasn't already
+	// active.
+	Activated string `json:",omitempty"`
+
+	// Directories made for the mount, outermost first.
+	Dirs []string `json:",omitempty"`
+}
+
+// Where a dated copy of a filesystem can be mounted from: either a
+// volume, or a directory to bind mount.
+type browseSource struct {
+	Vol  *VolInfo
+	Dir  string
+	From string
+}
+
+var browseDateRe = regexp.MustCompile(`^\d\d\d\d\.\d\d\.\d\d$`)
+
+func (b *Backup) browseDir() string {
+	return path.Join(b.host.Snapdir, "browse")
+}
+
+func (b *Backup) MountCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("mount", flag.ContinueOnError)
+	all := flags.Bool("all", false, "mount every dated copy of every filesystem")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	args = flags.Args()
+
+	var state []*browseMount
+	err = b.loadState(browseState, &state)
+	if err != nil {
+		return
+	}
+
+	mounts, err := GetMounts()
+	if err != nil {
+		return
+	}
+
+	type want struct {
+		fs   *FsInfo
+		date string
+	}
+	wanted := make([]want, 0)
+
+	if *all {
+		if len(args) != 0 {
+			err = errors.New("'mount --all' not expecting additional arguments")
+			return
+		}
+		for _, fs := range b.host.Filesystems {
+			for _, date := range b.browseDates(fs) {
+				wanted = append(wanted, want{fs, date})
+			}
+		}
+	} else {
+		if len(args) != 2 {
+			err = errors.New("'mount' command expects a filesystem and a date, or --all")
+			return
+		}
+		if !browseDateRe.MatchString(args[1]) {
+			err = errors.New(fmt.Sprintf("Invalid date %q, expecting yyyy.mm.dd", args[1]))
+			return
+		}
+		var fs *FsInfo
+		fs, err = b.lookupFs(args[0])
+		if err != nil {
+			return
+		}
+		wanted = append(wanted, want{fs, args[1]})
+	}
+
+	for _, w := range wanted {
+		mp := path.Join(b.browseDir(), w.date, w.fs.Lvname)
+		if isMounted(mounts, mp) {
+			runLog().Info("Already mounted", "mountpoint", mp)
+			continue
+		}
+
+		src, ok := b.browseSource(w.fs, w.date, "")
+		if !ok {
+			err = errors.New(fmt.Sprintf("No copy of %s from %s", w.fs.Lvname, w.date))
+			return
+		}
+
+		var bm *browseMount
+		bm, err = b.browseMount(src, mp)
+		if bm != nil {
+			state = append(state, bm)
+			serr := b.saveState(browseState, state)
+			if err == nil {
+				err = serr
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		runLog().Info("Mounted", "mountpoint", mp, "source", bm.Source, "from", src.From)
+	}
+
+	return
+}
+
+// Mount a source at mp.  The returned record covers whatever was done,
+// even if the mount itself failed, so that it can be undone.
+func (b *Backup) browseMount(src browseSource, mp string) (bm *browseMount, err error) {
+	bm = &browseMount{Mountpoint: mp}
+
+	// Note the directories that need to be made.
+	for dir := mp; dir != b.host.Snapdir && dir != "/"; dir = path.Dir(dir) {
+		if _, serr := os.Stat(dir); serr == nil {
+			break
+		}
+		bm.Dirs = append([]string{dir}, bm.Dirs...)
+	}
+	if len(bm.Dirs) > 0 {
+		err = b.privileged("mkdir", "-p", mp)
+		if err != nil {
+			return
+		}
+	}
+
+	if src.Vol != nil {
+		name := src.Vol.VgName()
+		bm.Source = name.DevName()
+		if !src.Vol.Active() {
+			err = b.activate(name)
+			if err != nil {
+				return
+			}
+			bm.Activated = name.TextName()
+		}
+		err = b.mount(name, mp, false)
+	} else {
+		bm.Source = src.Dir
+		err = b.privileged("mount", "-o", "bind,ro", src.Dir, mp)
+	}
+	return
+}
+
+func (b *Backup) UmountCmd(args ...string) (err error) {
+	if len(args) != 0 {
+		err = errors.New("'umount' command not expecting additional arguments")
+		return
+	}
+
+	var state []*browseMount
+	err = b.loadState(browseState, &state)
+	if err != nil {
+		return
+	}
+
+	mounts, err := GetMounts()
+	if err != nil {
+		return
+	}
+
+	// Undo in reverse, keeping anything that couldn't be undone.
+	failed := make([]*browseMount, 0)
+	dirs := make([]string, 0)
+	for i := len(state) - 1; i >= 0; i-- {
+		bm := state[i]
+
+		if isMounted(mounts, bm.Mountpoint) {
+			uerr := b.umountDir(bm.Mountpoint)
+			if uerr != nil {
+				runLog().Error("Unable to unmount", "mountpoint", bm.Mountpoint, "error", uerr)
+				failed = append([]*browseMount{bm}, failed...)
+				continue
+			}
+			runLog().Info("Unmounted", "mountpoint", bm.Mountpoint)
+		}
+
+		if bm.Activated != "" {
+			vg, lv, _ := strings.Cut(bm.Activated, "/")
+			derr := b.deactivate(VgName{VG: vg, LV: lv})
+			if derr != nil {
+				runLog().Error("Unable to deactivate", "volume", bm.Activated, "error", derr)
+			}
+		}
+
+		dirs = append(dirs, bm.Dirs...)
+	}
+
+	// Innermost directories first.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		rerr := b.privileged("rmdir", dir)
+		if rerr != nil {
+			runLog().Warn("Unable to remove directory", "dir", dir, "error", rerr)
+		}
+	}
+
+	err = b.saveState(browseState, failed)
+	if err == nil && len(failed) > 0 {
+		err = errors.New(fmt.Sprintf("%d mounts could not be undone", len(failed)))
+	}
+	return
+}
+
+// Find the filesystem with the given name.
+func (b *Backup) lookupFs(name string) (fs *FsInfo, err error) {
+	for _, f := range b.host.Filesystems {
+		if f.Lvname == name {
+			fs = f
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("Unknown filesystem %q", name))
+	return
+}
+
+// Find where to mount a dated copy of a filesystem from.  The local
+// snapshot is preferred, then the mirrors in the order configured.
+// If from is given, only that mirror is considered.
+func (b *Backup) browseSource(fs *FsInfo, date, from string) (src browseSource, ok bool) {
+	lv := fs.Lvname + "." + date
+
+	if from == "" {
+		if fs.Subvolume() {
+			dir := path.Join(fs.SnapshotDir(), lv)
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return browseSource{Dir: dir, From: "local"}, true
+			}
+		} else if vol, present := b.lvm.ByName[VgName{VG: fs.Volgroup, LV: lv}]; present {
+			return browseSource{Vol: vol, From: "local"}, true
+		}
+	}
+
+	for _, gm := range b.host.Mirrors {
+		if from != "" && gm["name"] != from {
+			continue
+		}
+		m, err := gm.GetMirror()
+		if err != nil {
+			continue
+		}
+
+		switch m := m.(type) {
+		case *lvmMirror:
+			vol, present := b.lvm.ByName[VgName{VG: m.VgName, LV: m.Prefix + lv}]
+			if present {
+				return browseSource{Vol: vol, From: gm["name"]}, true
+			}
+		case *btrMirror, *btrSendMirror, *dirMirror:
+			dir := path.Join(browsePrefix(m), lv)
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return browseSource{Dir: dir, From: gm["name"]}, true
+			}
+		case *zfsMirror:
+			mount, err := m.mountpoint()
+			if err != nil {
+				continue
+			}
+			dir := path.Join(mount, ".zfs/snapshot", lv, fs.Lvname)
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return browseSource{Dir: dir, From: gm["name"]}, true
+			}
+		}
+	}
+
+	return
+}
+
+// Make the files of a dated copy available, mounting it at dir if it
+// is a volume.  The release function, which must be called even if
+// there is an error, undoes whatever was done.
+func (b *Backup) mountCopy(src browseSource, dir string) (root string, release func(), err error) {
+	var steps []func()
+	release = func() {
+		for i := len(steps) - 1; i >= 0; i-- {
+			steps[i]()
+		}
+	}
+
+	if src.Vol == nil {
+		root = src.Dir
+		return
+	}
+
+	name := src.Vol.VgName()
+	if !src.Vol.Active() {
+		err = b.activate(name)
+		if err != nil {
+			return
+		}
+		steps = append(steps, b.deactivateLater(name))
+	}
+
+	err = b.mount(name, dir, false)
+	if err != nil {
+		return
+	}
+	steps = append(steps, b.umountLater(name))
+
+	root = dir
+	return
+}
+
+// The directory btrfs and dir mirror copies are kept in.
+func browsePrefix(m Mirror) string {
+	switch m := m.(type) {
+	case *btrMirror:
+		return m.Prefix
+	case *btrSendMirror:
+		return m.local.Prefix
+	case *dirMirror:
+		return m.Prefix
+	}
+	return ""
+}
+
+// All of the dates of a filesystem that can be mounted, oldest first.
+func (b *Backup) browseDates(fs *FsInfo) (dates []string) {
+	re := fs.MatchRe()
+	seen := make(map[string]bool)
+	add := func(lv string) {
+		if !re.MatchString(lv) || undate(lv) == lv {
+			return
+		}
+		date := lv[len(undate(lv))+1:]
+		if !seen[date] {
+			seen[date] = true
+			dates = append(dates, date)
+		}
+	}
+
+	if fs.Subvolume() {
+		for _, name := range subvolSnapshots(fs) {
+			add(name)
+		}
+	} else {
+		for _, vol := range b.lvm.Volumes {
+			if vol.VG == fs.Volgroup {
+				add(vol.LV)
+			}
+		}
+	}
+
+	for _, gm := range b.host.Mirrors {
+		m, err := gm.GetMirror()
+		if err != nil {
+			continue
+		}
+
+		switch m := m.(type) {
+		case *lvmMirror:
+			for _, vol := range b.lvm.Volumes {
+				if vol.VG == m.VgName && strings.HasPrefix(vol.LV, m.Prefix) {
+					add(vol.LV[len(m.Prefix):])
+				}
+			}
+		case *btrMirror, *btrSendMirror, *dirMirror:
+			names, err := scanNames(browsePrefix(m))
+			if err != nil {
+				continue
+			}
+			for n := range names {
+				add(n)
+			}
+		}
+	}
+
+	sort.Strings(dates)
+	return
+}
+
+// Run a simple command with privileges.
+func (b *Backup) privileged(name string, args ...string) (err error) {
+	sudo.Setup(runCtx)
+
+	cmd := exec.Command(name, args...)
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	err = runCommand(cmd)
+	return
+}
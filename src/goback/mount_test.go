@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMountUmount(t *testing.T) {
+	b := fakeBackup("home", "home.2013.06.01")
+	dir := t.TempDir()
+	b.host.Snapdir = path.Join(dir, "snap")
+	b.host.Statedir = path.Join(dir, "state")
+	os.Mkdir(b.host.Snapdir, 0755)
+
+	oldInfo := mountinfoPath
+	mountinfoPath = path.Join(dir, "mountinfo")
+	defer func() { mountinfoPath = oldInfo }()
+	os.WriteFile(mountinfoPath, nil, 0644)
+
+	mp := path.Join(b.host.Snapdir, "browse/2013.06.01/home")
+
+	fake := &fakeRunner{}
+	var err error
+	withFakeRunner(fake, func() {
+		err = b.MountCmd("home", "2013.06.01")
+	})
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+
+	ran := strings.Join(fake.ran, "\n")
+	for _, w := range []string{
+		"lvchange -ay -K /dev/mapper/vg-home.2013.06.01",
+		"mkdir -p " + mp,
+		"mount -r /dev/mapper/vg-home.2013.06.01 " + mp,
+	} {
+		if !strings.Contains(ran, w) {
+			t.Errorf("mount: missing command %q in\n%s", w, ran)
+		}
+	}
+
+	err = b.MountCmd("home", "2013.06.02")
+	if err == nil {
+		t.Errorf("Mounted a date with no copy")
+	}
+
+	// Pretend the mount happened.
+	line := fmt.Sprintf("40 1 8:1 / %s ro - ext4 /dev/mapper/vg-home.2013.06.01 ro\n", mp)
+	os.WriteFile(mountinfoPath, []byte(line), 0644)
+
+	fake = &fakeRunner{}
+	withFakeRunner(fake, func() {
+		err = b.UmountCmd()
+	})
+	if err != nil {
+		t.Fatalf("umount: %s", err)
+	}
+
+	want := []string{
+		"umount " + mp,
+		"lvchange -an /dev/mapper/vg-home.2013.06.01",
+		"rmdir " + mp,
+		"rmdir " + path.Dir(mp),
+		"rmdir " + path.Dir(path.Dir(mp)),
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("umount ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	var state []*browseMount
+	err = b.loadState(browseState, &state)
+	if err != nil || len(state) != 0 {
+		t.Errorf("State left after umount: %v, %v", state, err)
+	}
+}
+
+func TestDefaultStatedir(t *testing.T) {
+	defer func() { geteuid = os.Geteuid }()
+
+	geteuid = func() int { return 0 }
+	if got := defaultStatedir(); got != "/var/lib/goback" {
+		t.Errorf("Root: %q", got)
+	}
+
+	// Anyone else keeps the state where they can write it.
+	geteuid = func() int { return 1000 }
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_STATE_HOME", "")
+	if got := defaultStatedir(); got != path.Join(home, ".local/state/goback") {
+		t.Errorf("Home: %q", got)
+	}
+
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	b := fakeBackup()
+	err := b.saveState(browseState, []*browseMount{{Mountpoint: "/snap/browse/home"}})
+	if err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	if _, err = os.Stat(path.Join(state, "goback", browseState)); err != nil {
+		t.Errorf("Not in the user's state directory: %s", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A single mount, as described by a line of /proc/self/mountinfo.
+type MountEntry struct {
+	ID         int
+	Parent     int
+	Root       string
+	Mountpoint string
+	Fstype     string
+	Source     string
+}
+
+var mountinfoPath = "/proc/self/mountinfo"
+
+// Read the current mount table.  Entries are returned in the order
+// the kernel lists them, which is the order they were mounted.
+func GetMounts() (mounts []*MountEntry, err error) {
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	mounts = make([]*MountEntry, 0)
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		var ent *MountEntry
+		ent, err = parseMountinfo(scan.Text())
+		if err != nil {
+			return
+		}
+		mounts = append(mounts, ent)
+	}
+	err = scan.Err()
+
+	return
+}
+
+// Decode a single mountinfo line.  The format is described in
+// proc(5): a fixed set of fields, a variable number of optional
+// fields terminated by a lone "-", then the fstype and source.
+func parseMountinfo(line string) (ent *MountEntry, err error) {
+	fields := strings.Fields(line)
+
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || sep+2 >= len(fields) {
+		err = errors.New(fmt.Sprintf("Invalid mountinfo line: %q", line))
+		return
+	}
+
+	var result MountEntry
+
+	result.ID, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	result.Parent, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	result.Root = unescapeMount(fields[3])
+	result.Mountpoint = unescapeMount(fields[4])
+	result.Fstype = fields[sep+1]
+	result.Source = unescapeMount(fields[sep+2])
+
+	ent = &result
+	return
+}
+
+// The kernel escapes space, tab, newline and backslash in mountinfo
+// paths as a backslash followed by three octal digits.
+func unescapeMount(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+3 < len(text) {
+			n, err := strconv.ParseUint(text[i+1:i+4], 8, 8)
+			if err == nil {
+				buf.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(text[i])
+	}
+	return buf.String()
+}
+
+// Is this directory currently a mountpoint?
+func isMounted(mounts []*MountEntry, dir string) bool {
+	for _, m := range mounts {
+		if m.Mountpoint == dir {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseMountinfo(t *testing.T) {
+	line := `36 25 0:32 / /mnt/snap\040dir rw,noatime shared:1 master:2 - ext4 /dev/mapper/vg-home\134x rw`
+	ent, err := parseMountinfo(line)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	want := MountEntry{
+		ID:         36,
+		Parent:     25,
+		Root:       "/",
+		Mountpoint: "/mnt/snap dir",
+		Fstype:     "ext4",
+		Source:     `/dev/mapper/vg-home\x`,
+	}
+	if *ent != want {
+		t.Errorf("Got %+v, want %+v", *ent, want)
+	}
+
+	// No optional fields at all.
+	ent, err = parseMountinfo("22 1 8:1 /sub / rw - xfs /dev/sda1 rw")
+	if err != nil || ent.Root != "/sub" || ent.Fstype != "xfs" || ent.Source != "/dev/sda1" {
+		t.Errorf("Got %+v, %v", ent, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"22 1 8:1 / / rw xfs /dev/sda1 rw",
+		"22 1 8:1 / / rw - xfs",
+		"x 1 8:1 / / rw - xfs /dev/sda1 rw",
+		"22 y 8:1 / / rw - xfs /dev/sda1 rw",
+	} {
+		if _, err = parseMountinfo(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	for _, c := range []struct{ in, out string }{
+		{"/plain", "/plain"},
+		{`/a\040b`, "/a b"},
+		{`/a\011b\012c`, "/a\tb\nc"},
+		{`/back\134slash`, `/back\slash`},
+		{`/end\040`, "/end "},
+		// Not an escape, so left alone.
+		{`/a\9b`, `/a\9b`},
+		{`/short\04`, `/short\04`},
+		{`/trailing\`, `/trailing\`},
+	} {
+		if got := unescapeMount(c.in); got != c.out {
+			t.Errorf("unescapeMount(%q) = %q, want %q", c.in, got, c.out)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// Notifiers send the report of a run somewhere someone will see it.
+// Like mirrors, they are configured as a general mapping of keys to
+// values, selected by the "style" key:
+//
+//	style = "sendmail"  to = "root"  [sendmail = "/usr/sbin/sendmail"]
+//	style = "webhook"   url = "https://..."
+//	style = "file"      dir = "/var/spool/goback"
+//
+// Each also accepts a "when" key, either "always" (the default) or
+// "failure".
+type GeneralNotifier map[string]string
+
+type Notifier interface {
+	Notify(r *Report) (err error)
+}
+
+func (n GeneralNotifier) GetNotifier() (result Notifier, err error) {
+	switch n["style"] {
+	case "sendmail":
+		to, ok := n["to"]
+		if !ok {
+			return nil, notifyExpecting(n["style"], "to")
+		}
+		prog, ok := n["sendmail"]
+		if !ok {
+			prog = "/usr/sbin/sendmail"
+		}
+		return &mailNotifier{To: to, Sendmail: prog}, nil
+
+	case "webhook":
+		url, ok := n["url"]
+		if !ok {
+			return nil, notifyExpecting(n["style"], "url")
+		}
+		return &webhookNotifier{URL: url}, nil
+
+	case "file":
+		dir, ok := n["dir"]
+		if !ok {
+			return nil, notifyExpecting(n["style"], "dir")
+		}
+		return &fileNotifier{Dir: dir}, nil
+
+	default:
+		msg := fmt.Sprintf("Unknown notifier style: %q", n["style"])
+		err = errors.New(msg)
+		return
+	}
+}
+
+func notifyExpecting(style, key string) error {
+	msg := fmt.Sprintf("Notifier configuration for %q needs %q key", style, key)
+	return errors.New(msg)
+}
+
+// Send the report through every configured notifier.  Failures are
+// logged, and don't affect the result of the run.
+func (b *Backup) notify() {
+	r := b.report
+	if r == nil {
+		return
+	}
+
+	for _, gn := range b.host.Notify {
+		if gn["when"] == "failure" && !r.Failed() {
+			continue
+		}
+
+		n, err := gn.GetNotifier()
+		if err == nil {
+			err = n.Notify(r)
+		}
+		if err != nil {
+			runLog().Error("Unable to send notification", "notifier", gn["style"], "error", err)
+		}
+	}
+}
+
+// Send mail through a local sendmail binary.  These are run directly
+// rather than through runCommand, since notification still needs to
+// happen after the run has been aborted.
+type mailNotifier struct {
+	To       string
+	Sendmail string
+}
+
+func (n *mailNotifier) Notify(r *Report) (err error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "To: %s\n", n.To)
+	fmt.Fprintf(&msg, "Subject: %s\n", r.Subject())
+	fmt.Fprintf(&msg, "\n%s", r.Text())
+
+	cmd := exec.Command(n.Sendmail, "-t")
+	cmd.Stdin = &msg
+	showCommand(cmd)
+	err = cmd.Run()
+	return
+}
+
+// POST the report, as JSON, to a URL.
+type webhookNotifier struct {
+	URL string
+}
+
+func (n *webhookNotifier) Notify(r *Report) (err error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = errors.New(fmt.Sprintf("Webhook returned %s", resp.Status))
+	}
+	return
+}
+
+// Drop the report, as JSON, into a directory.
+type fileNotifier struct {
+	Dir string
+}
+
+func (n *fileNotifier) Notify(r *Report) (err error) {
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return
+	}
+
+	name := fmt.Sprintf("goback-%s-%s-%s.json", r.Host,
+		strings.Replace(r.Command, "/", "_", -1),
+		r.Start.Format("20060102-150405"))
+	name = path.Join(n.Dir, name)
+
+	// Write to a temp name first so that anything watching the
+	// directory never sees a partial report.
+	tmp := path.Join(n.Dir, "."+path.Base(name)+".tmp")
+	err = os.WriteFile(tmp, append(body, '\n'), 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, name)
+	return
+}
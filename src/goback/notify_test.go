@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestGetNotifier(t *testing.T) {
+	for _, gn := range []GeneralNotifier{
+		{"style": "sendmail"},
+		{"style": "webhook"},
+		{"style": "file"},
+		{"style": "pigeon"},
+	} {
+		if _, err := gn.GetNotifier(); err == nil {
+			t.Errorf("%v: expected an error", gn)
+		}
+	}
+
+	n, err := GeneralNotifier{"style": "sendmail", "to": "root"}.GetNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := n.(*mailNotifier); m.To != "root" || m.Sendmail != "/usr/sbin/sendmail" {
+		t.Errorf("Got %+v", m)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir := t.TempDir()
+
+	// A sendmail that keeps the message it is given.
+	mailed := path.Join(dir, "mailed")
+	sendmail := path.Join(dir, "sendmail")
+	err := os.WriteFile(sendmail, []byte("#!/bin/sh\ncat > "+mailed+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var posted []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	spool := path.Join(dir, "spool")
+	os.Mkdir(spool, 0755)
+
+	b := &Backup{
+		host: &Host{Notify: []GeneralNotifier{
+			{"style": "sendmail", "to": "root", "sendmail": sendmail, "when": "failure"},
+			{"style": "webhook", "url": server.URL},
+			{"style": "file", "dir": spool},
+		}},
+		report: newReport("host", "snap"),
+	}
+
+	// Only the failure notifier is skipped on success.
+	b.report.Finish(nil, nil)
+	b.notify()
+	if _, err = os.Stat(mailed); err == nil {
+		t.Errorf("Mailed on success")
+	}
+	var r Report
+	if err = json.Unmarshal(posted, &r); err != nil || r.Status != "succeeded" {
+		t.Errorf("Posted %q: %v", posted, err)
+	}
+	names, _ := os.ReadDir(spool)
+	if len(names) != 1 || !strings.HasPrefix(names[0].Name(), "goback-host-snap-") {
+		t.Fatalf("Spool has %v", names)
+	}
+	text, _ := os.ReadFile(path.Join(spool, names[0].Name()))
+	if err = json.Unmarshal(text, &r); err != nil || r.Command != "snap" {
+		t.Errorf("Spooled %q: %v", text, err)
+	}
+
+	b.report = newReport("host", "snap")
+	b.report.Finish(errors.New("lvcreate failed"), nil)
+	b.notify()
+	text, err = os.ReadFile(mailed)
+	if err != nil {
+		t.Fatalf("Not mailed: %s", err)
+	}
+	for _, w := range []string{"To: root\n", "Subject: goback snap on host failed\n", "lvcreate failed"} {
+		if !strings.Contains(string(text), w) {
+			t.Errorf("Mail missing %q:\n%s", w, text)
+		}
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := (&webhookNotifier{URL: server.URL}).Notify(newReport("host", "snap"))
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A summary of a single run of goback, sent to the configured
+// notifiers when the run finishes (successfully or not).
+type Report struct {
+	Host      string
+	Command   string
+	Mirror    string `json:",omitempty"`
+	Start     time.Time
+	End       time.Time
+	Duration  time.Duration
+	Status    string
+	Snapshots []*SnapReport `json:",omitempty"`
+	Pushes    []*PushReport `json:",omitempty"`
+	Errors    []string      `json:",omitempty"`
+}
+
+// A single filesystem that was snapshotted.
+type SnapReport struct {
+	Filesystem string
+	Volume     string
+	Size       string
+	Changes    int
+	Duration   time.Duration
+}
+
+// A single volume pushed to a mirror.
+type PushReport struct {
+	Volume   string
+	Size     string
+	Created  int
+	Updated  int
+	Deleted  int
+	Bytes    int64
+	Duration time.Duration
+}
+
+func newReport(host, command string) *Report {
+	return &Report{
+		Host:    host,
+		Command: command,
+		Start:   time.Now(),
+		Status:  "running",
+	}
+}
+
+// The report methods can be called on a nil report, for runs that
+// don't generate one.
+
+func (r *Report) AddSnap(snap *SnapReport) {
+	if r == nil {
+		return
+	}
+	r.Snapshots = append(r.Snapshots, snap)
+}
+
+func (r *Report) AddPush(push *PushReport) {
+	if r == nil {
+		return
+	}
+	r.Pushes = append(r.Pushes, push)
+}
+
+func (r *Report) AddError(err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Find the report for a snapshot made in this run.
+func (r *Report) snap(fs *FsInfo) *SnapReport {
+	if r == nil {
+		return nil
+	}
+	for _, s := range r.Snapshots {
+		if s.Filesystem == fs.Lvname {
+			return s
+		}
+	}
+	return nil
+}
+
+// Mark the run as complete.  The signal is non-nil if the run was
+// aborted.
+func (r *Report) Finish(err error, sig os.Signal) {
+	if r == nil {
+		return
+	}
+
+	r.End = time.Now()
+	r.Duration = r.End.Sub(r.Start).Round(time.Second)
+
+	r.AddError(err)
+
+	switch {
+	case sig != nil:
+		r.Status = "aborted by " + sig.String()
+	case len(r.Errors) > 0:
+		r.Status = "failed"
+	default:
+		r.Status = "succeeded"
+	}
+}
+
+func (r *Report) Failed() bool {
+	return r.Status != "succeeded"
+}
+
+// A one line summary of the run, used as the subject for mail.
+func (r *Report) Subject() string {
+	what := r.Command
+	if r.Mirror != "" {
+		what += " " + r.Mirror
+	}
+	return fmt.Sprintf("goback %s on %s %s", what, r.Host, r.Status)
+}
+
+// Format the report as readable text.
+func (r *Report) Text() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s\n\n", r.Subject())
+	fmt.Fprintf(&buf, "Started:  %s\n", r.Start.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&buf, "Duration: %s\n", r.Duration)
+
+	if len(r.Snapshots) > 0 {
+		fmt.Fprintf(&buf, "\nSnapshots:\n")
+		for _, s := range r.Snapshots {
+			fmt.Fprintf(&buf, "  %-20s %8s %6d changes  %s\n",
+				s.Volume, s.Size, s.Changes, s.Duration)
+		}
+	}
+
+	if len(r.Pushes) > 0 {
+		fmt.Fprintf(&buf, "\nPushed to %s:\n", r.Mirror)
+		for _, p := range r.Pushes {
+			fmt.Fprintf(&buf, "  %-20s %8s  +%d ~%d -%d  %s sent  %s\n",
+				p.Volume, p.Size, p.Created, p.Updated, p.Deleted,
+				formatBytes(p.Bytes), p.Duration)
+		}
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(&buf, "\nErrors:\n")
+		for _, e := range r.Errors {
+			fmt.Fprintf(&buf, "  %s\n", strings.TrimSpace(e))
+		}
+	}
+
+	return buf.String()
+}
+
+// The size of a volume, as reported by lvs.
+func (b *Backup) volSize(vol VgName) string {
+	if b.lvm == nil {
+		return ""
+	}
+	info, ok := b.lvm.ByName[vol]
+	if !ok {
+		return ""
+	}
+	return info.Lsize
+}
+
+// Record a volume having been pushed to the current mirror.
+func (b *Backup) pushed(vol VgName, start time.Time) {
+	b.report.AddPush(&PushReport{
+		Volume:   vol.LV,
+		Size:     b.volSize(vol),
+		Created:  b.transfer.Created,
+		Updated:  b.transfer.Updated,
+		Deleted:  b.transfer.Deleted,
+		Bytes:    b.transfer.Sent,
+		Duration: time.Since(start).Round(time.Second),
+	})
+	b.transfer = RsyncStats{}
+}
+
+// A writer that counts the lines written through it.
+type lineCounter struct {
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (n int, err error) {
+	c.lines += bytes.Count(p, []byte{'\n'})
+	return len(p), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	r := newReport("host", "push")
+	r.Mirror = "external"
+	r.AddSnap(&SnapReport{Filesystem: "home", Volume: "home.2013.06.01", Size: "10.00g", Changes: 3})
+	r.AddPush(&PushReport{Volume: "home.2013.06.01", Created: 1, Updated: 2, Deleted: 3, Bytes: 2048})
+	r.AddError(nil)
+
+	r.Finish(nil, nil)
+	if r.Failed() || r.Status != "succeeded" {
+		t.Errorf("Status %q", r.Status)
+	}
+	if r.End.IsZero() || r.End.Before(r.Start) {
+		t.Errorf("End %s, start %s", r.End, r.Start)
+	}
+	if got := r.Subject(); got != "goback push external on host succeeded" {
+		t.Errorf("Subject %q", got)
+	}
+
+	text := r.Text()
+	for _, w := range []string{
+		"Snapshots:\n  home.2013.06.01",
+		"3 changes",
+		"Pushed to external:\n",
+		"+1 ~2 -3",
+	} {
+		if !strings.Contains(text, w) {
+			t.Errorf("Text missing %q:\n%s", w, text)
+		}
+	}
+	if strings.Contains(text, "Errors:") {
+		t.Errorf("Text has errors:\n%s", text)
+	}
+
+	r = newReport("host", "snap")
+	r.AddError(errors.New("rsync failed"))
+	r.Finish(errors.New("snap failed"), nil)
+	if !r.Failed() || r.Status != "failed" || len(r.Errors) != 2 {
+		t.Errorf("Status %q, errors %q", r.Status, r.Errors)
+	}
+	if !strings.Contains(r.Text(), "Errors:\n  rsync failed\n  snap failed\n") {
+		t.Errorf("Text:\n%s", r.Text())
+	}
+
+	r = newReport("host", "snap")
+	r.Finish(nil, syscall.SIGTERM)
+	if !r.Failed() || r.Status != "aborted by terminated" {
+		t.Errorf("Status %q", r.Status)
+	}
+
+	// A nil report ignores everything.
+	var none *Report
+	none.AddSnap(&SnapReport{})
+	none.AddPush(&PushReport{})
+	none.AddError(errors.New("ignored"))
+	none.Finish(nil, nil)
+	if none.snap(&FsInfo{Lvname: "home"}) != nil {
+		t.Errorf("Found a snapshot in a nil report")
+	}
+
+	r = newReport("host", "snap")
+	r.AddSnap(&SnapReport{Filesystem: "home", Duration: time.Second})
+	if s := r.snap(&FsInfo{Lvname: "home"}); s == nil || s.Duration != time.Second {
+		t.Errorf("snap gave %+v", s)
+	}
+	if s := r.snap(&FsInfo{Lvname: "var"}); s != nil {
+		t.Errorf("snap found %+v", s)
+	}
+}
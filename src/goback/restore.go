@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"sudo"
+)
+
+// Restoring files and directories from old snapshots.  A path on one
+// of the backed up filesystems is copied back from a dated copy: the
+// local snapshot, or a mirror, which is either mounted and copied
+// from with the native sync engine, or for archive mirrors, extracted
+// from.  Ownership, permissions, extended attributes and hardlinks
+// are all kept.
+
+func (b *Backup) RestoreCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	date := flags.String("date", "", "date of the copy to restore from, yyyy.mm.dd")
+	from := flags.String("from", "", "mirror to restore from, instead of the local snapshot")
+	to := flags.String("to", "", "directory to restore into, instead of the original location")
+	force := flags.Bool("force", false, "overwrite files that already exist")
+
+	args, err = parseInterspersed(flags, args)
+	if err != nil {
+		return
+	}
+
+	if len(args) != 1 || *date == "" {
+		err = errors.New("'restore' command expects a path and --date")
+		return
+	}
+	if !browseDateRe.MatchString(*date) {
+		err = errors.New(fmt.Sprintf("Invalid date %q, expecting yyyy.mm.dd", *date))
+		return
+	}
+
+	target := path.Clean(args[0])
+	if !path.IsAbs(target) {
+		err = errors.New(fmt.Sprintf("Path to restore %q must be absolute", args[0]))
+		return
+	}
+
+	fs, rel, err := b.fsForPath(target)
+	if err != nil {
+		return
+	}
+
+	dest := target
+	if *to != "" {
+		base := path.Base(target)
+		if rel == "" {
+			base = fs.Lvname
+		}
+		dest = path.Join(*to, base)
+	}
+
+	exists, err := fileExists(dest)
+	if err != nil {
+		return
+	}
+	if exists && !*force {
+		err = errors.New(fmt.Sprintf("%q already exists, use --force to overwrite it", dest))
+		return
+	}
+
+	defer logWith("filesystem", fs.Lvname, "date", *date)()
+	runLog().Info("Restoring", "path", target, "dest", dest)
+
+	printer := &restorePrinter{dest: dest}
+
+	if *from != "" {
+		info := b.host.LookupMirror(*from)
+		if info == nil {
+			err = errors.New(fmt.Sprintf("No mirror named %q", *from))
+			return
+		}
+		var m Mirror
+		m, err = info.GetMirror()
+		if err != nil {
+			return
+		}
+
+		switch m := m.(type) {
+		case *tarMirror:
+			err = b.restoreTar(m, fs, *date, rel, dest, printer)
+			return
+		case *chunkMirror:
+			err = b.restoreChunk(m, fs, *date, rel, dest, printer)
+			return
+		}
+	}
+
+	src, ok := b.browseSource(fs, *date, *from)
+	if !ok {
+		err = errors.New(fmt.Sprintf("No copy of %s from %s", fs.Lvname, *date))
+		return
+	}
+
+	err = b.restoreCopy(src, rel, dest, printer)
+	if err == nil {
+		runLog().Info("Restored", "from", src.From, "items", printer.count)
+	}
+	return
+}
+
+// Find the filesystem a path is on, from the longest Mount containing
+// it, and the path within that filesystem.
+func (b *Backup) fsForPath(p string) (fs *FsInfo, rel string, err error) {
+	for _, f := range b.host.Filesystems {
+		mount := path.Clean(f.Mount)
+		var r string
+		switch {
+		case p == mount:
+			r = ""
+		case mount == "/":
+			r = p[1:]
+		case strings.HasPrefix(p, mount+"/"):
+			r = p[len(mount)+1:]
+		default:
+			continue
+		}
+		if fs == nil || len(mount) > len(path.Clean(fs.Mount)) {
+			fs, rel = f, r
+		}
+	}
+
+	if fs == nil {
+		err = errors.New(fmt.Sprintf("%q is not on a filesystem that is backed up", p))
+	}
+	return
+}
+
+// Restore by copying from a mounted copy.
+func (b *Backup) restoreCopy(src browseSource, rel, dest string, printer io.Writer) (err error) {
+	root, release, err := b.mountCopy(src, "/mnt/old")
+	defer release()
+	if err != nil {
+		return
+	}
+
+	sudo.Setup(runCtx)
+
+	cmd, err := selfCommand("tsync", "-delete=false", path.Join(root, rel), dest)
+	if err != nil {
+		return
+	}
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stdout = printer
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+	err = runCommand(cmd)
+	return
+}
+
+// Restore from the archives of a tar mirror.  Unchanged files in an
+// incremental are found in the earlier archives its manifest names,
+// which are extracted first.
+func (b *Backup) restoreTar(m *tarMirror, fs *FsInfo, date, rel, dest string, printer *restorePrinter) (err error) {
+	m.backup = b
+	m.names, err = scanNames(m.Dir)
+	if err != nil {
+		return
+	}
+
+	lv := fs.Lvname + "." + date
+	if !m.names[path.Base(m.archiveName(lv))] {
+		err = errors.New(fmt.Sprintf("No archive of %s from %s", fs.Lvname, date))
+		return
+	}
+
+	man, err := m.readManifest(lv)
+	if err != nil {
+		return
+	}
+
+	work, err := os.MkdirTemp("", "goback-restore")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(work)
+	plain := path.Join(work, "manifest")
+	err = writeManifest(plain, man)
+	if err != nil {
+		return
+	}
+
+	x := &extractor{Prefix: rel, Dest: dest}
+	x.plan(man.Entries)
+	needed := make(map[string]bool)
+	found := false
+	for _, e := range man.Entries {
+		if _, ok := x.target(e.Path); !ok {
+			continue
+		}
+		found = true
+		if e.Archive != "" && e.Archive != lv {
+			needed[e.Archive] = true
+		}
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("%q is not in archive %s", rel, lv))
+		return
+	}
+	archives := make([]string, 0, len(needed)+1)
+	for a := range needed {
+		archives = append(archives, a)
+	}
+	sort.Strings(archives)
+	archives = append(archives, lv)
+
+	sudo.Setup(runCtx)
+
+	for _, a := range archives {
+		var file *os.File
+		file, err = os.Open(m.archiveName(a))
+		if err != nil {
+			return
+		}
+
+		var cmds []*exec.Cmd
+		cmds = addStage(cmds, m.Crypt.decryptCommand())
+
+		decompress := exec.Command("zstd", "-q", "-d", "-c")
+		decompress.Stderr = os.Stderr
+		showCommand(decompress)
+		cmds = append(cmds, decompress)
+
+		var extract *exec.Cmd
+		extract, err = selfCommand("tar-extract", "-manifest", plain,
+			"-name", a, "-prefix", rel, dest)
+		if err != nil {
+			file.Close()
+			return
+		}
+		extract = sudo.Sudoify(extract)
+		extract.Stdout = printer
+		extract.Stderr = os.Stderr
+		showCommand(extract)
+		cmds = append(cmds, extract)
+
+		cmds[0].Stdin = file
+		_, err = runPipeline(cmds...)
+		file.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	runLog().Info("Restored", "archives", len(archives), "items", printer.count)
+	return
+}
+
+// Restore from a chunk store snapshot.
+func (b *Backup) restoreChunk(m *chunkMirror, fs *FsInfo, date, rel, dest string, printer *restorePrinter) (err error) {
+	sudo.Setup(runCtx)
+
+	cmd, err := selfCommand("chunk-restore", "-repo", m.Repo,
+		"-name", fs.Lvname+"."+date, "-prefix", rel, dest)
+	if err != nil {
+		return
+	}
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stdout = printer
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+	err = runCommand(cmd)
+	if err == nil {
+		runLog().Info("Restored", "items", printer.count)
+	}
+	return
+}
+
+// Parse flags that may be mixed in with the other arguments, returning
+// the other arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) (rest []string, err error) {
+	for {
+		err = flags.Parse(args)
+		if err != nil {
+			return
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// Takes the itemized output of a restore, and prints the full path of
+// each item restored.
+type restorePrinter struct {
+	dest  string
+	buf   []byte
+	count int
+}
+
+func (p *restorePrinter) Write(data []byte) (n int, err error) {
+	p.buf = append(p.buf, data...)
+	for {
+		pos := bytes.IndexByte(p.buf, '\n')
+		if pos < 0 {
+			break
+		}
+		p.line(string(p.buf[:pos]))
+		p.buf = p.buf[pos+1:]
+	}
+	return len(data), nil
+}
+
+func (p *restorePrinter) line(line string) {
+	// Itemized lines are 11 flag characters, a space, and the name.
+	if len(line) < 13 || line[11] != ' ' || strings.HasPrefix(line, "*deleting") {
+		return
+	}
+
+	name := line[12:]
+	switch {
+	case line[1] == 'L':
+		name, _, _ = strings.Cut(name, " -> ")
+	case line[0] == 'h':
+		name, _, _ = strings.Cut(name, " => ")
+	}
+	name = strings.TrimSuffix(name, "/")
+
+	full := p.dest
+	if name != "." && name != "" {
+		full = path.Join(p.dest, name)
+	}
+	fmt.Println(full)
+	p.count++
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFsForPath(t *testing.T) {
+	b := fakeBackup()
+	b.host.Filesystems = append(b.host.Filesystems,
+		&FsInfo{Volgroup: "vg", Lvname: "root", Mount: "/"},
+		&FsInfo{Volgroup: "vg", Lvname: "data", Mount: "/home/data"})
+
+	for _, c := range []struct{ path, lv, rel string }{
+		{"/home", "home", ""},
+		{"/home/user/file", "home", "user/file"},
+		{"/home/database", "home", "database"},
+		{"/home/data/x", "data", "x"},
+		{"/etc/passwd", "root", "etc/passwd"},
+		{"/", "root", ""},
+	} {
+		fs, rel, err := b.fsForPath(c.path)
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+			continue
+		}
+		if fs.Lvname != c.lv || rel != c.rel {
+			t.Errorf("%s: got %s %q, want %s %q", c.path, fs.Lvname, rel, c.lv, c.rel)
+		}
+	}
+}
+
+func TestRestoreLocal(t *testing.T) {
+	b := fakeBackup("home", "home.2013.06.01")
+	to := t.TempDir()
+
+	fake := &fakeRunner{}
+	var err error
+	withFakeRunner(fake, func() {
+		err = b.RestoreCmd("/home/user/notes", "--date", "2013.06.01", "--to", to)
+	})
+	if err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+
+	ran := strings.Join(fake.ran, "\n")
+	for _, w := range []string{
+		"lvchange -ay -K /dev/mapper/vg-home.2013.06.01",
+		"mount -r /dev/mapper/vg-home.2013.06.01 /mnt/old",
+		"tsync -delete=false /mnt/old/user/notes " + path.Join(to, "notes"),
+		"umount /dev/mapper/vg-home.2013.06.01",
+		"lvchange -an /dev/mapper/vg-home.2013.06.01",
+	} {
+		if !strings.Contains(ran, w) {
+			t.Errorf("restore: missing command %q in\n%s", w, ran)
+		}
+	}
+
+	// Restoring over something requires --force.
+	os.Mkdir(path.Join(to, "notes"), 0755)
+	withFakeRunner(&fakeRunner{}, func() {
+		err = b.RestoreCmd("/home/user/notes", "--date", "2013.06.01", "--to", to)
+	})
+	if err == nil {
+		t.Errorf("Restored over an existing file without --force")
+	}
+
+	withFakeRunner(&fakeRunner{}, func() {
+		err = b.RestoreCmd("/home/user/notes", "--date", "2013.06.02", "--to", to, "--force")
+	})
+	if err == nil {
+		t.Errorf("Restored from a date with no copy")
+	}
+}
+
+func TestRestorePrinter(t *testing.T) {
+	p := &restorePrinter{dest: "/home/user"}
+	p.Write([]byte("cd+++++++++ ./\n>f+++++++++ a\ncL+++++++++ b -> a\nhf+++"))
+	p.Write([]byte("++++++ c => a\n\nNumber of files: 3\n"))
+	if p.count != 4 {
+		t.Errorf("Printed %d items, want 4", p.count)
+	}
+}
+
+func TestRestoreTar(t *testing.T) {
+	b := fakeBackup("home")
+	dir := t.TempDir()
+	b.host.Mirrors = []GeneralMirror{{"name": "usb", "style": "tar", "dir": dir}}
+
+	// An incremental, with its unchanged file in the earlier archive.
+	for _, n := range []string{"home.2013.06.01", "home.2013.06.02"} {
+		os.WriteFile(path.Join(dir, n+tarSuffix), nil, 0644)
+	}
+	err := writeManifest(path.Join(dir, "home.2013.06.02"+manifestSuffix), &Manifest{
+		Header: ManifestHeader{Name: "home.2013.06.02", Parent: "home.2013.06.01"},
+		Entries: []*ManifestEntry{
+			{Path: ".", Type: "d"},
+			{Path: "user", Type: "d"},
+			{Path: "user/notes", Type: "f", Archive: "home.2013.06.01"},
+			{Path: "user/new", Type: "f"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := t.TempDir()
+	fake := &fakeRunner{}
+	withFakeRunner(fake, func() {
+		err = b.RestoreCmd("/home/user", "--date", "2013.06.02", "--from", "usb", "--to", to)
+	})
+	if err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+
+	var extracts []string
+	for _, r := range fake.ran {
+		if strings.Contains(r, "tar-extract") {
+			_, after, _ := strings.Cut(r, "-name ")
+			extracts = append(extracts, strings.Fields(after)[0])
+		}
+	}
+	if strings.Join(extracts, " ") != "home.2013.06.01 home.2013.06.02" {
+		t.Errorf("Extracted %q", extracts)
+	}
+
+	// Something that isn't there is an error, not an empty restore.
+	fake = &fakeRunner{}
+	withFakeRunner(fake, func() {
+		err = b.RestoreCmd("/home/missing", "--date", "2013.06.02", "--from", "usb", "--to", to)
+	})
+	if err == nil || !strings.Contains(err.Error(), "is not in archive") {
+		t.Errorf("Restored a missing path: %v", err)
+	}
+	for _, r := range fake.ran {
+		if strings.Contains(r, "tar-extract") {
+			t.Errorf("Extracted a missing path: %s", r)
+		}
+	}
+}
+
+func TestExtractHardlinks(t *testing.T) {
+	dest := path.Join(t.TempDir(), "user")
+	x := &extractor{Prefix: "user", Dest: dest}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	entries := []*ManifestEntry{
+		{Path: "other", Type: "d", Mode: 0755, Uid: uid, Gid: gid},
+		// The first link is outside what is being restored.
+		{Path: "other/a", Type: "f", Mode: 0644, Uid: uid, Gid: gid},
+		{Path: "user", Type: "d", Mode: 0755, Uid: uid, Gid: gid},
+		{Path: "user/b", Type: "h", Link: "other/a"},
+		{Path: "user/c", Type: "h", Link: "other/a"},
+		{Path: "user/d", Type: "f", Mode: 0600, Uid: uid, Gid: gid},
+		{Path: "user/e", Type: "h", Link: "user/d"},
+	}
+	x.plan(entries)
+
+	for _, e := range entries {
+		var data io.Reader
+		if e.Type == "f" {
+			data = strings.NewReader("contents of " + e.Path)
+		}
+		err := x.create(e, data, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", e.Path, err)
+		}
+	}
+	if err := x.finish(); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+
+	text, err := os.ReadFile(path.Join(dest, "b"))
+	if err != nil || string(text) != "contents of other/a" {
+		t.Errorf("b has %q, %v", text, err)
+	}
+	if _, err = os.Lstat(path.Join(path.Dir(dest), "other")); err == nil {
+		t.Errorf("Restored outside of the prefix")
+	}
+
+	for _, pair := range [][2]string{{"b", "c"}, {"d", "e"}} {
+		fa, err1 := os.Stat(path.Join(dest, pair[0]))
+		fb, err2 := os.Stat(path.Join(dest, pair[1]))
+		if err1 != nil || err2 != nil || !os.SameFile(fa, fb) {
+			t.Errorf("%s and %s aren't linked: %v %v", pair[0], pair[1], err1, err2)
+		}
+	}
+	if fi, err := os.Stat(path.Join(dest, "b")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("b: %v %v", fi, err)
+	}
+}
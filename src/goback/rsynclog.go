@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Logs of the rsync runs made while pushing.  The itemized output
+// (-i) of each rsync is written to a log file per mirror and volume,
+// under the host's Rsynclog directory:
+//
+//	<Rsynclog>/<mirror>/<volume>.log
+//
+// Since the volume names carry the date of the snapshot, there is one
+// log per pushed date.  The output is also parsed into a count of
+// the changes made.
+
+// Statistics gathered from the output of 'rsync -i --stats'.
+type RsyncStats struct {
+	Created int
+	Updated int
+	Deleted int
+	Sent    int64
+
+	partial []byte
+}
+
+var rsyncSentRe = regexp.MustCompile(`^Total bytes sent: ([\d,]+)`)
+
+// An itemized change line: the update type, the file type, then the
+// attribute flags.  See the --itemize-changes section of rsync(1).
+var rsyncItemRe = regexp.MustCompile(`^([<>ch.])([fdLDS])([.+ ?a-zA-Z]{9}) `)
+
+func (s *RsyncStats) Write(p []byte) (n int, err error) {
+	s.partial = append(s.partial, p...)
+	for {
+		pos := bytes.IndexByte(s.partial, '\n')
+		if pos < 0 {
+			break
+		}
+		s.parseLine(string(s.partial[:pos]))
+		s.partial = s.partial[pos+1:]
+	}
+	return len(p), nil
+}
+
+func (s *RsyncStats) parseLine(line string) {
+	if strings.HasPrefix(line, "*deleting ") {
+		s.Deleted++
+		return
+	}
+
+	if m := rsyncSentRe.FindStringSubmatch(line); m != nil {
+		text := strings.Replace(m[1], ",", "", -1)
+		s.Sent, _ = strconv.ParseInt(text, 10, 64)
+		return
+	}
+
+	m := rsyncItemRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	switch {
+	case strings.Trim(m[3], "+") == "":
+		s.Created++
+	case m[1] == "." && strings.Trim(m[3], ". ") == "":
+		// Unchanged, only shown with -ii.
+	default:
+		s.Updated++
+	}
+}
+
+// Accumulate another set of statistics into these.
+func (s *RsyncStats) Add(other *RsyncStats) {
+	s.Created += other.Created
+	s.Updated += other.Updated
+	s.Deleted += other.Deleted
+	s.Sent += other.Sent
+}
+
+func (s *RsyncStats) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d deleted, %s sent",
+		s.Created, s.Updated, s.Deleted, formatBytes(s.Sent))
+}
+
+// The directory holding the rsync logs for a mirror.
+func (b *Backup) rsyncLogDir(mirror string) string {
+	return path.Join(b.host.Rsynclog, mirror)
+}
+
+// Open the log for rsync of a volume to the current mirror.  Returns
+// a nil file if rsync logs aren't configured.
+func (b *Backup) openRsyncLog(vol VgName) (file *os.File, err error) {
+	if b.host.Rsynclog == "" || b.mirror == "" {
+		return
+	}
+
+	dir := b.rsyncLogDir(b.mirror)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	file, err = os.Create(path.Join(dir, vol.LV+".log"))
+	return
+}
+
+// Read back the statistics from a saved rsync log.
+func readRsyncLog(name string) (stats *RsyncStats, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var result RsyncStats
+	_, err = io.Copy(&result, f)
+	if err != nil {
+		return
+	}
+	result.Write([]byte("\n"))
+
+	stats = &result
+	return
+}
+
+// Format a byte count in human units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
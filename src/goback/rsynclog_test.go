@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRsyncStats(t *testing.T) {
+	for _, c := range []struct {
+		line                      string
+		created, updated, deleted int
+		sent                      int64
+	}{
+		{">f+++++++++ home/new.txt", 1, 0, 0, 0},
+		{"cd+++++++++ home/newdir/", 1, 0, 0, 0},
+		{">f.st...... home/changed.txt", 0, 1, 0, 0},
+		{".d..t...... home/", 0, 1, 0, 0},
+		{">f..T...... home/touched.txt", 0, 1, 0, 0},
+		{"*deleting   home/old.txt", 0, 0, 1, 0},
+		{"hf+++++++++ home/link => home/new.txt", 1, 0, 0, 0},
+		{"hf..t...... home/link2 => home/new.txt", 0, 1, 0, 0},
+		{"cL+++++++++ home/sym -> new.txt", 1, 0, 0, 0},
+		{"cL..T...... home/sym -> other.txt", 0, 1, 0, 0},
+		{"cS+++++++++ home/socket", 1, 0, 0, 0},
+		{".f          home/same.txt", 0, 0, 0, 0},
+		{"Total bytes sent: 1,234,567", 0, 0, 0, 1234567},
+		{"Total bytes received: 99", 0, 0, 0, 0},
+		{"Number of files: 10", 0, 0, 0, 0},
+		{"sending incremental file list", 0, 0, 0, 0},
+		{"", 0, 0, 0, 0},
+	} {
+		var s RsyncStats
+		s.parseLine(c.line)
+		if s.Created != c.created || s.Updated != c.updated || s.Deleted != c.deleted || s.Sent != c.sent {
+			t.Errorf("%q: got %s", c.line, &s)
+		}
+	}
+}
+
+func TestRsyncStatsWrite(t *testing.T) {
+	var s RsyncStats
+
+	// Lines split across writes are put back together.
+	for _, p := range []string{">f++++", "+++++ a\n*deleting   b\n>f.s", "....... c\n"} {
+		s.Write([]byte(p))
+	}
+	if s.Created != 1 || s.Deleted != 1 || s.Updated != 1 {
+		t.Errorf("Got %s", &s)
+	}
+
+	var total RsyncStats
+	total.Add(&s)
+	total.Add(&RsyncStats{Created: 2, Sent: 10})
+	if total.Created != 3 || total.Sent != 10 {
+		t.Errorf("Total %s", &total)
+	}
+
+	// A saved log without a final newline.
+	name := path.Join(t.TempDir(), "home.log")
+	os.WriteFile(name, []byte(">f+++++++++ a\nTotal bytes sent: 2,048"), 0644)
+	stats, err := readRsyncLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 1 || stats.Sent != 2048 {
+		t.Errorf("Read %s", stats)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// All of the commands goback runs go through a Runner.  Normally
+// this is an execRunner, which actually runs them, but tests can
+// substitute one that records them instead.
+type Runner interface {
+	// Run a pipeline of commands, the output of each feeding the
+	// input of the next, returning the number of bytes passed
+	// into the last one.
+	Run(cmds ...*exec.Cmd) (moved int64, err error)
+}
+
+var runner Runner = execRunner{}
+
+type execRunner struct{}
+
+// Run a pipeline of commands.  The data passes through this process between each
+// stage, so that it can be counted; the number of bytes passed into
+// the last command is returned.  All of the commands are tracked so
+// that they can be terminated if a signal arrives.
+func (execRunner) Run(cmds ...*exec.Cmd) (moved int64, err error) {
+	t := &teardowns
+
+	// The ends of the pipes given to the children, which are
+	// closed here once they have started, and the ends used by the
+	// copiers.
+	childEnds := make([]*os.File, 0)
+	links := make([][2]*os.File, 0)
+	defer func() {
+		for _, f := range childEnds {
+			f.Close()
+		}
+	}()
+
+	for i := 0; i+1 < len(cmds); i++ {
+		var r1, w1, r2, w2 *os.File
+		r1, w1, err = os.Pipe()
+		if err != nil {
+			return
+		}
+		r2, w2, err = os.Pipe()
+		if err != nil {
+			r1.Close()
+			w1.Close()
+			return
+		}
+		cmds[i].Stdout = w1
+		cmds[i+1].Stdin = r2
+		childEnds = append(childEnds, w1, r2)
+		links = append(links, [2]*os.File{r1, w2})
+	}
+
+	t.lock.Lock()
+	if t.signal != nil && t.releasing == 0 {
+		t.lock.Unlock()
+		err = errAborted
+		closeLinks(links)
+		return
+	}
+	for i, cmd := range cmds {
+		err = cmd.Start()
+		if err != nil {
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+				started.Wait()
+			}
+			t.lock.Unlock()
+			closeLinks(links)
+			return
+		}
+	}
+	t.children = append(t.children, cmds...)
+	t.lock.Unlock()
+
+	for _, f := range childEnds {
+		f.Close()
+	}
+	childEnds = nil
+
+	var copiers sync.WaitGroup
+	for i, link := range links {
+		copiers.Add(1)
+		go func(last bool, r, w *os.File) {
+			n, _ := io.Copy(w, r)
+			r.Close()
+			w.Close()
+			if last {
+				moved = n
+			}
+			copiers.Done()
+		}(i == len(links)-1, link[0], link[1])
+	}
+
+	start := time.Now()
+	for _, cmd := range cmds {
+		werr := cmd.Wait()
+		if err == nil {
+			err = werr
+		}
+
+		duration := time.Since(start).Round(time.Millisecond)
+		status := cmd.ProcessState.ExitCode()
+		if werr != nil {
+			runLog().Warn("Command failed", "exec", strings.Join(cmd.Args, " "),
+				"duration", duration, "status", status)
+		} else {
+			runLog().Debug("Command finished", "exec", cmd.Args[0],
+				"duration", duration, "status", status)
+		}
+	}
+	copiers.Wait()
+
+	// Other pipelines might still be running.
+	t.lock.Lock()
+	children := make([]*exec.Cmd, 0, len(t.children))
+	for _, child := range t.children {
+		mine := false
+		for _, cmd := range cmds {
+			if child == cmd {
+				mine = true
+			}
+		}
+		if !mine {
+			children = append(children, child)
+		}
+	}
+	t.children = children
+	t.lock.Unlock()
+
+	return
+}
+
+func closeLinks(links [][2]*os.File) {
+	for _, link := range links {
+		link[0].Close()
+		link[1].Close()
+	}
+}
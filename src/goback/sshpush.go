@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"sudo"
+)
+
+// An ssh mirror pushes to another host.  Each filesystem is copied
+// with rsync over ssh into an undated base directory under Dir on
+// the remote host, after which a dated snapshot of the base is made
+// there, using one of:
+//
+//	btrfs - the base is a subvolume, snapshotted read-only
+//	lvm   - the base is a mounted LV in Volgroup, snapshotted with lvcreate
+//	cp    - the base is a plain directory, copied with 'cp -al'
+//
+// The dates already present on the remote host are found over the
+// same ssh connection.  Ssh is the command used to reach the host,
+// so a wrapper can be given in place of plain ssh.
+type sshMirror struct {
+	Host     string
+	Dir      string
+	Snapshot string
+	Volgroup string
+	Ssh      string
+	backup   *Backup
+}
+
+func (m *sshMirror) Push(b *Backup) (err error) {
+	m.backup = b
+
+	src, err := m.backup.GetSources()
+	if err != nil {
+		return
+	}
+
+	have, err := m.remoteNames()
+	if err != nil {
+		return
+	}
+
+	sort.Sort(SourceSlice(src))
+
+	for _, vg := range src {
+		if have[vg.LV] {
+			continue
+		}
+
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
+		base := path.Join(m.Dir, undate(vg.LV))
+		runLog().Info("Pushing volume", "source", vg.TextName(),
+			"host", m.Host, "base", base)
+
+		if !have[undate(vg.LV)] {
+			err = m.makeBase(base)
+			if err != nil {
+				done()
+				return
+			}
+			have[undate(vg.LV)] = true
+		}
+
+		err = m.pushVol(vg, base)
+		if err != nil {
+			done()
+			return
+		}
+
+		err = m.snapshot(vg.LV)
+		done()
+		if err != nil {
+			return
+		}
+		m.backup.pushed(vg.VgName, start)
+		have[vg.LV] = true
+	}
+
+	return
+}
+
+func (m *sshMirror) pushVol(src Source, base string) (err error) {
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
+	if err != nil {
+		return
+	}
+
+	cmd := rsyncCommand("/mnt/old/.", m.Host+":"+base, "--protect-args", "-e", m.Ssh)
+	err = m.backup.runSync(src.VgName, cmd)
+	return
+}
+
+// Return the names present on the remote host: the entries of Dir,
+// or the volumes of the remote volume group.
+func (m *sshMirror) remoteNames() (names map[string]bool, err error) {
+	var out string
+	if m.Snapshot == "lvm" {
+		out, err = m.remote("lvs", "--noheadings", "-o", "lv_name", m.Volgroup)
+	} else {
+		out, err = m.remote("ls", "-1", "--", m.Dir)
+	}
+	if err != nil {
+		return
+	}
+
+	names = make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			names[line] = true
+		}
+	}
+	return
+}
+
+// Create the base directory that new copies of a filesystem are made
+// into.  A base LV must already exist and be mounted.
+func (m *sshMirror) makeBase(base string) (err error) {
+	switch m.Snapshot {
+	case "btrfs":
+		_, err = m.remote("btrfs", "subvolume", "create", base)
+	case "cp":
+		_, err = m.remote("mkdir", "-p", "--", base)
+	case "lvm":
+		msg := fmt.Sprintf("Remote volume %s/%s on %q doesn't exist",
+			m.Volgroup, path.Base(base), m.Host)
+		err = errors.New(msg)
+	}
+	return
+}
+
+// Make the dated snapshot of the base on the remote host.
+func (m *sshMirror) snapshot(lv string) (err error) {
+	base := undate(lv)
+
+	switch m.Snapshot {
+	case "btrfs":
+		_, err = m.remote("btrfs", "subvolume", "snapshot", "-r",
+			path.Join(m.Dir, base), path.Join(m.Dir, lv))
+	case "lvm":
+		_, err = m.remote("sync")
+		if err != nil {
+			return
+		}
+		_, err = m.remote("lvcreate", "-s", "-n", lv, m.Volgroup+"/"+base)
+	case "cp":
+		_, err = m.remote("cp", "-al", "--",
+			path.Join(m.Dir, base), path.Join(m.Dir, lv))
+	default:
+		err = errors.New(fmt.Sprintf("Unknown remote snapshot method %q", m.Snapshot))
+	}
+	return
+}
+
+// Run a command on the remote host, returning its output.  The
+// command is run through sudo locally, so that it uses the same ssh
+// identity as the rsync does.
+func (m *sshMirror) remote(args ...string) (out string, err error) {
+	sudo.Setup(runCtx)
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	ssh := strings.Fields(m.Ssh)
+	ssh = append(ssh, m.Host, strings.Join(quoted, " "))
+
+	cmd := exec.Command(ssh[0], ssh[1:]...)
+	cmd = sudo.Sudoify(cmd)
+	cmd.Stderr = os.Stderr
+	showCommand(cmd)
+	text, err := commandOutput(cmd)
+	out = string(text)
+	return
+}
+
+// Quote a word for the remote shell, leaving simple words alone.
+func shellQuote(word string) string {
+	if word != "" && strings.Trim(word, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:@=+,") == "" {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
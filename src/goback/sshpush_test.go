@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSshPush(t *testing.T) {
+	b := fakeBackup("home", "home.2013.06.01", "home.2013.06.02")
+
+	fake := &fakeRunner{
+		output: map[string]string{
+			"fakessh -p 2222 backup@nas ls": "home\nhome.2013.06.01\n",
+		},
+	}
+
+	m, err := GeneralMirror{
+		"name":     "nas",
+		"style":    "ssh",
+		"host":     "backup@nas",
+		"dir":      "/srv/back up",
+		"snapshot": "cp",
+		"ssh":      "fakessh -p 2222",
+	}.GetMirror()
+	if err != nil {
+		t.Fatalf("GetMirror: %s", err)
+	}
+
+	withFakeRunner(fake, func() {
+		err = m.Push(b)
+	})
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+
+	ran := strings.Join(fake.ran, "\n")
+	t.Logf("Commands:\n%s", ran)
+
+	want := []string{
+		"fakessh -p 2222 backup@nas ls -1 -- '/srv/back up'",
+		"rsync -aXHi --stats --delete --protect-args -e fakessh -p 2222 /mnt/old/. backup@nas:/srv/back up/home",
+		"fakessh -p 2222 backup@nas cp -al -- '/srv/back up/home' '/srv/back up/home.2013.06.02'",
+	}
+	for _, w := range want {
+		if !strings.Contains(ran, w) {
+			t.Errorf("Missing command: %q", w)
+		}
+	}
+
+	if strings.Contains(ran, "home.2013.06.01") {
+		t.Errorf("Pushed a date already on the remote host")
+	}
+	if strings.Contains(ran, "mkdir") {
+		t.Errorf("Made a base directory that already exists")
+	}
+}
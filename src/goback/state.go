@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// State kept between runs, as JSON files within the Statedir.
+
+const systemStatedir = "/var/lib/goback"
+
+// Overridden by tests.
+var geteuid = os.Geteuid
+
+// The Statedir when none is configured.  goback only has privileges
+// for the commands it runs, so unless it is run as root the state is
+// kept in the user's own state directory, which it can write.
+func defaultStatedir() string {
+	if geteuid() == 0 {
+		return systemStatedir
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); path.IsAbs(dir) {
+		return path.Join(dir, "goback")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return path.Join(home, ".local/state/goback")
+	}
+	return systemStatedir
+}
+
+func (b *Backup) statePath(name string) string {
+	dir := b.host.Statedir
+	if dir == "" {
+		dir = defaultStatedir()
+	}
+	return path.Join(dir, name)
+}
+
+// Read a state file into v.  A missing file leaves v alone.
+func (b *Backup) loadState(name string, v any) (err error) {
+	text, err := os.ReadFile(b.statePath(name))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(text, v)
+	return
+}
+
+// Write a state file, replacing it atomically.
+func (b *Backup) saveState(name string, v any) (err error) {
+	text, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+
+	full := b.statePath(name)
+	err = os.MkdirAll(path.Dir(full), 0755)
+	if err != nil {
+		return
+	}
+
+	tmp := path.Join(path.Dir(full), "."+path.Base(full)+".tmp")
+	err = os.WriteFile(tmp, append(text, '\n'), 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, full)
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path"
+	"sort"
+)
+
+// Filesystems can be btrfs subvolumes instead of LVM volumes.  Their
+// snapshots are read-only subvolumes, named the same way as LVM
+// snapshots, and kept in the filesystem's snapshot directory.
+
+// A dated snapshot to push to the mirrors.  For btrfs subvolumes,
+// Path is the snapshot, and only the LV of the VgName is set.
+type Source struct {
+	VgName
+	Path string
+}
+
+func (s *Source) TextName() string {
+	if s.Path != "" {
+		return s.Path
+	}
+	return s.VgName.TextName()
+}
+
+type SourceSlice []Source
+
+func (p SourceSlice) Len() int      { return len(p) }
+func (p SourceSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p SourceSlice) Less(i, j int) bool {
+	if p[i].VG != p[j].VG {
+		return p[i].VG < p[j].VG
+	}
+	return p[i].LV < p[j].LV
+}
+
+// The names of the snapshots of a subvolume, oldest first.
+func subvolSnapshots(fs *FsInfo) (names []string) {
+	all, err := scanNames(fs.SnapshotDir())
+	if err != nil {
+		return
+	}
+
+	re := fs.MatchRe()
+	for name := range all {
+		if re.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Where today's snapshot of a subvolume goes.
+func (b *Backup) subvolSnap(fs *FsInfo) string {
+	return path.Join(fs.SnapshotDir(), b.namer.Snapvol(fs))
+}
+
+func (b *Backup) snapshotSubvol(fs *FsInfo) (err error) {
+	err = b.privileged("mkdir", "-p", fs.SnapshotDir())
+	if err != nil {
+		return
+	}
+
+	err = b.privileged("btrfs", "subvolume", "snapshot", "-r", fs.Mount, b.subvolSnap(fs))
+	return
+}
+
+// Run gosure on today's snapshot of a subvolume.  The snapshot is
+// only made writable for long enough to copy the integrity data in.
+func (b *Backup) goSureSubvol(fs *FsInfo) (err error) {
+	snap := b.subvolSnap(fs)
+
+	err = b.runGosure(fs, snap)
+	if err != nil {
+		return
+	}
+
+	err = b.setReadonly(snap, false)
+	if err != nil {
+		return
+	}
+	defer teardowns.Push("read-only "+snap, func() error {
+		return b.setReadonly(snap, true)
+	})()
+
+	err = b.copySure(fs, snap)
+	return
+}
+
+func (b *Backup) setReadonly(subvol string, ro bool) error {
+	flag := "false"
+	if ro {
+		flag = "true"
+	}
+	return b.privileged("btrfs", "property", "set", "-ts", subvol, "ro", flag)
+}
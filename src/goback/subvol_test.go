@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSubvolSources(t *testing.T) {
+	b := fakeBackup()
+	dir := t.TempDir()
+	b.host.Filesystems = []*FsInfo{{
+		Lvname:    "home",
+		Mount:     "/home",
+		Kind:      "btrfs",
+		Snapshots: dir,
+	}}
+	fs := b.host.Filesystems[0]
+	if b.host.UsesLVM() {
+		t.Errorf("Host with only subvolumes uses LVM")
+	}
+
+	for _, name := range []string{"home.2013.06.02", "home.2013.06.01", "other.2013.06.01"} {
+		os.Mkdir(path.Join(dir, name), 0755)
+	}
+
+	src, err := b.GetSources()
+	if err != nil {
+		t.Fatalf("GetSources: %s", err)
+	}
+	if len(src) != 2 {
+		t.Fatalf("Got sources %v", src)
+	}
+	if src[0].Path != path.Join(dir, "home.2013.06.01") || src[0].LV != "home.2013.06.01" {
+		t.Errorf("Unexpected source %+v", src[0])
+	}
+
+	fake := &fakeRunner{}
+	withFakeRunner(fake, func() {
+		err = b.snapshotSubvol(fs)
+		if err != nil {
+			return
+		}
+		var release func()
+		release, err = b.mountSource(src[0], "/mnt/old")
+		release()
+	})
+	if err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+
+	want := []string{
+		"mkdir -p " + dir,
+		"btrfs subvolume snapshot -r /home " + b.subvolSnap(fs),
+		"mount -o bind,ro " + src[0].Path + " /mnt/old",
+		"umount /mnt/old",
+	}
+	if got := strings.Join(fake.ran, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("Ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Reading of the integrity data gosure saves with each snapshot
+// (2sure.dat.gz), in the "asure-2.0" format.  After a two line
+// header, the tree is written depth first: a directory is a "d" line,
+// followed by its subdirectories, a "-" line, its other entries as
+// "f" lines, and finally a "u" line.  Each "d" and "f" line holds an
+// escaped name, and the attributes in brackets, e.g.
+//
+//	asure-2.0
+//	-----
+//	d__root__ [gid 0 kind dir perm 493 uid 0 ]
+//	-
+//	fa=20b [gid 0 kind file mtime 1370000000 perm 420 sha1 ... size 3 uid 0 ]
+//	u
+//
+// Names and values have bytes outside of printable ASCII, as well
+// as '=', '[' and ']', written as "=xx" in hex.
+
+const sureName = "2sure.dat.gz"
+
+// Read the integrity data of a tree, as manifest entries indexed by
+// path.  The entries of files hold their sha1 in hashes.
+func readSure(name string) (entries map[string]*ManifestEntry, hashes map[string]string, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return
+	}
+
+	entries, hashes, err = decodeSure(zr)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Reading %s: %s", name, err))
+	}
+	return
+}
+
+func decodeSure(r io.Reader) (entries map[string]*ManifestEntry, hashes map[string]string, err error) {
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for _, want := range []string{"asure-2.0", "-----"} {
+		if !scan.Scan() || scan.Text() != want {
+			err = errors.New("Not in asure-2.0 format")
+			return
+		}
+	}
+
+	entries = make(map[string]*ManifestEntry)
+	hashes = make(map[string]string)
+
+	// The path of the directory currently being read, as a stack.
+	var dirs []string
+	for scan.Scan() {
+		line := scan.Text()
+		if line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case '-':
+			continue
+		case 'u':
+			if len(dirs) == 0 {
+				err = errors.New("Unbalanced 'u' line")
+				return
+			}
+			dirs = dirs[:len(dirs)-1]
+			continue
+		case 'd', 'f':
+		default:
+			err = errors.New(fmt.Sprintf("Unexpected line %q", line))
+			return
+		}
+
+		var name string
+		var atts map[string]string
+		name, atts, err = parseSureLine(line[1:])
+		if err != nil {
+			return
+		}
+
+		var p string
+		switch {
+		case len(dirs) == 0:
+			// The root, whatever it is called.
+		case dirs[len(dirs)-1] == "":
+			p = name
+		default:
+			p = path.Join(dirs[len(dirs)-1], name)
+		}
+
+		if line[0] == 'd' {
+			dirs = append(dirs, p)
+		}
+		if p == "" {
+			continue
+		}
+
+		var e *ManifestEntry
+		e, err = sureEntry(p, atts)
+		if err != nil {
+			return
+		}
+		entries[p] = e
+		if sha, ok := atts["sha1"]; ok {
+			hashes[p] = sha
+		}
+	}
+	err = scan.Err()
+	return
+}
+
+// Split a "d" or "f" line, without the leading letter, into the name
+// and the attributes.
+func parseSureLine(text string) (name string, atts map[string]string, err error) {
+	pos := strings.Index(text, " [")
+	if pos < 0 || !strings.HasSuffix(text, "]") {
+		err = errors.New(fmt.Sprintf("Malformed line %q", text))
+		return
+	}
+
+	name, err = sureUnescape(text[:pos])
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(text[pos+2 : len(text)-1])
+	if len(fields)%2 != 0 {
+		err = errors.New(fmt.Sprintf("Malformed attributes %q", text))
+		return
+	}
+	atts = make(map[string]string)
+	for i := 0; i < len(fields); i += 2 {
+		atts[fields[i]], err = sureUnescape(fields[i+1])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func sureUnescape(text string) (string, error) {
+	if !strings.Contains(text, "=") {
+		return text, nil
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '=' {
+			buf.WriteByte(text[i])
+			continue
+		}
+		if i+2 >= len(text) {
+			return "", errors.New(fmt.Sprintf("Bad escape in %q", text))
+		}
+		ch, err := strconv.ParseUint(text[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Bad escape in %q", text))
+		}
+		buf.WriteByte(byte(ch))
+		i += 2
+	}
+	return buf.String(), nil
+}
+
+var sureKinds = map[string]string{
+	"dir":  "d",
+	"file": "f",
+	"lnk":  "l",
+	"chr":  "c",
+	"blk":  "b",
+	"fifo": "p",
+	"sock": "s",
+}
+
+// Make a manifest entry from the attributes of a node.  The mode only
+// holds the permissions, and mtimes are in seconds, so these entries
+// can only be compared with each other.
+func sureEntry(p string, atts map[string]string) (e *ManifestEntry, err error) {
+	e = &ManifestEntry{Path: p, Link: atts["targ"]}
+
+	var ok bool
+	e.Type, ok = sureKinds[atts["kind"]]
+	if !ok {
+		err = errors.New(fmt.Sprintf("Unknown kind %q for %q", atts["kind"], p))
+		return
+	}
+
+	num := func(key string) int64 {
+		n, nerr := strconv.ParseInt(atts[key], 10, 64)
+		if nerr != nil && err == nil && atts[key] != "" {
+			err = errors.New(fmt.Sprintf("Bad %s %q for %q", key, atts[key], p))
+		}
+		return n
+	}
+
+	e.Mode = uint32(num("perm"))
+	e.Uid = int(num("uid"))
+	e.Gid = int(num("gid"))
+	e.Size = num("size")
+	e.Mtime = num("mtime")
+	e.Rdev = uint64(num("devmaj"))<<32 | uint64(num("devmin"))
+	return
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Management of the Surelog, the log of the gosure signoffs made as
+// each snapshot is taken.  Previous logs are kept as date-stamped
+// generations alongside the current one, e.g.
+//
+//	surelog.txt
+//	surelog.txt.2013.06.01-023000
+//	surelog.txt.2013.05.31-023000.gz
+//
+// When they are compressed, the newest generation is left as it is.
+//
+// Should two generations get the same stamp, later ones are given a
+// numeric suffix, as in surelog.txt.2013.06.01-023000.1
+
+// Format used for the date stamp of rotated generations.
+const surelogStamp = "2006.01.02-150405"
+
+var surelogGenRe = regexp.MustCompile(`^\.(\d\d\d\d\.\d\d\.\d\d-\d{6})(?:\.(\d+))?(\.gz)?$`)
+
+// Rotate the surelog(s) and open fresh ones for this run.
+func (b *Backup) LogRotate() (err error) {
+	if !b.host.SurelogPerFs {
+		b.logFile, err = b.rotateOne(b.host.Surelog)
+		return
+	}
+
+	b.logFiles = make(map[*FsInfo]*os.File)
+	for _, fs := range b.host.Filesystems {
+		var file *os.File
+		file, err = b.rotateOne(b.surelogName(fs))
+		if err != nil {
+			return
+		}
+		b.logFiles[fs] = file
+	}
+
+	return
+}
+
+// The name of the surelog for a particular filesystem, when each
+// filesystem has its own.  The Lvname is inserted before the
+// extension, so "surelog.txt" becomes "surelog-home.txt".
+func (b *Backup) surelogName(fs *FsInfo) string {
+	ext := filepath.Ext(b.host.Surelog)
+	base := strings.TrimSuffix(b.host.Surelog, ext)
+	return fmt.Sprintf("%s-%s%s", base, fs.Lvname, ext)
+}
+
+// Return the log file that the surelog messages for this filesystem
+// should be written to.
+func (b *Backup) surelog(fs *FsInfo) *os.File {
+	if b.logFiles != nil {
+		return b.logFiles[fs]
+	}
+	return b.logFile
+}
+
+// Rotate a single log file, and create a new one in its place.
+func (b *Backup) rotateOne(lname string) (file *os.File, err error) {
+	fi, err := os.Stat(lname)
+	if err == nil {
+		genName := generationName(lname, fi.ModTime().Local().Format(surelogStamp))
+		err = os.Rename(lname, genName)
+		if err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	err = b.pruneGenerations(lname)
+	if err != nil {
+		return
+	}
+
+	if b.host.SurelogCompress {
+		err = compressGenerations(lname)
+		if err != nil {
+			return
+		}
+	}
+
+	file, err = os.Create(lname)
+	return
+}
+
+// The name for a new generation of a log with the given stamp, which
+// doesn't clash with an existing one, compressed or not.
+func generationName(lname, stamp string) string {
+	name := lname + "." + stamp
+	for n := 1; ; n++ {
+		_, err := os.Lstat(name)
+		_, gzErr := os.Lstat(name + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%s.%d", lname, stamp, n)
+	}
+}
+
+// A rotated generation of a log.
+type logGeneration struct {
+	name  string
+	stamp string
+	seq   int
+	gz    bool
+}
+
+// The generations of a log, and the directory they are in, oldest
+// first.
+func logGenerations(lname string) (dir string, gens []logGeneration, err error) {
+	dir, base := path.Split(lname)
+	if dir == "" {
+		dir = "."
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+
+	gens = make([]logGeneration, 0)
+	for _, n := range names {
+		if !strings.HasPrefix(n, base) {
+			continue
+		}
+		m := surelogGenRe.FindStringSubmatch(n[len(base):])
+		if m == nil {
+			continue
+		}
+		seq, _ := strconv.Atoi(m[2])
+		gens = append(gens, logGeneration{name: n, stamp: m[1], seq: seq, gz: m[3] != ""})
+	}
+
+	// The stamps sort by date, then by suffix, newest last.
+	sort.Slice(gens, func(i, j int) bool {
+		if gens[i].stamp != gens[j].stamp {
+			return gens[i].stamp < gens[j].stamp
+		}
+		return gens[i].seq < gens[j].seq
+	})
+	return
+}
+
+// Remove all but the newest SurelogKeep generations of a log.
+func (b *Backup) pruneGenerations(lname string) (err error) {
+	keep := b.host.SurelogKeep
+	if keep <= 0 {
+		keep = 1
+	}
+
+	dir, gens, err := logGenerations(lname)
+	if err != nil {
+		return
+	}
+
+	for len(gens) > keep {
+		runLog().Info("Removing old surelog", "file", gens[0].name)
+		err = os.Remove(path.Join(dir, gens[0].name))
+		if err != nil {
+			return
+		}
+		gens = gens[1:]
+	}
+
+	return
+}
+
+// Compress all but the newest generation of a log, which is left
+// as it is so that the last run's signoffs can be read directly.
+func compressGenerations(lname string) (err error) {
+	dir, gens, err := logGenerations(lname)
+	if err != nil || len(gens) == 0 {
+		return
+	}
+
+	for _, g := range gens[:len(gens)-1] {
+		if g.gz {
+			continue
+		}
+		err = compressFile(path.Join(dir, g.name))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Gzip a file, replacing it with one with a ".gz" suffix.
+func compressFile(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dest, err := os.Create(name + ".gz")
+	if err != nil {
+		return
+	}
+
+	zw := gzip.NewWriter(dest)
+	zw.Name = path.Base(name)
+
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dest.Close()
+	} else {
+		dest.Close()
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return
+	}
+
+	err = os.Remove(name)
+	return
+}
+
+// Write a header into the surelog for a filesystem.
+func (b *Backup) message(fs *FsInfo, format string, a ...interface{}) {
+	log := b.surelog(fs)
+
+	text := fmt.Sprintf(format, a...)
+	hyphens := strings.Map(func(a rune) rune { return '-' }, text)
+	fmt.Fprintf(log, "%s\n", hyphens)
+	fmt.Fprintf(log, "%s\n", text)
+	fmt.Fprintf(log, "%s\n", hyphens)
+}
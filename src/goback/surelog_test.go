@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0, len(names))
+	for _, n := range names {
+		result = append(result, n.Name())
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestPruneGenerations(t *testing.T) {
+	dir := t.TempDir()
+	lname := path.Join(dir, "surelog.txt")
+
+	for _, n := range []string{
+		"surelog.txt",
+		"surelog.txt.2013.05.30-023000.gz",
+		"surelog.txt.2013.05.31-023000.2.gz",
+		"surelog.txt.2013.05.31-023000.10",
+		"surelog.txt.2013.05.31-023000.gz",
+		"surelog.txt.2013.05.31-023000.1",
+		"surelog.txt.2013.06.01-023000",
+		"surelog.txt.notes",
+		"surelog-home.txt.2013.05.01-023000",
+	} {
+		os.WriteFile(path.Join(dir, n), nil, 0644)
+	}
+
+	b := &Backup{host: &Host{SurelogKeep: 3}}
+	err := b.pruneGenerations(lname)
+	if err != nil {
+		t.Fatalf("prune: %s", err)
+	}
+
+	want := []string{
+		"surelog-home.txt.2013.05.01-023000",
+		"surelog.txt",
+		"surelog.txt.2013.05.31-023000.10",
+		"surelog.txt.2013.05.31-023000.2.gz",
+		"surelog.txt.2013.06.01-023000",
+		"surelog.txt.notes",
+	}
+	if got := listDir(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Left %q, want %q", got, want)
+	}
+
+	// Nothing kept still keeps one.
+	b.host.SurelogKeep = 0
+	err = b.pruneGenerations(lname)
+	if err != nil {
+		t.Fatalf("prune: %s", err)
+	}
+	if got := listDir(t, dir); len(got) != 4 || got[2] != "surelog.txt.2013.06.01-023000" {
+		t.Errorf("Left %q", got)
+	}
+}
+
+func TestRotateSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	lname := path.Join(dir, "surelog.txt")
+	b := &Backup{host: &Host{SurelogKeep: 5, SurelogCompress: true}}
+
+	stamp := time.Date(2013, 6, 1, 2, 30, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		os.WriteFile(lname, []byte("log"), 0644)
+		os.Chtimes(lname, stamp, stamp)
+		file, err := b.rotateOne(lname)
+		if err != nil {
+			t.Fatalf("rotate: %s", err)
+		}
+		file.Close()
+	}
+
+	// All but the newest generation are compressed.
+	want := []string{
+		"surelog.txt",
+		"surelog.txt.2013.06.01-023000.1.gz",
+		"surelog.txt.2013.06.01-023000.2",
+		"surelog.txt.2013.06.01-023000.gz",
+	}
+	if got := listDir(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
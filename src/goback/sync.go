@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"tsync"
+)
+
+// Copying of trees to mirrors.  Each mirror can select the engine
+// used with its "sync" key: either "rsync" (the default), which runs
+// rsync, or "native", which uses the tsync package.  The native
+// engine runs as an internal command of goback itself, so that it
+// can be run with privileges the same way rsync is.  Both produce
+// rsync's itemized output, so are logged the same way.
+
+func checkEngine(m GeneralMirror) (err error) {
+	switch m["sync"] {
+	case "", "rsync", "native":
+	default:
+		msg := fmt.Sprintf("Mirror %q has unknown sync engine %q", m["name"], m["sync"])
+		err = errors.New(msg)
+	}
+	return
+}
+
+// Build the (not yet privileged) command to copy from into to.  If
+// linkDest is given, unchanged files are hardlinked from that tree
+// instead of being copied.
+func (b *Backup) syncCommand(from, to, linkDest string) (cmd *exec.Cmd, err error) {
+	switch b.engine {
+	case "", "rsync":
+		var opts []string
+		if linkDest != "" {
+			opts = append(opts, "--link-dest="+linkDest)
+		}
+		cmd = rsyncCommand(from, to, opts...)
+	case "native":
+		cmd, err = selfCommand("tsync", "-link-dest", linkDest, from, to)
+	default:
+		err = errors.New(fmt.Sprintf("Unknown sync engine %q", b.engine))
+	}
+	return
+}
+
+// Build an rsync command copying from into to, with any extra
+// options given.
+func rsyncCommand(from, to string, opts ...string) *exec.Cmd {
+	args := []string{"-aXHi", "--stats", "--delete"}
+	args = append(args, opts...)
+	args = append(args, from, to)
+	return exec.Command("rsync", args...)
+}
+
+// Build a command to run an internal command of this same goback
+// executable.  It logs the same way this one does.
+func selfCommand(args ...string) (cmd *exec.Cmd, err error) {
+	self, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	cmd = exec.Command(self, append(logOptions(), args...)...)
+	return
+}
+
+// How often the native engine reports progress.
+var tsyncProgress = 30 * time.Second
+
+// Internal command: tsync [-link-dest dir] from to
+func tsyncCmd(args ...string) (err error) {
+	flags := flag.NewFlagSet("tsync", flag.ContinueOnError)
+	linkDest := flags.String("link-dest", "", "hardlink unchanged files from this tree")
+	del := flags.Bool("delete", true, "remove files that aren't in the source")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	args = flags.Args()
+
+	if len(args) != 2 {
+		err = errors.New("tsync expects a source and a destination")
+		return
+	}
+
+	opts := &tsync.Options{
+		Delete:           *del,
+		LinkDest:         *linkDest,
+		Itemize:          os.Stdout,
+		ProgressInterval: tsyncProgress,
+		Progress: func(st *tsync.Stats) {
+			runLog().Info("Sync progress", "files", st.Files, "created", st.Created,
+				"updated", st.Updated, "deleted", st.Deleted, "bytes", st.Bytes)
+		},
+	}
+
+	_, err = tsync.Sync(args[0], args[1], opts)
+	return
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestSelfCommandLogging(t *testing.T) {
+	cmd, err := selfCommand("tsync", "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmd.Args[1:], " "); got != "tsync a b" {
+		t.Errorf("Got %q", got)
+	}
+
+	// Only the logging options are passed on.
+	flags := flag.NewFlagSet("goback", flag.ContinueOnError)
+	flags.String("log", "text", "")
+	flags.Bool("quiet", false, "")
+	flags.Bool("debug", false, "")
+	flags.Bool("wait", false, "")
+	err = flags.Parse([]string{"-log=text", "-quiet", "-wait"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(logOptionsFrom(flags), " "); got != "-log=text -quiet=true" {
+		t.Errorf("Got %q", got)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"sudo"
+)
+
+// A tar mirror writes each dated snapshot as a zstd compressed tar
+// file, <lv>.<date>.tar.zst, with a manifest of its contents
+// alongside, <lv>.<date>.manifest.  It needs nothing from the
+// destination filesystem beyond holding plain files, so works on
+// exFAT disks and network shares.
+//
+// When incremental, an archive only holds the files that changed
+// since the previous archive of the same filesystem, as found from
+// that archive's manifest.  A full archive is written every
+// FullEvery archives so that chains don't grow without bound.
+//
+// With encryption configured, both the archives and the manifests
+// are encrypted, and have a ".gpg" suffix.  If an earlier manifest
+// can't be decrypted, because only the public key is available, a
+// full archive is made instead of an incremental.
+type tarMirror struct {
+	Dir         string
+	Incremental bool
+	FullEvery   int
+	Crypt       *archiveCrypt
+	backup      *Backup
+	names       map[string]bool
+}
+
+const tarSuffix = ".tar.zst"
+const manifestSuffix = ".manifest"
+
+func (m *tarMirror) Push(b *Backup) (err error) {
+	m.backup = b
+
+	src, err := m.backup.GetSources()
+	if err != nil {
+		return
+	}
+
+	src, err = m.filterSource(src)
+	if err != nil {
+		return
+	}
+
+	sort.Sort(SourceSlice(src))
+
+	for _, vg := range src {
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
+
+		var parent *Manifest
+		if m.Incremental {
+			parent, err = m.parent(vg.LV)
+			if err != nil {
+				runLog().Warn("Making a full archive", "error", err)
+				parent, err = nil, nil
+			}
+		}
+
+		runLog().Info("Pushing volume", "source", vg.TextName(),
+			"dest", m.archiveName(vg.LV), "incremental", parent != nil)
+
+		var size int64
+		size, err = m.pushVol(vg, parent)
+		done()
+		if err != nil {
+			return
+		}
+
+		m.backup.report.AddPush(&PushReport{
+			Volume:   vg.LV,
+			Size:     m.backup.volSize(vg.VgName),
+			Bytes:    size,
+			Duration: time.Since(start).Round(time.Second),
+		})
+
+		m.names[path.Base(m.archiveName(vg.LV))] = true
+		m.names[path.Base(m.manifestName(vg.LV))] = true
+	}
+
+	return
+}
+
+// The paths of the archive and manifest for a source volume.
+func (m *tarMirror) archiveName(lv string) string {
+	return path.Join(m.Dir, lv+tarSuffix+m.Crypt.suffix())
+}
+
+func (m *tarMirror) manifestName(lv string) string {
+	return path.Join(m.Dir, lv+manifestSuffix+m.Crypt.suffix())
+}
+
+// Filter out the source volumes that already have an archive.
+func (m *tarMirror) filterSource(src []Source) (result []Source, err error) {
+	m.names, err = scanNames(m.Dir)
+	if err != nil {
+		return
+	}
+
+	result = make([]Source, 0)
+
+	for _, vol := range src {
+		if !m.names[path.Base(m.archiveName(vol.LV))] {
+			result = append(result, vol)
+		}
+	}
+
+	return
+}
+
+// The names of the archives present, without their suffixes, oldest
+// first.
+func (m *tarMirror) archives() (result []string) {
+	suffix := tarSuffix + m.Crypt.suffix()
+	for n := range m.names {
+		if strings.HasSuffix(n, suffix) && !strings.HasPrefix(n, ".") {
+			result = append(result, strings.TrimSuffix(n, suffix))
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+// Read the manifest of an archive.
+func (m *tarMirror) readManifest(lv string) (man *Manifest, err error) {
+	name := m.manifestName(lv)
+	data, err := m.Crypt.readFile(name)
+	if err != nil {
+		return
+	}
+
+	man, err = decodeManifest(bytes.NewReader(data))
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Reading manifest %q: %s", name, err))
+	}
+	return
+}
+
+// Find the manifest of the archive that an incremental of lv should
+// be made against: the most recent earlier archive of the same
+// filesystem.  Returns nil when a full archive is due instead.
+func (m *tarMirror) parent(lv string) (parent *Manifest, err error) {
+	base := undate(lv)
+
+	var name string
+	for _, n := range m.archives() {
+		if undate(n) != base || n == base || !m.names[path.Base(m.manifestName(n))] {
+			continue
+		}
+		if n < lv {
+			name = n
+		}
+	}
+
+	if name == "" {
+		return
+	}
+
+	parent, err = m.readManifest(name)
+	if err != nil {
+		return
+	}
+
+	// Count the archives in the chain back to the last full one.
+	length := 1
+	for header := &parent.Header; header.Parent != ""; length++ {
+		var data []byte
+		data, err = m.Crypt.readFile(m.manifestName(header.Parent))
+		if err != nil {
+			return
+		}
+		header, err = decodeManifestHeader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+	}
+
+	if length >= m.FullEvery {
+		parent = nil
+	}
+	return
+}
+
+// Write the archive and manifest for a single volume, returning the
+// size of the archive.
+func (m *tarMirror) pushVol(src Source, parent *Manifest) (size int64, err error) {
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
+	if err != nil {
+		return
+	}
+
+	name := m.archiveName(src.LV)
+	manifest := m.manifestName(src.LV)
+	tmp := path.Join(m.Dir, "."+path.Base(name)+".partial")
+	tmpManifest := path.Join(m.Dir, "."+path.Base(manifest)+".partial")
+
+	// For an encrypted mirror, the plaintext manifest is only
+	// written to a private temporary directory, and removed once the
+	// encrypted copy is on the mirror.  Later incrementals decrypt
+	// that copy (see parent).
+	plainManifest := tmpManifest
+	if m.Crypt != nil {
+		var work string
+		work, err = os.MkdirTemp("", "goback-tar")
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(work)
+		plainManifest = path.Join(work, "manifest")
+	}
+
+	args := []string{"tar-create", "-name", src.LV}
+	if parent != nil {
+		prev := path.Join(m.Dir, parent.Header.Name+manifestSuffix)
+		if m.Crypt != nil {
+			prev = plainManifest + ".prev"
+			err = writeManifest(prev, parent)
+			if err != nil {
+				return
+			}
+		}
+		args = append(args, "-prev", prev)
+	}
+	args = append(args, "/mnt/old", plainManifest)
+
+	sudo.Setup(runCtx)
+
+	create, err := selfCommand(args...)
+	if err != nil {
+		return
+	}
+	create = sudo.Sudoify(create)
+	create.Stderr = os.Stderr
+	showCommand(create)
+
+	compress := exec.Command("zstd", "-q", "-T0", "-c")
+	compress.Stderr = os.Stderr
+	showCommand(compress)
+
+	cmds := addStage([]*exec.Cmd{create, compress}, m.Crypt.encryptCommand())
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	cmds[len(cmds)-1].Stdout = file
+
+	_, err = runPipeline(cmds...)
+	if err == nil {
+		err = file.Sync()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil && m.Crypt != nil {
+		err = m.Crypt.encryptFile(plainManifest, tmpManifest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(tmpManifest)
+		return
+	}
+
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return
+	}
+	size = fi.Size()
+
+	// The manifest goes in first, so that an archive is never seen
+	// without one.
+	err = os.Rename(tmpManifest, manifest)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, name)
+	return
+}
+
+// Verify each archive against its manifest: every file stored in the
+// archive must have the recorded checksum, and the earlier archives
+// that an incremental refers to must be present.
+func (m *tarMirror) Verify(b *Backup) (err error) {
+	m.backup = b
+
+	m.names, err = scanNames(m.Dir)
+	if err != nil {
+		return
+	}
+
+	work, err := os.MkdirTemp("", "goback-verify")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(work)
+
+	failed := 0
+	for _, lv := range m.archives() {
+		verr := m.verifyOne(lv, work)
+		if verr != nil {
+			runLog().Error("Archive failed verification", "archive", lv, "error", verr)
+			b.report.AddError(verr)
+			failed++
+			continue
+		}
+		runLog().Info("Archive verified", "archive", lv)
+	}
+
+	if failed > 0 {
+		err = errors.New(fmt.Sprintf("%d archives failed verification", failed))
+	}
+	return
+}
+
+func (m *tarMirror) verifyOne(lv, work string) (err error) {
+	man, err := m.readManifest(lv)
+	if err != nil {
+		return
+	}
+
+	for _, e := range man.Entries {
+		if e.Archive != "" && e.Archive != lv &&
+			!m.names[path.Base(m.archiveName(e.Archive))] {
+			msg := fmt.Sprintf("%q refers to missing archive %q", e.Path, e.Archive)
+			err = errors.New(msg)
+			return
+		}
+	}
+
+	plain := path.Join(work, lv+manifestSuffix)
+	err = writeManifest(plain, man)
+	if err != nil {
+		return
+	}
+	defer os.Remove(plain)
+
+	file, err := os.Open(m.archiveName(lv))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var cmds []*exec.Cmd
+	cmds = addStage(cmds, m.Crypt.decryptCommand())
+
+	decompress := exec.Command("zstd", "-q", "-d", "-c")
+	decompress.Stderr = os.Stderr
+	showCommand(decompress)
+	cmds = append(cmds, decompress)
+
+	check, err := selfCommand("tar-verify", plain)
+	if err != nil {
+		return
+	}
+	check.Stdout = commandStdout()
+	check.Stderr = os.Stderr
+	showCommand(check)
+	cmds = append(cmds, check)
+
+	cmds[0].Stdin = file
+	_, err = runPipeline(cmds...)
+	return
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// A fake runner that also writes the manifest tar-create would have,
+// naming the archive and its parent.
+type tarRunner struct {
+	fakeRunner
+}
+
+func (f *tarRunner) Run(cmds ...*exec.Cmd) (moved int64, err error) {
+	moved, err = f.fakeRunner.Run(cmds...)
+	if err != nil {
+		return
+	}
+
+	for _, cmd := range cmds {
+		args := cmd.Args
+		for len(args) > 0 && args[0] != "tar-create" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		flags := flag.NewFlagSet("tar-create", flag.ContinueOnError)
+		name := flags.String("name", "", "")
+		prev := flags.String("prev", "", "")
+		err = flags.Parse(args[1:])
+		if err != nil {
+			return
+		}
+
+		man := &Manifest{Header: ManifestHeader{Name: *name, Source: flags.Arg(0)}}
+		if *prev != "" {
+			var parent *Manifest
+			parent, err = readManifest(*prev)
+			if err != nil {
+				return
+			}
+			man.Header.Parent = parent.Header.Name
+		}
+		err = writeManifest(flags.Arg(1), man)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Push to the mirror with the given volumes present, returning the
+// -prev given to each tar-create, or "full".
+func tarPushes(t *testing.T, m Mirror, vols ...string) (result []string) {
+	b := fakeBackup(append([]string{"home"}, vols...)...)
+	fake := &tarRunner{}
+
+	old := runner
+	runner = fake
+	err := m.Push(b)
+	runner = old
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+
+	for _, r := range fake.ran {
+		if !strings.Contains(r, "tar-create") {
+			continue
+		}
+		prev := "full"
+		if _, after, ok := strings.Cut(r, "-prev "); ok {
+			prev = path.Base(strings.Fields(after)[0])
+		}
+		result = append(result, prev)
+	}
+	return
+}
+
+func TestTarIncremental(t *testing.T) {
+	dir := t.TempDir()
+	m, err := GeneralMirror{
+		"name":        "usb",
+		"style":       "tar",
+		"dir":         dir,
+		"incremental": "true",
+		"fullevery":   "3",
+	}.GetMirror()
+	if err != nil {
+		t.Fatalf("GetMirror: %s", err)
+	}
+
+	vols := []string{}
+	for _, c := range []struct {
+		vol  string
+		want string
+	}{
+		{"home.2013.06.01", "full"},
+		{"home.2013.06.02", "home.2013.06.01.manifest"},
+		{"home.2013.06.03", "home.2013.06.02.manifest"},
+		// The chain is three long, so a new full one.
+		{"home.2013.06.04", "full"},
+		{"home.2013.06.05", "home.2013.06.04.manifest"},
+	} {
+		vols = append(vols, c.vol)
+		got := tarPushes(t, m, vols...)
+		if len(got) != 1 || got[0] != c.want {
+			t.Errorf("%s: got %q, want %q", c.vol, got, c.want)
+		}
+
+		for _, suffix := range []string{tarSuffix, manifestSuffix} {
+			if _, err = os.Stat(path.Join(dir, c.vol+suffix)); err != nil {
+				t.Errorf("%s: %s", c.vol, err)
+			}
+		}
+	}
+
+	// The parents were recorded in the manifests.
+	man, err := readManifest(path.Join(dir, "home.2013.06.03"+manifestSuffix))
+	if err != nil || man.Header.Parent != "home.2013.06.02" {
+		t.Errorf("Manifest %+v, %v", man, err)
+	}
+
+	// An archive without its manifest can't be a parent, so the one
+	// before it is used.
+	os.Remove(path.Join(dir, "home.2013.06.05"+manifestSuffix))
+	vols = append(vols, "home.2013.06.06")
+	if got := tarPushes(t, m, vols...); len(got) != 1 || got[0] != "home.2013.06.04.manifest" {
+		t.Errorf("Missing manifest: got %q", got)
+	}
+
+	// Nothing new, nothing pushed.
+	if got := tarPushes(t, m, vols...); len(got) != 0 {
+		t.Errorf("Pushed again: %q", got)
+	}
+}
+
+func TestTarFull(t *testing.T) {
+	dir := t.TempDir()
+	m, err := GeneralMirror{"name": "usb", "style": "tar", "dir": dir}.GetMirror()
+	if err != nil {
+		t.Fatalf("GetMirror: %s", err)
+	}
+
+	got := tarPushes(t, m, "home.2013.06.01", "home.2013.06.02")
+	if strings.Join(got, " ") != "full full" {
+		t.Errorf("Got %q", got)
+	}
+}
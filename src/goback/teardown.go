@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Orderly teardown of activations and mounts.
+//
+// Steps that undo something (unmounting, deactivating a volume) are
+// registered as they become necessary, and released (run) as the
+// code that needed them finishes.  If goback receives a termination
+// signal, the running child command is told to terminate, no new
+// commands are started, and the remaining steps are run, most recent
+// first, as the main code unwinds.  Only commands started as part of
+// a teardown step are allowed to run once the run has been aborted.
+
+type teardownStep struct {
+	name string
+	fn   func() error
+}
+
+type teardownStack struct {
+	lock      sync.Mutex
+	steps     []*teardownStep
+	children  []*exec.Cmd
+	signal    os.Signal
+	releasing int
+}
+
+var teardowns teardownStack
+
+var errAborted = errors.New("Run aborted by signal")
+
+// Start catching termination signals.
+func (t *teardownStack) CatchSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		for sig := range ch {
+			t.abort(sig)
+		}
+	}()
+}
+
+func (t *teardownStack) abort(sig os.Signal) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.signal != nil {
+		runLog().Warn("Teardown already in progress", "signal", sig.String())
+		return
+	}
+	t.signal = sig
+	runLog().Warn("Aborting run", "signal", sig.String())
+
+	// Don't interrupt a command that is itself undoing something.
+	if t.releasing > 0 {
+		return
+	}
+	for _, child := range t.children {
+		if child.Process == nil {
+			continue
+		}
+		err := child.Process.Signal(syscall.SIGTERM)
+		if err != nil {
+			runLog().Error("Unable to terminate command", "exec", child.Path, "error", err)
+		}
+	}
+}
+
+// Has the run been aborted?
+func (t *teardownStack) Aborted() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.signal != nil
+}
+
+// Register a teardown step.  The returned function runs the step
+// (once), and is meant to be deferred by the caller.
+func (t *teardownStack) Push(name string, fn func() error) func() {
+	step := &teardownStep{name: name, fn: fn}
+
+	t.lock.Lock()
+	t.steps = append(t.steps, step)
+	t.lock.Unlock()
+
+	return func() { t.release(step) }
+}
+
+func (t *teardownStack) release(step *teardownStep) {
+	t.lock.Lock()
+	pos := -1
+	for i, s := range t.steps {
+		if s == step {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		t.lock.Unlock()
+		return
+	}
+	t.steps = append(t.steps[:pos], t.steps[pos+1:]...)
+	t.releasing++
+	t.lock.Unlock()
+
+	err := step.fn()
+
+	t.lock.Lock()
+	t.releasing--
+	t.lock.Unlock()
+
+	if err != nil {
+		runLog().Error("Teardown step failed", "teardown", step.name, "error", err)
+	}
+}
+
+// Run every step that is still registered, most recent first.
+// Returns the signal that aborted the run, or nil if the run was not
+// interrupted.
+func (t *teardownStack) Finish() os.Signal {
+	for {
+		t.lock.Lock()
+		if len(t.steps) == 0 {
+			sig := t.signal
+			t.lock.Unlock()
+			return sig
+		}
+		step := t.steps[len(t.steps)-1]
+		t.lock.Unlock()
+
+		t.release(step)
+	}
+}
+
+// Run a command, tracking it so that it can be terminated if a
+// signal arrives.
+func runCommand(cmd *exec.Cmd) (err error) {
+	_, err = runner.Run(cmd)
+	return
+}
+
+// Run a pipeline of commands, the output of each feeding the input of
+// the next.  Returns the number of bytes passed into the last
+// command.
+func runPipeline(cmds ...*exec.Cmd) (moved int64, err error) {
+	return runner.Run(cmds...)
+}
+
+// Run a command, returning its standard output, as with
+// (*exec.Cmd).Output.
+func commandOutput(cmd *exec.Cmd) (out []byte, err error) {
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	err = runCommand(cmd)
+	out = buf.Bytes()
+	return
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"sudo"
+)
+
+// A zfs mirror copies each source snapshot into a directory within a
+// zfs dataset, and then takes a zfs snapshot of the dataset named
+// after the source, e.g. tank/backup@home.2013.06.01.
+type zfsMirror struct {
+	Dataset string
+	backup  *Backup
+}
+
+func (m *zfsMirror) Push(b *Backup) (err error) {
+	m.backup = b
+
+	src, err := m.backup.GetSources()
+	if err != nil {
+		return
+	}
+
+	src, err = m.filterSource(src)
+	if err != nil {
+		return
+	}
+
+	if len(src) == 0 {
+		return
+	}
+
+	mount, err := m.mountpoint()
+	if err != nil {
+		return
+	}
+
+	sort.Sort(SourceSlice(src))
+
+	for _, vg := range src {
+		done := logStep("push", "filesystem", undate(vg.LV))
+		start := time.Now()
+		base := path.Join(mount, undate(vg.LV))
+		snap := m.Dataset + "@" + vg.LV
+		runLog().Info("Pushing volume", "source", vg.TextName(),
+			"base", base, "dest", snap)
+
+		err = m.pushVol(vg, base)
+		if err != nil {
+			done()
+			return
+		}
+
+		err = m.snapshot(snap)
+		done()
+		if err != nil {
+			return
+		}
+		m.backup.pushed(vg.VgName, start)
+	}
+
+	return
+}
+
+// Filter out the source volumes that already have a snapshot of the
+// dataset.
+func (m *zfsMirror) filterSource(src []Source) (result []Source, err error) {
+	snaps, err := m.snapshots()
+	if err != nil {
+		return
+	}
+
+	result = make([]Source, 0)
+
+	for _, vol := range src {
+		if !snaps[vol.LV] {
+			result = append(result, vol)
+		}
+	}
+
+	return
+}
+
+// Return the names (the part after the '@') of the existing
+// snapshots of the dataset.
+func (m *zfsMirror) snapshots() (names map[string]bool, err error) {
+	out, err := m.zfs("list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", m.Dataset)
+	if err != nil {
+		return
+	}
+
+	names = make(map[string]bool)
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		pos := strings.IndexByte(line, '@')
+		if pos < 0 || line[:pos] != m.Dataset {
+			continue
+		}
+		names[line[pos+1:]] = true
+	}
+
+	return
+}
+
+// Find where the dataset is mounted.
+func (m *zfsMirror) mountpoint() (mount string, err error) {
+	out, err := m.zfs("get", "-H", "-o", "value", "mountpoint", m.Dataset)
+	if err != nil {
+		return
+	}
+
+	mount = strings.TrimSpace(out)
+	if !strings.HasPrefix(mount, "/") {
+		msg := fmt.Sprintf("Dataset %q is not mounted (mountpoint %q)", m.Dataset, mount)
+		err = errors.New(msg)
+	}
+	return
+}
+
+func (m *zfsMirror) snapshot(snap string) (err error) {
+	_, err = m.zfs("snapshot", snap)
+	return
+}
+
+// Run a zfs command, returning its output.
+func (m *zfsMirror) zfs(args ...string) (out string, err error) {
+	sudo.Setup(runCtx)
+
+	cmd := exec.Command("zfs", args...)
+	cmd = sudo.Sudoify(cmd)
+	showCommand(cmd)
+	text, err := commandOutput(cmd)
+	out = string(text)
+	return
+}
+
+func (m *zfsMirror) pushVol(src Source, base string) (err error) {
+	release, err := m.backup.mountSource(src, "/mnt/old")
+	defer release()
+	if err != nil {
+		return
+	}
+
+	err = m.backup.syncTree(src.VgName, "/mnt/old/.", base, "")
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Runner that records the commands it is given instead of running
+// them.  Commands whose text starts with one of the keys of output
+// write the associated value as their output.
+type fakeRunner struct {
+	output map[string]string
+	ran    []string
+
+	// Commands starting with any of these fail.
+	fail []string
+}
+
+func (f *fakeRunner) Run(cmds ...*exec.Cmd) (moved int64, err error) {
+	for _, cmd := range cmds {
+		args := cmd.Args
+		if len(args) > 0 && args[0] == "sudo" {
+			args = args[1:]
+		}
+		text := strings.Join(args, " ")
+		f.ran = append(f.ran, text)
+
+		for prefix, out := range f.output {
+			if strings.HasPrefix(text, prefix) && cmd.Stdout != nil {
+				io.WriteString(cmd.Stdout, out)
+			}
+		}
+		for _, prefix := range f.fail {
+			if strings.HasPrefix(text, prefix) {
+				err = errors.New("failed: " + text)
+				return
+			}
+		}
+	}
+	return
+}
+
+// Run f with a fake runner in place.
+func withFakeRunner(fake *fakeRunner, f func()) {
+	old := runner
+	runner = fake
+	defer func() { runner = old }()
+
+	f()
+}
+
+// Make a backup with a single filesystem, and the given volumes.
+func fakeBackup(vols ...string) *Backup {
+	fs := &FsInfo{Volgroup: "vg", Lvname: "home", Mount: "/home"}
+
+	lvm := &LVInfo{ByName: make(map[VgName]*VolInfo)}
+	for _, name := range vols {
+		vol := &VolInfo{VG: "vg", LV: name}
+		lvm.Volumes = append(lvm.Volumes, vol)
+		lvm.ByName[vol.VgName()] = vol
+	}
+
+	return &Backup{
+		host: &Host{
+			Host:        "test",
+			Snapdir:     "/mnt/snap",
+			Filesystems: []*FsInfo{fs},
+		},
+		lvm:   lvm,
+		namer: newNamer(),
+		time:  time.Now(),
+	}
+}
+
+func TestZfsPush(t *testing.T) {
+	b := fakeBackup("home", "home.2013.06.01", "home.2013.06.02")
+
+	fake := &fakeRunner{
+		output: map[string]string{
+			"zfs list": "tank/backup@home.2013.06.01\ntank/backup/other@home.2013.06.02\n",
+			"zfs get":  "/tank/backup\n",
+		},
+	}
+
+	m, err := GeneralMirror{"name": "zfs", "style": "zfs", "dataset": "tank/backup"}.GetMirror()
+	if err != nil {
+		t.Fatalf("GetMirror: %s", err)
+	}
+
+	withFakeRunner(fake, func() {
+		err = m.Push(b)
+	})
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+
+	ran := strings.Join(fake.ran, "\n")
+	t.Logf("Commands:\n%s", ran)
+
+	want := []string{
+		"lvchange -ay -K /dev/mapper/vg-home.2013.06.02",
+		"mount -r /dev/mapper/vg-home.2013.06.02 /mnt/old",
+		"rsync -aXHi --stats --delete /mnt/old/. /tank/backup/home",
+		"umount /dev/mapper/vg-home.2013.06.02",
+		"lvchange -an /dev/mapper/vg-home.2013.06.02",
+		"zfs snapshot tank/backup@home.2013.06.02",
+	}
+	for _, w := range want {
+		if !strings.Contains(ran, w) {
+			t.Errorf("Missing command: %q", w)
+		}
+	}
+
+	if strings.Contains(ran, "home.2013.06.01") {
+		t.Errorf("Pushed a snapshot already in the dataset")
+	}
+
+	// The snapshot must be taken after the volume is unmounted.
+	if strings.Index(ran, "zfs snapshot") < strings.Index(ran, "umount") {
+		t.Errorf("Snapshot taken before unmount")
+	}
+}
@@ -0,0 +1,171 @@
+// Test the privilege methods, with a stand-in for sudo that just
+// shows what it was asked to do.
+
+package sudo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMethods(t *testing.T) {
+	saved := needSudo
+	needSudo = true
+	defer func() { needSudo = saved }()
+
+	// Count the validations in a file.
+	tally := t.TempDir() + "/tally"
+	methods["fake"] = &method{
+		command:  "sh",
+		validate: []string{"-c", "echo >> " + tally},
+		noPrompt: "-e",
+		setsUser: true,
+	}
+	defer delete(methods, "fake")
+	defer Configure("sudo", false)
+
+	err := Configure("bogus", false)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown method")
+	}
+
+	err = Configure("fake", true)
+	if err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+
+	cmd := Sudoify(exec.Command("echo", "hello"))
+	want := "sh -e " + cmd.Args[2] + " hello"
+	if got := strings.Join(cmd.Args, " "); got != want || !strings.HasSuffix(cmd.Args[2], "/echo") {
+		t.Errorf("Sudoify gave %q, want %q", got, want)
+	}
+
+	args, ok := Unwrap(cmd)
+	if !ok || strings.Join(args, " ") != cmd.Args[2]+" hello" {
+		t.Errorf("Unwrap gave %q", args)
+	}
+	if _, ok = Unwrap(exec.Command("echo", "hello")); ok {
+		t.Errorf("Unwrapped a command that wasn't wrapped")
+	}
+
+	TickInterval = 10 * time.Millisecond
+	defer func() { TickInterval = 30 * time.Second }()
+
+	// Only one of these validates, and starts the keeper.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Setup(context.Background())
+			if err != nil {
+				t.Errorf("Setup: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := count(t, tally); n != 1 {
+		t.Errorf("Validated %d times, want 1", n)
+	}
+
+	err = Configure("none", false)
+	if err == nil {
+		t.Errorf("Configure allowed while running")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	Stop()
+	n := count(t, tally)
+	if n < 3 {
+		t.Errorf("Keeper only validated %d times", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if count(t, tally) != n {
+		t.Errorf("Keeper still running after Stop")
+	}
+
+	// The keeper also stops with the context of Setup.
+	ctx, cancel := context.WithCancel(context.Background())
+	err = Setup(ctx)
+	if err != nil {
+		t.Fatalf("Setup: %s", err)
+	}
+	cancel()
+	lock.Lock()
+	done := stopped
+	lock.Unlock()
+	<-done
+	Stop()
+
+	// A method that would lose the working directory keeps it,
+	// and the command is told who ran it.  The stand-in here is
+	// env itself.
+	methods["fakepk"] = &method{command: "env", dropsDir: true}
+	defer delete(methods, "fakepk")
+	err = Configure("fakepk", false)
+	if err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+	dir, err := os.MkdirTemp("", "method")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	pwd := exec.Command("sh", "-c", "echo $PWD $SUDO_UID $SUDO_GID")
+	pwd.Dir = dir
+	cmd = Sudoify(pwd)
+	if len(cmd.Args) < 3 || cmd.Args[2] != "--chdir="+dir {
+		t.Errorf("Sudoify gave %q", cmd.Args)
+	}
+	out, err := cmd.Output()
+	want = fmt.Sprintf("%s %d %d", dir, os.Getuid(), os.Getgid())
+	if err != nil || strings.TrimSpace(string(out)) != want {
+		t.Errorf("Ran with %q, want %q: %v", out, want, err)
+	}
+	args, ok = Unwrap(cmd)
+	if !ok || len(args) != 3 || !strings.HasSuffix(args[0], "/sh") {
+		t.Errorf("Unwrap gave %q", args)
+	}
+
+	// Without a directory, there's only the user to pass on.
+	cmd = Sudoify(exec.Command("pwd"))
+	if len(cmd.Args) != 5 || !strings.HasPrefix(cmd.Args[2], "SUDO_UID=") {
+		t.Errorf("Sudoify gave %q", cmd.Args)
+	}
+	args, ok = Unwrap(cmd)
+	if !ok || len(args) != 1 || !strings.HasSuffix(args[0], "/pwd") {
+		t.Errorf("Unwrap gave %q", args)
+	}
+
+	// A method that can only prompt can't be used without one.
+	Stop()
+	err = Configure("pkexec", true)
+	if err == nil {
+		t.Errorf("pkexec allowed without prompting")
+	}
+
+	err = Configure("none", false)
+	if err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+	cmd = exec.Command("echo", "hello")
+	if Sudoify(cmd) != cmd {
+		t.Errorf("Method none changed the command")
+	}
+}
+
+func count(t *testing.T, name string) int {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
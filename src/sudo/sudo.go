@@ -1,61 +1,201 @@
-// Run commands through sudo if we aren't root.  Also manages a
-// periodic invocation of sudo -v to keep the cookie alive.
+// Run commands with privileges, through sudo (or doas or pkexec) if
+// we aren't root.  With sudo, also manages a periodic invocation of
+// sudo -v to keep the cookie alive.
 
 package sudo
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
+	"sync"
 	"time"
 )
 
+// A way of running commands with privileges.
+type method struct {
+	command string
+
+	// The arguments that check (and refresh) the cached
+	// credentials, for methods that cache them.
+	validate []string
+
+	// The option that makes it fail, rather than prompt for a
+	// password, if it has one.
+	noPrompt string
+
+	// Set if it runs the command in another directory (pkexec uses
+	// the target user's home), so the command's own has to be
+	// restored with env --chdir.
+	dropsDir bool
+
+	// Set if it tells the command who ran it, in SUDO_UID and
+	// SUDO_GID.  For the others, these are set with env.
+	setsUser bool
+}
+
+var methods = map[string]*method{
+	"sudo":   {command: "sudo", validate: []string{"-v"}, noPrompt: "-n", setsUser: true},
+	"doas":   {command: "doas", noPrompt: "-n"},
+	"pkexec": {command: "pkexec", dropsDir: true},
+	"none":   nil,
+}
+
 var needSudo = false
+
+// How often the keeper refreshes the credentials.  Zero turns the
+// keeper off, for when they are only needed once.
 var TickInterval = 30 * time.Second
+
+// Protects everything below.
+var lock sync.Mutex
+var current = methods["sudo"]
+var noPrompt = false
 var running = false
 
+// Calling stop ends the keeper, which closes stopped once it has.
+var stop context.CancelFunc
+var stopped chan struct{}
+
 func init() {
 	id := os.Geteuid()
 	needSudo = id != 0
 }
 
-func Setup() (err error) {
+// Choose how to run privileged commands: "sudo" (the default, also
+// given by ""), "doas", "pkexec", or "none" to run them directly.
+// With nonInteractive, a command that would ask for a password fails
+// instead, as is wanted under cron; pkexec can't do that, so is
+// refused.  This has to be done before Setup.
+func Configure(name string, nonInteractive bool) (err error) {
+	if name == "" {
+		name = "sudo"
+	}
+	m, ok := methods[name]
+	if !ok {
+		err = errors.New(fmt.Sprintf("Unknown privilege method %q", name))
+		return
+	}
+	if nonInteractive && needSudo && m != nil && m.noPrompt == "" {
+		err = errors.New(fmt.Sprintf("%s can't be run without prompting for a password", name))
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
 	if running {
+		err = errors.New("Can't change the privilege method once it is set up")
 		return
 	}
+	current = m
+	noPrompt = nonInteractive
+	return
+}
+
+// Get ready to run privileged commands, prompting for a password if
+// that is needed (and allowed).  With sudo, this also starts the
+// keeper, which refreshes its credentials until ctx is done or Stop
+// is called.  It is safe to call this any number of times, including
+// concurrently; only the first call does anything, unless the keeper
+// has since stopped.
+func Setup(ctx context.Context) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
 
-	err = SudoKeeper()
+	if running && !keeperDone() {
+		return
+	}
+
+	m, quiet := current, noPrompt
+	err = validate(ctx, m, quiet)
 	if err != nil {
 		return
 	}
+	running = true
+
+	if !needSudo || m == nil || m.validate == nil || TickInterval <= 0 {
+		return
+	}
+
+	kctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	stop, stopped = cancel, done
+	go keeper(kctx, m, quiet, done)
+	return
+}
+
+// Has the keeper stopped on its own, because the context of Setup is
+// done?  Called with the lock held.
+func keeperDone() bool {
+	if stopped == nil {
+		return false
+	}
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func keeper(ctx context.Context, m *method, quiet bool, done chan struct{}) {
+	defer close(done)
 
 	tick := time.NewTicker(TickInterval)
-	go func() {
-		for {
-			_ = <-tick.C
-			err = SudoKeeper()
-			if err != nil {
-				log.Printf("Warning: error running sudo: %s", err)
-			}
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
 		}
-	}()
 
-	running = true
+		err := validate(ctx, m, quiet)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: error running %s: %s", m.command, err)
+		}
+	}
+}
 
-	return
+// Stop the keeper, waiting for it to finish.  Setup can be called
+// again afterwards.
+func Stop() {
+	lock.Lock()
+	cancel, done := stop, stopped
+	stop, stopped = nil, nil
+	running = false
+	lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
 }
 
-// Function called periodically that will enforce that sudo -v has
-// been run.  This can also be invoked initially to
-func SudoKeeper() (err error) {
-	if !needSudo {
+// Check that the method's credentials are cached, asking for them if
+// they aren't (unless quiet).
+func validate(ctx context.Context, m *method, quiet bool) (err error) {
+	if !needSudo || m == nil || m.validate == nil {
 		return
 	}
 
 	// log.Printf("sudo tick: %s", time.Now().Format("15:04:05"))
-	cmd := exec.Command("sudo", "-v")
+	args := m.validate
+	if quiet && m.noPrompt != "" {
+		args = append([]string{m.noPrompt}, args...)
+	}
+	cmd := exec.CommandContext(ctx, m.command, args...)
 	err = cmd.Run()
-
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%s %v: %s", m.command, args, err))
+	}
 	return
 }
 
@@ -65,30 +205,85 @@ func SudoKeeper() (err error) {
 // to run with Sudo.  The Path and Args fields will be freshly
 // allocated, and the rest will just be copied over.
 func Sudoify(cmd *exec.Cmd) *exec.Cmd {
+	lock.Lock()
+	m, quiet := current, noPrompt
+	lock.Unlock()
+
 	if !needSudo {
 		log.Printf("Running: %#v", cmd)
 		return cmd
 	}
+	if m == nil {
+		return cmd
+	}
 
 	ncmd := *cmd
 
 	// log.Printf("Old cmd: %#v", &ncmd)
 
 	// new arg[0] gets the sudo command.
-	// new arg[1] gets the sudo executable
-	// new arg[2] gets the original cmd.
+	// new arg[1] gets the no prompt option, if that is set.
+	// next gets the original executable.
 	// old arg[0] is discarded.
 
-	args := make([]string, len(cmd.Args)+1)
-	args[0] = "sudo"
-	args[1] = cmd.Path
-	copy(args[2:], cmd.Args[1:])
-	ncmd.Args = args
+	args := make([]string, 0, len(cmd.Args)+2)
+	args = append(args, m.command)
+	if quiet && m.noPrompt != "" {
+		args = append(args, m.noPrompt)
+	}
 	var err error
-	ncmd.Path, err = exec.LookPath("sudo")
+	var envArgs []string
+	if m.dropsDir && cmd.Dir != "" {
+		envArgs = append(envArgs, "--chdir="+cmd.Dir)
+	}
+	if !m.setsUser {
+		envArgs = append(envArgs, fmt.Sprintf("SUDO_UID=%d", os.Getuid()),
+			fmt.Sprintf("SUDO_GID=%d", os.Getgid()))
+	}
+	if len(envArgs) > 0 {
+		var env string
+		env, err = exec.LookPath("env")
+		if err != nil {
+			log.Fatalf("Unable to find env command: %s", err)
+		}
+		args = append(append(args, env), envArgs...)
+	}
+	args = append(args, cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+	ncmd.Args = args
+	ncmd.Path, err = exec.LookPath(m.command)
 	if err != nil {
-		log.Fatalf("Unable to find sudo command: %s", err)
+		log.Fatalf("Unable to find %s command: %s", m.command, err)
 	}
 	// log.Printf("Running: %#v", &ncmd)
 	return &ncmd
 }
+
+// Undo Sudoify, returning the arguments of the original command, with
+// its full path first, if cmd came from it.
+func Unwrap(cmd *exec.Cmd) (args []string, ok bool) {
+	lock.Lock()
+	m, quiet := current, noPrompt
+	lock.Unlock()
+
+	if !needSudo || m == nil || len(cmd.Args) < 2 || cmd.Args[0] != m.command {
+		return
+	}
+
+	args = cmd.Args[1:]
+	if quiet && m.noPrompt != "" {
+		if args[0] != m.noPrompt {
+			return
+		}
+		args = args[1:]
+	}
+	if (m.dropsDir || !m.setsUser) && len(args) > 0 && path.Base(args[0]) == "env" {
+		args = args[1:]
+		for len(args) > 0 && (strings.HasPrefix(args[0], "--chdir=") ||
+			strings.HasPrefix(args[0], "SUDO_UID=") || strings.HasPrefix(args[0], "SUDO_GID=")) {
+			args = args[1:]
+		}
+	}
+	ok = len(args) > 0
+	return
+}
@@ -7,6 +7,7 @@
 package sudo_test
 
 import (
+	"context"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -19,11 +20,12 @@ func TestSudo(t *testing.T) {
 	// Make the ticker much faster.
 	sudo.TickInterval = 1 * time.Second
 
-	err := sudo.Setup()
+	err := sudo.Setup(context.Background())
 	if err != nil {
 		t.Errorf("Error starting sudo: %s", err)
 		return
 	}
+	defer sudo.Stop()
 
 	// Sleep a little bit.
 	time.Sleep(5 * time.Second)
@@ -42,7 +44,7 @@ func TestSudo(t *testing.T) {
 var idRe = regexp.MustCompile(`id=(\d+)`)
 
 func TestSudoRun(t *testing.T) {
-	err := sudo.Setup()
+	err := sudo.Setup(context.Background())
 	if err != nil {
 		t.Errorf("Can't setup sudo: %s", err)
 		return
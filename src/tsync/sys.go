@@ -0,0 +1,179 @@
+package tsync
+
+// Low level system calls that the syscall package doesn't provide:
+// the variants that operate on a symlink itself rather than the file
+// it points to.
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	atFdcwd           = -0x64
+	atSymlinkNofollow = 0x100
+	utimeOmit         = (1 << 30) - 2
+)
+
+// Set the modification time of a path, without following symlinks,
+// and leaving the access time alone.
+func lsetMtime(path string, mtime syscall.Timespec) (err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+
+	ts := [2]syscall.Timespec{
+		{Sec: 0, Nsec: utimeOmit},
+		mtime,
+	}
+
+	fd := atFdcwd
+	_, _, e := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])),
+		atSymlinkNofollow, 0, 0)
+	if e != 0 {
+		err = e
+	}
+	return
+}
+
+func llistxattr(path string, dest []byte) (sz int, err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	r, _, e := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(d), uintptr(len(dest)))
+	if e != 0 {
+		err = e
+	}
+	sz = int(r)
+	return
+}
+
+func lgetxattr(path, attr string, dest []byte) (sz int, err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	r, _, e := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(d), uintptr(len(dest)), 0, 0)
+	if e != 0 {
+		err = e
+	}
+	sz = int(r)
+	return
+}
+
+func lsetxattr(path, attr string, data []byte) (err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return
+	}
+	var d unsafe.Pointer
+	if len(data) > 0 {
+		d = unsafe.Pointer(&data[0])
+	}
+	_, _, e := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(d), uintptr(len(data)), 0, 0)
+	if e != 0 {
+		err = e
+	}
+	return
+}
+
+func lremovexattr(path, attr string) (err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return
+	}
+	_, _, e := syscall.Syscall(syscall.SYS_LREMOVEXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), 0)
+	if e != 0 {
+		err = e
+	}
+	return
+}
+
+// Read all of the extended attributes of a path, without following
+// symlinks.  ACLs are stored as the system.posix_acl_* attributes,
+// so are included.  Filesystems without xattr support just return an
+// empty set.
+func GetXattrs(path string) (attrs map[string][]byte, err error) {
+	attrs = make(map[string][]byte)
+
+	sz, err := llistxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		err = nil
+		return
+	}
+	if err != nil || sz == 0 {
+		return
+	}
+
+	buf := make([]byte, sz)
+	sz, err = llistxattr(path, buf)
+	if err != nil {
+		return
+	}
+
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		key := string(name)
+
+		var vsz int
+		vsz, err = lgetxattr(path, key, nil)
+		if err == syscall.ENODATA {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		value := make([]byte, vsz)
+		if vsz > 0 {
+			vsz, err = lgetxattr(path, key, value)
+			if err != nil {
+				return
+			}
+		}
+		attrs[key] = value[:vsz]
+	}
+
+	return
+}
+
+// Set an extended attribute of a path, without following symlinks.
+func SetXattr(path, attr string, value []byte) error {
+	return lsetxattr(path, attr, value)
+}
+
+// Set the modification time of a path, given in nanoseconds, without
+// following symlinks.
+func SetMtime(path string, nsec int64) error {
+	return lsetMtime(path, syscall.NsecToTimespec(nsec))
+}
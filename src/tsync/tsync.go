@@ -0,0 +1,652 @@
+// Native synchronization of directory trees.
+//
+// Sync makes a destination directory an exact copy of a source
+// directory, the way 'rsync -aXH --delete src/. dest' does: regular
+// files, directories, symlinks, devices, fifos and sockets are all
+// copied, along with hardlinks, ownership, permissions, modification
+// times and extended attributes (which include POSIX ACLs).
+//
+// As with rsync, a regular file whose size and modification time
+// match is assumed to be unchanged, and only has its metadata
+// brought up to date.  The changes made can be written out in the
+// same format as 'rsync -i', so that the output can be logged and
+// parsed the same way.
+
+package tsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+type Options struct {
+	// Remove files from the destination that aren't in the
+	// source.
+	Delete bool
+
+	// If set, a directory holding a previous copy of the tree.
+	// Files that are missing from the destination, but are
+	// identical in this tree are hardlinked from it rather than
+	// copied, as with rsync's --link-dest.
+	LinkDest string
+
+	// If set, an itemized list of the changes is written here.
+	Itemize io.Writer
+
+	// If set, called every ProgressInterval with the statistics
+	// so far.
+	Progress         func(stats *Stats)
+	ProgressInterval time.Duration
+}
+
+type Stats struct {
+	Files   int   // Number of source entries examined.
+	Created int   // Entries created in the destination.
+	Updated int   // Entries whose contents or metadata changed.
+	Deleted int   // Entries removed from the destination.
+	Bytes   int64 // Bytes of file data copied.
+}
+
+func (st *Stats) String() string {
+	return fmt.Sprintf("%d files, %d created, %d updated, %d deleted, %d bytes copied",
+		st.Files, st.Created, st.Updated, st.Deleted, st.Bytes)
+}
+
+// Hardlinked files are identified by device and inode.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type syncer struct {
+	src, dest string
+	opts      *Options
+	stats     Stats
+	links     map[fileID]string
+	lastShown time.Time
+}
+
+// Synchronize the tree at dest with the tree at src.
+func Sync(src, dest string, opts *Options) (stats *Stats, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	s := &syncer{
+		src:       src,
+		dest:      dest,
+		opts:      opts,
+		links:     make(map[fileID]string),
+		lastShown: time.Now(),
+	}
+
+	err = s.syncPath("")
+	stats = &s.stats
+
+	if opts.Itemize != nil {
+		fmt.Fprintf(opts.Itemize, "\nNumber of files: %d\n", s.stats.Files)
+		fmt.Fprintf(opts.Itemize, "Total bytes sent: %d\n", s.stats.Bytes)
+	}
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+
+	return
+}
+
+// The flags of an rsync itemized change line.  See the description
+// of --itemize-changes in rsync(1).
+type itemFlags [11]byte
+
+func newItem(kind byte) (it itemFlags) {
+	copy(it[:], "...........")
+	it[1] = kind
+	return
+}
+
+func (it *itemFlags) create() {
+	copy(it[2:], "+++++++++")
+}
+
+func (it *itemFlags) changed() bool {
+	for _, ch := range it[2:] {
+		if ch != '.' {
+			return true
+		}
+	}
+	return it[0] != '.'
+}
+
+func kindOf(mode uint32) byte {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return 'f'
+	case syscall.S_IFDIR:
+		return 'd'
+	case syscall.S_IFLNK:
+		return 'L'
+	case syscall.S_IFIFO, syscall.S_IFSOCK:
+		return 'S'
+	default:
+		return 'D'
+	}
+}
+
+// Show and count a change.
+func (s *syncer) item(it itemFlags, name string, created bool) {
+	if created {
+		s.stats.Created++
+	} else if it.changed() {
+		s.stats.Updated++
+	} else {
+		return
+	}
+
+	if s.opts.Itemize != nil {
+		fmt.Fprintf(s.opts.Itemize, "%s %s\n", it[:], name)
+	}
+}
+
+func (s *syncer) progress() {
+	s.stats.Files++
+	if s.opts.Progress == nil {
+		return
+	}
+	if time.Since(s.lastShown) >= s.opts.ProgressInterval {
+		s.opts.Progress(&s.stats)
+		s.lastShown = time.Now()
+	}
+}
+
+// The name of an entry, as shown in the itemized output.
+func showName(rel string, mode uint32) string {
+	if rel == "" {
+		return "./"
+	}
+	if mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return rel + "/"
+	}
+	return rel
+}
+
+// Synchronize a single entry (and for directories, everything
+// beneath it).
+func (s *syncer) syncPath(rel string) (err error) {
+	spath := filepath.Join(s.src, rel)
+	dpath := filepath.Join(s.dest, rel)
+
+	var sst syscall.Stat_t
+	err = syscall.Lstat(spath, &sst)
+	if err != nil {
+		return &os.PathError{Op: "lstat", Path: spath, Err: err}
+	}
+	s.progress()
+
+	var dst syscall.Stat_t
+	exists := true
+	err = syscall.Lstat(dpath, &dst)
+	if err == syscall.ENOENT {
+		exists = false
+	} else if err != nil {
+		return &os.PathError{Op: "lstat", Path: dpath, Err: err}
+	}
+	err = nil
+
+	sfmt := sst.Mode & syscall.S_IFMT
+
+	// Anything of the wrong type is replaced.
+	if exists && dst.Mode&syscall.S_IFMT != sfmt {
+		err = os.RemoveAll(dpath)
+		if err != nil {
+			return
+		}
+		exists = false
+	}
+
+	// Further links to an already seen file become hardlinks.
+	if sfmt != syscall.S_IFDIR && sst.Nlink > 1 {
+		id := fileID{dev: sst.Dev, ino: sst.Ino}
+		if first, ok := s.links[id]; ok {
+			return s.hardlink(rel, first, exists, &dst)
+		}
+		s.links[id] = rel
+	}
+
+	it := newItem(kindOf(sst.Mode))
+	created := !exists
+
+	switch sfmt {
+	case syscall.S_IFREG:
+		if !exists && s.opts.LinkDest != "" {
+			var linked bool
+			linked, err = s.linkDest(rel, spath, dpath, &sst)
+			if err != nil || linked {
+				return
+			}
+		}
+
+		if !exists || dst.Size != sst.Size || dst.Mtim != sst.Mtim {
+			it[0] = '>'
+			if exists {
+				if dst.Size != sst.Size {
+					it[3] = 's'
+				}
+				if dst.Mtim != sst.Mtim {
+					it[4] = 't'
+				}
+			}
+			err = s.copyFile(spath, dpath, sst.Size)
+			if err != nil {
+				return
+			}
+			// The copy is a new file, so all of the
+			// metadata needs to be set.
+			exists = false
+		}
+
+	case syscall.S_IFDIR:
+		if !exists {
+			err = os.Mkdir(dpath, 0700)
+			if err != nil {
+				return
+			}
+
+			// Show new directories before their contents,
+			// the way rsync does.
+			it[0] = 'c'
+			it.create()
+			s.item(it, showName(rel, sst.Mode), true)
+		}
+
+		err = s.syncDir(rel)
+		if err != nil {
+			return
+		}
+
+	case syscall.S_IFLNK:
+		var target string
+		target, err = os.Readlink(spath)
+		if err != nil {
+			return
+		}
+
+		if exists {
+			old, rerr := os.Readlink(dpath)
+			if rerr != nil || old != target {
+				err = os.Remove(dpath)
+				if err != nil {
+					return
+				}
+				exists = false
+				it[0] = 'c'
+				it[2] = 'c'
+			}
+		}
+
+		if !exists {
+			err = os.Symlink(target, dpath)
+			if err != nil {
+				return
+			}
+		}
+
+		rel = fmt.Sprintf("%s -> %s", rel, target)
+
+	default:
+		if exists && dst.Rdev != sst.Rdev {
+			err = os.Remove(dpath)
+			if err != nil {
+				return
+			}
+			exists = false
+			it[0] = 'c'
+			it[2] = 'c'
+		}
+
+		if !exists {
+			err = syscall.Mknod(dpath, sst.Mode&(syscall.S_IFMT|07777), int(sst.Rdev))
+			if err != nil {
+				return &os.PathError{Op: "mknod", Path: dpath, Err: err}
+			}
+		}
+	}
+
+	if created {
+		if sfmt == syscall.S_IFREG {
+			it[0] = '>'
+		} else {
+			it[0] = 'c'
+		}
+		it.create()
+	}
+
+	var old *syscall.Stat_t
+	if exists {
+		old = &dst
+	}
+	err = s.setMeta(spath, dpath, &sst, old, &it)
+	if err != nil {
+		return
+	}
+
+	if !(created && sfmt == syscall.S_IFDIR) {
+		s.item(it, showName(rel, sst.Mode), created)
+	}
+	return
+}
+
+// Synchronize the contents of a directory that exists in both trees.
+func (s *syncer) syncDir(rel string) (err error) {
+	snames, err := readNames(filepath.Join(s.src, rel))
+	if err != nil {
+		return
+	}
+
+	if s.opts.Delete {
+		var dnames []string
+		dnames, err = readNames(filepath.Join(s.dest, rel))
+		if err != nil {
+			return
+		}
+
+		present := make(map[string]bool)
+		for _, n := range snames {
+			present[n] = true
+		}
+
+		for _, n := range dnames {
+			if !present[n] {
+				err = s.remove(filepath.Join(rel, n))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	for _, n := range snames {
+		err = s.syncPath(filepath.Join(rel, n))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Remove an extraneous entry from the destination, showing each
+// deleted name, deepest first.
+func (s *syncer) remove(rel string) (err error) {
+	dpath := filepath.Join(s.dest, rel)
+
+	fi, err := os.Lstat(dpath)
+	if err != nil {
+		return
+	}
+
+	name := rel
+	if fi.IsDir() {
+		var names []string
+		names, err = readNames(dpath)
+		if err != nil {
+			return
+		}
+		for _, n := range names {
+			err = s.remove(filepath.Join(rel, n))
+			if err != nil {
+				return
+			}
+		}
+		name += "/"
+	}
+
+	err = os.Remove(dpath)
+	if err != nil {
+		return
+	}
+
+	s.stats.Deleted++
+	if s.opts.Itemize != nil {
+		fmt.Fprintf(s.opts.Itemize, "*deleting   %s\n", name)
+	}
+	return
+}
+
+// Make rel a hardlink to the already synchronized first.
+func (s *syncer) hardlink(rel, first string, exists bool, dst *syscall.Stat_t) (err error) {
+	dpath := filepath.Join(s.dest, rel)
+	fpath := filepath.Join(s.dest, first)
+
+	var fst syscall.Stat_t
+	err = syscall.Lstat(fpath, &fst)
+	if err != nil {
+		return &os.PathError{Op: "lstat", Path: fpath, Err: err}
+	}
+
+	if exists {
+		if dst.Dev == fst.Dev && dst.Ino == fst.Ino {
+			return
+		}
+		err = os.Remove(dpath)
+		if err != nil {
+			return
+		}
+	}
+
+	err = os.Link(fpath, dpath)
+	if err != nil {
+		return
+	}
+
+	it := newItem(kindOf(fst.Mode))
+	it[0] = 'h'
+	it.create()
+	s.item(it, fmt.Sprintf("%s => %s", rel, first), true)
+	return
+}
+
+// Try to hardlink a new file from the LinkDest tree.  The file there
+// must match in contents (by size and time) and in all of its
+// metadata, since the link shares it.
+func (s *syncer) linkDest(rel, spath, dpath string, sst *syscall.Stat_t) (linked bool, err error) {
+	lpath := filepath.Join(s.opts.LinkDest, rel)
+
+	var lst syscall.Stat_t
+	if syscall.Lstat(lpath, &lst) != nil {
+		return
+	}
+
+	if lst.Mode != sst.Mode || lst.Size != sst.Size || lst.Mtim != sst.Mtim ||
+		lst.Uid != sst.Uid || lst.Gid != sst.Gid {
+		return
+	}
+
+	sattrs, err := GetXattrs(spath)
+	if err != nil {
+		return
+	}
+	lattrs, err := GetXattrs(lpath)
+	if err != nil {
+		return
+	}
+	if len(sattrs) != len(lattrs) {
+		return
+	}
+	for key, value := range sattrs {
+		if !bytes.Equal(value, lattrs[key]) {
+			return
+		}
+	}
+
+	err = os.Link(lpath, dpath)
+	if err != nil {
+		return
+	}
+
+	// Linked files aren't shown or counted as changes, as with
+	// rsync.
+	linked = true
+	return
+}
+
+// Copy the contents of a regular file.  The data is written to a
+// temporary file alongside the destination, which is then renamed
+// into place.
+func (s *syncer) copyFile(spath, dpath string, size int64) (err error) {
+	src, err := os.Open(spath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	tmp := filepath.Join(filepath.Dir(dpath), "."+filepath.Base(dpath)+".tsync")
+	dest, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		// Left from an interrupted run.
+		err = os.Remove(tmp)
+		if err == nil {
+			dest, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	n, err := io.Copy(dest, src)
+	cerr := dest.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = errors.New(fmt.Sprintf("%q changed size while copying", spath))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	s.stats.Bytes += n
+
+	err = os.Rename(tmp, dpath)
+	return
+}
+
+// Bring the metadata of the destination up to date.  old is the
+// previous state of the destination, or nil if it has just been
+// created.
+func (s *syncer) setMeta(spath, dpath string, sst, old *syscall.Stat_t, it *itemFlags) (err error) {
+	isLink := sst.Mode&syscall.S_IFMT == syscall.S_IFLNK
+
+	if old == nil || old.Uid != sst.Uid || old.Gid != sst.Gid {
+		err = os.Lchown(dpath, int(sst.Uid), int(sst.Gid))
+		if err != nil {
+			return
+		}
+		if old != nil {
+			if old.Uid != sst.Uid {
+				it[6] = 'o'
+			}
+			if old.Gid != sst.Gid {
+				it[7] = 'g'
+			}
+		}
+	}
+
+	// Changing the owner can clear the setuid bits, so the mode
+	// always needs setting after a chown.
+	if !isLink && (old == nil || old.Mode&07777 != sst.Mode&07777 ||
+		old.Uid != sst.Uid || old.Gid != sst.Gid) {
+		err = syscall.Chmod(dpath, sst.Mode&07777)
+		if err != nil {
+			return &os.PathError{Op: "chmod", Path: dpath, Err: err}
+		}
+		if old != nil && old.Mode&07777 != sst.Mode&07777 {
+			it[5] = 'p'
+		}
+	}
+
+	err = s.syncXattrs(spath, dpath, old != nil, it)
+	if err != nil {
+		return
+	}
+
+	if old == nil || old.Mtim != sst.Mtim {
+		err = lsetMtime(dpath, sst.Mtim)
+		if err != nil {
+			return &os.PathError{Op: "utimensat", Path: dpath, Err: err}
+		}
+		if old != nil {
+			it[4] = 't'
+		}
+	}
+
+	return
+}
+
+const aclPrefix = "system.posix_acl_"
+
+func (s *syncer) syncXattrs(spath, dpath string, show bool, it *itemFlags) (err error) {
+	sattrs, err := GetXattrs(spath)
+	if err != nil {
+		return
+	}
+	dattrs, err := GetXattrs(dpath)
+	if err != nil {
+		return
+	}
+
+	mark := func(key string) {
+		if !show {
+			return
+		}
+		if len(key) > len(aclPrefix) && key[:len(aclPrefix)] == aclPrefix {
+			it[9] = 'a'
+		} else {
+			it[10] = 'x'
+		}
+	}
+
+	for key, value := range sattrs {
+		if old, ok := dattrs[key]; ok && bytes.Equal(old, value) {
+			continue
+		}
+		err = lsetxattr(dpath, key, value)
+		if err != nil {
+			return &os.PathError{Op: "setxattr " + key, Path: dpath, Err: err}
+		}
+		mark(key)
+	}
+
+	for key := range dattrs {
+		if _, ok := sattrs[key]; ok {
+			continue
+		}
+		err = lremovexattr(dpath, key)
+		if err != nil {
+			return &os.PathError{Op: "removexattr " + key, Path: dpath, Err: err}
+		}
+		mark(key)
+	}
+
+	return
+}
+
+// Read the names in a directory, in sorted order.
+func readNames(dir string) (names []string, err error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	names = make([]string, len(ents))
+	for i, e := range ents {
+		names[i] = e.Name()
+	}
+	return
+}
@@ -0,0 +1,266 @@
+// Test the native tree synchronizer.
+
+package tsync_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+	"tsync"
+)
+
+// Build a small tree exercising each kind of node.
+func buildTree(t *testing.T, root string) {
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("Building tree: %s", err)
+		}
+	}
+
+	must(os.MkdirAll(filepath.Join(root, "a/b/c"), 0755))
+	must(os.Mkdir(filepath.Join(root, "private"), 0700))
+	must(os.WriteFile(filepath.Join(root, "a/one"), []byte("one\n"), 0644))
+	must(os.WriteFile(filepath.Join(root, "a/b/two"), bytes.Repeat([]byte("two"), 10000), 0600))
+	must(os.WriteFile(filepath.Join(root, "private/exec"), []byte("#!/bin/sh\n"), 0755))
+	must(os.WriteFile(filepath.Join(root, "empty"), nil, 0640))
+	must(os.Link(filepath.Join(root, "a/one"), filepath.Join(root, "a/b/c/one-link")))
+	must(os.Symlink("../one", filepath.Join(root, "a/b/rel-link")))
+	must(os.Symlink("/nonexistent", filepath.Join(root, "dangling")))
+	must(syscall.Mkfifo(filepath.Join(root, "fifo"), 0620))
+
+	// Extended attributes aren't supported everywhere.
+	err := syscall.Setxattr(filepath.Join(root, "a/one"), "user.test", []byte("value"), 0)
+	if err != nil {
+		t.Logf("Not testing xattrs: %s", err)
+	}
+
+	old := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+	must(os.Chtimes(filepath.Join(root, "empty"), old, old))
+	must(os.Chtimes(filepath.Join(root, "a/b"), old, old))
+}
+
+// A description of a tree, that can be compared with another.
+func describe(t *testing.T, root string) string {
+	var buf bytes.Buffer
+	inodes := make(map[uint64]string)
+
+	names := make([]string, 0)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		names = append(names, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walking %q: %s", root, err)
+	}
+	sort.Strings(names)
+
+	for _, path := range names {
+		rel, _ := filepath.Rel(root, path)
+
+		var st syscall.Stat_t
+		err = syscall.Lstat(path, &st)
+		if err != nil {
+			t.Fatalf("lstat: %s", err)
+		}
+
+		fmt.Fprintf(&buf, "%s mode=%o uid=%d gid=%d", rel, st.Mode, st.Uid, st.Gid)
+
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFREG:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			fmt.Fprintf(&buf, " size=%d data=%x", st.Size, data)
+			fmt.Fprintf(&buf, " mtime=%d.%09d", st.Mtim.Sec, st.Mtim.Nsec)
+		case syscall.S_IFLNK:
+			target, _ := os.Readlink(path)
+			fmt.Fprintf(&buf, " target=%q", target)
+		case syscall.S_IFDIR:
+			// Directory times depend on when the children
+			// were created, only check the ones we set.
+			if rel == filepath.Join("a", "b") {
+				fmt.Fprintf(&buf, " mtime=%d", st.Mtim.Sec)
+			}
+		}
+
+		if st.Nlink > 1 && st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			if first, ok := inodes[st.Ino]; ok {
+				fmt.Fprintf(&buf, " link=%s", first)
+			} else {
+				inodes[st.Ino] = rel
+			}
+		}
+
+		buf.WriteString(describeXattrs(path))
+		buf.WriteByte('\n')
+	}
+
+	return buf.String()
+}
+
+func describeXattrs(path string) string {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil || sz == 0 {
+		return ""
+	}
+	list := make([]byte, sz)
+	sz, _ = syscall.Listxattr(path, list)
+
+	keys := make([]string, 0)
+	for _, k := range bytes.Split(list[:sz], []byte{0}) {
+		if len(k) > 0 {
+			keys = append(keys, string(k))
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		value := make([]byte, 256)
+		n, _ := syscall.Getxattr(path, k, value)
+		fmt.Fprintf(&buf, " %s=%q", k, value[:n])
+	}
+	return buf.String()
+}
+
+func TestSync(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest := filepath.Join(tmp, "dest")
+
+	buildTree(t, src)
+
+	var out bytes.Buffer
+	stats, err := tsync.Sync(src, dest, &tsync.Options{Delete: true, Itemize: &out})
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	t.Logf("First sync: %s\n%s", stats, out.String())
+
+	if a, b := describe(t, src), describe(t, dest); a != b {
+		t.Fatalf("Trees differ after sync:\nsrc:\n%s\ndest:\n%s", a, b)
+	}
+
+	// A second sync should change nothing.
+	out.Reset()
+	stats, err = tsync.Sync(src, dest, &tsync.Options{Delete: true, Itemize: &out})
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if stats.Created+stats.Updated+stats.Deleted != 0 {
+		t.Errorf("Resync made changes: %s\n%s", stats, out.String())
+	}
+
+	// Change things, and make sure they are brought across.
+	err = os.WriteFile(filepath.Join(src, "a/one"), []byte("changed\n"), 0644)
+	if err == nil {
+		err = os.RemoveAll(filepath.Join(src, "a/b/c"))
+	}
+	if err == nil {
+		err = os.Chmod(filepath.Join(src, "private/exec"), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dest, "extra"), []byte("extra"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Modifying tree: %s", err)
+	}
+
+	out.Reset()
+	stats, err = tsync.Sync(src, dest, &tsync.Options{Delete: true, Itemize: &out})
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	t.Logf("Update sync: %s\n%s", stats, out.String())
+
+	if stats.Deleted != 3 {
+		t.Errorf("Expecting 3 deletes, got %d", stats.Deleted)
+	}
+	if a, b := describe(t, src), describe(t, dest); a != b {
+		t.Fatalf("Trees differ after update:\nsrc:\n%s\ndest:\n%s", a, b)
+	}
+}
+
+// The result should be the same as rsync's.
+func TestSyncMatchesRsync(t *testing.T) {
+	rsync, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("rsync not available")
+	}
+
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	native := filepath.Join(tmp, "native")
+	other := filepath.Join(tmp, "rsync")
+
+	buildTree(t, src)
+
+	_, err = tsync.Sync(src, native, &tsync.Options{Delete: true})
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+
+	out, err := exec.Command(rsync, "-aXH", "--delete", src+"/.", other).CombinedOutput()
+	if err != nil {
+		t.Fatalf("rsync: %s\n%s", err, out)
+	}
+
+	if a, b := describe(t, native), describe(t, other); a != b {
+		t.Fatalf("Native and rsync differ:\nnative:\n%s\nrsync:\n%s", a, b)
+	}
+}
+
+// Unchanged files should be linked from a previous copy.
+func TestSyncLinkDest(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	prev := filepath.Join(tmp, "prev")
+	dest := filepath.Join(tmp, "dest")
+
+	buildTree(t, src)
+
+	_, err := tsync.Sync(src, prev, &tsync.Options{Delete: true})
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+
+	err = os.WriteFile(filepath.Join(src, "a/b/two"), []byte("new contents"), 0600)
+	if err != nil {
+		t.Fatalf("Modifying tree: %s", err)
+	}
+
+	stats, err := tsync.Sync(src, dest, &tsync.Options{Delete: true, LinkDest: prev})
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if stats.Bytes != int64(len("new contents")) {
+		t.Errorf("Expecting only the changed file to be copied: %s", stats)
+	}
+
+	if a, b := describe(t, src), describe(t, dest); a != b {
+		t.Fatalf("Trees differ after sync:\nsrc:\n%s\ndest:\n%s", a, b)
+	}
+
+	same := func(name string) bool {
+		var a, b syscall.Stat_t
+		syscall.Lstat(filepath.Join(prev, name), &a)
+		syscall.Lstat(filepath.Join(dest, name), &b)
+		return a.Ino == b.Ino
+	}
+	if !same("private/exec") {
+		t.Errorf("Unchanged file not linked")
+	}
+	if same("a/b/two") {
+		t.Errorf("Changed file was linked")
+	}
+}